@@ -12,9 +12,12 @@ import java.util.Optional;
 import java.util.UUID;
 import java.util.ArrayList;
 import java.util.HashMap;
+import java.time.Instant;
 
 import com.authzed.api.v1.*;
 import com.authzed.grpcutil.BearerToken;
+import com.google.protobuf.Struct;
+import com.google.protobuf.Value;
 import io.grpc.ManagedChannel;
 import io.grpc.ManagedChannelBuilder;
 
@@ -75,7 +78,18 @@ public class DocumentController {
                                 .setObjectType("user")
                                 .setObjectId(username)
                                 .build())
-                        .build());
+                        .build())
+                .setContext(caveatContext());
+    }
+
+    // Expiring group memberships are caveated on the current time; without it
+    // SpiceDB can only answer CONDITIONAL, which we treat as no access
+    private Struct caveatContext() {
+        return Struct.newBuilder()
+                .putFields("now", Value.newBuilder()
+                        .setStringValue(Instant.now().toString())
+                        .build())
+                .build();
     }
     
     private CheckPermissionRequest buildPermissionCheckWithZedtoken(String resourceType, String resourceId, String permission, String username, String zedtoken) {
@@ -213,6 +227,7 @@ public class DocumentController {
                                         .setObjectId(username)
                                         .build())
                                 .build())
+                        .setContext(caveatContext())
                         .build();
 
                 CheckPermissionResponse parentPermResponse = permClient.checkPermission(parentPermRequest);
@@ -241,6 +256,7 @@ public class DocumentController {
                                         .setObjectId(username)
                                         .build())
                                 .build())
+                        .setContext(caveatContext())
                         .build();
 
                 CheckPermissionResponse rootPermResponse = permClient.checkPermission(rootPermRequest);
@@ -536,6 +552,7 @@ public class DocumentController {
                                     .setObjectId(username)
                                     .build())
                             .build())
+                    .setContext(caveatContext())
                     .build();
 
             CheckPermissionResponse permResponse = permClient.checkPermission(permRequest);
@@ -603,6 +620,7 @@ public class DocumentController {
                                     .setObjectId(username)
                                     .build())
                             .build())
+                    .setContext(caveatContext())
                     .build();
 
             CheckPermissionResponse permResponse = permClient.checkPermission(permRequest);
@@ -669,6 +687,7 @@ public class DocumentController {
                                     .setObjectId(username)
                                     .build())
                             .build())
+                    .setContext(caveatContext())
                     .build();
 
             CheckPermissionResponse permResponse = permClient.checkPermission(permRequest);
@@ -741,6 +760,7 @@ public class DocumentController {
                                     .setObjectId(username)
                                     .build())
                             .build())
+                    .setContext(caveatContext())
                     .build();
 
             CheckPermissionResponse permResponse = permClient.checkPermission(permRequest);
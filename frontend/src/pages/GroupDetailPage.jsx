@@ -11,6 +11,7 @@ function GroupDetailPage({ currentUser }) {
   const [users, setUsers] = useState([])
   const [newMemberUsername, setNewMemberUsername] = useState('')
   const [newMemberRole, setNewMemberRole] = useState('MEMBER')
+  const [newMemberExpiresAt, setNewMemberExpiresAt] = useState('')
   const [loading, setLoading] = useState(true)
   const [error, setError] = useState(null)
   const [permissionDenied, setPermissionDenied] = useState(false)
@@ -78,6 +79,68 @@ function GroupDetailPage({ currentUser }) {
     fetchUsers()
   }, [fetchGroupDetails, fetchGroupMembers, fetchUsers])
 
+  // Follow live changes made by other admins. EventSource can't send the
+  // X-Username header, so the event stream is read with fetch instead.
+  useEffect(() => {
+    const controller = new AbortController()
+    let lastEventId = null
+
+    const handleEvent = (type) => {
+      if (type === 'group.deleted' || type === 'revoked') {
+        navigate('/groups')
+      } else if (type.startsWith('member.') || type === 'role.changed') {
+        fetchGroupMembers()
+        fetchGroupDetails()
+      } else if (type === 'group.updated') {
+        fetchGroupDetails()
+      }
+    }
+
+    const follow = async () => {
+      while (!controller.signal.aborted) {
+        try {
+          const headers = { 'X-Username': currentUser.username }
+          if (lastEventId) {
+            headers['Last-Event-ID'] = lastEventId
+          }
+          const response = await fetch(`http://localhost:3001/groups/${username}/events`, {
+            headers,
+            signal: controller.signal
+          })
+          if (!response.ok) {
+            return
+          }
+
+          const reader = response.body.pipeThrough(new TextDecoderStream()).getReader()
+          let buffer = ''
+          for (;;) {
+            const { value, done } = await reader.read()
+            if (done) break
+            buffer += value
+            let end
+            while ((end = buffer.indexOf('\n\n')) >= 0) {
+              const block = buffer.slice(0, end)
+              buffer = buffer.slice(end + 2)
+              let type = null
+              for (const line of block.split('\n')) {
+                if (line.startsWith('id: ')) lastEventId = line.slice(4)
+                if (line.startsWith('event: ')) type = line.slice(7)
+              }
+              if (type) handleEvent(type)
+            }
+          }
+        } catch (error) {
+          if (controller.signal.aborted) return
+          console.error('Group event stream interrupted:', error)
+        }
+        await new Promise(resolve => setTimeout(resolve, 3000))
+      }
+    }
+
+    follow()
+    return () => controller.abort()
+  }, [username, currentUser.username, fetchGroupMembers, fetchGroupDetails, navigate])
+
   const addMember = async () => {
     if (!newMemberUsername.trim()) return
 
@@ -90,7 +153,8 @@ function GroupDetailPage({ currentUser }) {
         },
         body: JSON.stringify({
           username: newMemberUsername,
-          role: newMemberRole
+          role: newMemberRole,
+          ...(newMemberRole === 'MEMBER' && newMemberExpiresAt && { expires_at: newMemberExpiresAt })
         })
       })
 
@@ -98,6 +162,7 @@ function GroupDetailPage({ currentUser }) {
         await fetchGroupMembers()
         setNewMemberUsername('')
         setNewMemberRole('MEMBER')
+        setNewMemberExpiresAt('')
         
         // If we're adding an owner, refresh group details to update owners list
         if (newMemberRole === 'OWNER') {
@@ -258,6 +323,13 @@ function GroupDetailPage({ currentUser }) {
                   <WiredItem value="MANAGER" >Manager</WiredItem>
                   <WiredItem value="OWNER" >Owner</WiredItem>
                 </WiredCombo>
+                {newMemberRole === 'MEMBER' && (
+                  <WiredInput
+                    placeholder="Expires (YYYY-MM-DD, optional)"
+                    value={newMemberExpiresAt}
+                    onChange={(e) => setNewMemberExpiresAt(e.target.value)}
+                  />
+                )}
                 <WiredButton onClick={addMember}>Add Member</WiredButton>
               </div>
             </WiredCard>
@@ -289,7 +361,18 @@ function GroupDetailPage({ currentUser }) {
                         <div><strong>{member.username}</strong></div>
                         <div style={{ color: '#666', fontSize: '14px' }}>
                           Role: {member.role}
+                          {member.expires_at && ` · expires ${member.expires_at}`}
                         </div>
+                        {member.joined_at && (
+                          <div style={{ color: '#666', fontSize: '12px' }}>
+                            Joined {member.joined_at}{member.added_by && ` · added by ${member.added_by}`}
+                          </div>
+                        )}
+                        {member.note && (
+                          <div style={{ color: '#666', fontSize: '12px', fontStyle: 'italic' }}>
+                            {member.note}
+                          </div>
+                        )}
                       </div>
                       <WiredButton 
                         onClick={() => removeMember(member.username)}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type GroupAlias struct {
+	Alias     string `json:"alias"`
+	Email     string `json:"email"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Find the group an address local part belongs to, either by group username or alias
+func lookupGroupByLocalPart(localPart string) (string, bool, error) {
+	var groupUsername string
+	err := db.QueryRow(`
+		SELECT username FROM groups WHERE username = $1
+		UNION ALL
+		SELECT group_username FROM group_aliases WHERE alias = $1
+		LIMIT 1
+	`, localPart).Scan(&groupUsername)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return groupUsername, true, nil
+}
+
+func getGroupAliases(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	// Check permission to manage aliases
+	if !checkPrincipalPermission(c, groupUsername, "manage_aliases") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT alias, created_by, created_at
+		FROM group_aliases
+		WHERE group_username = $1
+		ORDER BY alias
+	`, groupUsername)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group aliases"})
+		return
+	}
+	defer rows.Close()
+
+	aliases := []GroupAlias{}
+	for rows.Next() {
+		var alias GroupAlias
+		var createdAt time.Time
+		if err := rows.Scan(&alias.Alias, &alias.CreatedBy, &createdAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan group alias"})
+			return
+		}
+		alias.Email = emailAddress(alias.Alias)
+		alias.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		aliases = append(aliases, alias)
+	}
+
+	c.JSON(http.StatusOK, aliases)
+}
+
+func addGroupAlias(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	// Check permission to manage aliases
+	principal := currentPrincipal(c)
+	if !checkPrincipalPermission(c, groupUsername, "manage_aliases") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	type AddAliasRequest struct {
+		Alias string `json:"alias" binding:"required"`
+	}
+
+	var req AddAliasRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Accept either a bare alias or a full address in our domain
+	alias := strings.ToLower(strings.TrimSpace(req.Alias))
+	if localPart, domain, err := parseAddress(alias); err == nil {
+		if domain != emailDomain {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Alias must be in the %s domain", emailDomain)})
+			return
+		}
+		alias = localPart
+	}
+	if alias == "" || strings.ContainsAny(alias, "@ \t") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alias"})
+		return
+	}
+
+	exists, err := groupExists(groupUsername)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check group existence"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group alias"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Aliases share a namespace with users, groups and other aliases
+	if err := validateUsername(tx, alias); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO group_aliases (alias, group_username, created_by)
+		VALUES ($1, $2, $3)
+	`, alias, groupUsername, principal.Actor())
+	if err == nil {
+		err = recordGroupEvent(tx, &GroupEvent{
+			Type:          "group.updated",
+			GroupUsername: groupUsername,
+			Actor:         principal.Actor(),
+			Data:          eventData(gin.H{"change": "alias_added", "alias": alias}),
+		})
+	}
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "alias.added",
+			GroupUsername: groupUsername,
+			Subject:       alias,
+			After:         gin.H{"alias": alias, "email": emailAddress(alias)},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to create alias %s for group %s: %v", alias, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group alias"})
+		return
+	}
+
+	log.Printf("Alias %s added to group %s by %s", alias, groupUsername, principal.Actor())
+	c.JSON(http.StatusCreated, GroupAlias{
+		Alias:     alias,
+		Email:     emailAddress(alias),
+		CreatedBy: principal.Actor(),
+		CreatedAt: time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+func removeGroupAlias(c *gin.Context) {
+	groupUsername := c.Param("username")
+	alias := strings.ToLower(c.Param("alias"))
+
+	// Check permission to manage aliases
+	principal := currentPrincipal(c)
+	if !checkPrincipalPermission(c, groupUsername, "manage_aliases") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group alias"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		DELETE FROM group_aliases
+		WHERE alias = $1 AND group_username = $2
+	`, alias, groupUsername)
+	if err != nil {
+		log.Printf("Failed to delete alias %s for group %s: %v", alias, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group alias"})
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alias not found"})
+		return
+	}
+
+	err = recordGroupEvent(tx, &GroupEvent{
+		Type:          "group.updated",
+		GroupUsername: groupUsername,
+		Actor:         principal.Actor(),
+		Data:          eventData(gin.H{"change": "alias_removed", "alias": alias}),
+	})
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "alias.removed",
+			GroupUsername: groupUsername,
+			Subject:       alias,
+			Before:        gin.H{"alias": alias, "email": emailAddress(alias)},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to delete alias %s for group %s: %v", alias, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group alias"})
+		return
+	}
+
+	log.Printf("Alias %s removed from group %s by %s", alias, groupUsername, principal.Actor())
+	c.JSON(http.StatusOK, gin.H{"message": "Alias removed successfully"})
+}
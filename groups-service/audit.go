@@ -0,0 +1,318 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+type AuditEvent struct {
+	Actor          string
+	ImpersonatedBy string
+	Action         string
+	GroupUsername  string
+	Subject        string
+	Before         interface{}
+	After          interface{}
+	Zedtoken       string
+	RequestID      string
+	// The outbox entry carrying the SpiceDB side of the change, when the
+	// event is recorded before that write is made
+	OutboxID int64
+}
+
+// An audit event as returned by the query API
+type AuditRecord struct {
+	ID             int64           `json:"id"`
+	Actor          string          `json:"actor"`
+	ImpersonatedBy string          `json:"impersonated_by,omitempty"`
+	Action         string          `json:"action"`
+	GroupUsername  string          `json:"group_username,omitempty"`
+	Subject        string          `json:"subject,omitempty"`
+	Before         json.RawMessage `json:"before,omitempty"`
+	After          json.RawMessage `json:"after,omitempty"`
+	Zedtoken       string          `json:"zedtoken,omitempty"`
+	RequestID      string          `json:"request_id,omitempty"`
+	CreatedAt      string          `json:"created_at"`
+}
+
+// Encode a before/after state for storage, keeping absent states NULL
+func auditState(state interface{}) (sql.NullString, error) {
+	if state == nil {
+		return sql.NullString{}, nil
+	}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(encoded), Valid: true}, nil
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// Append an event to the audit log through exec. Handlers pass the transaction
+// that makes the change, so the change and its audit row commit together.
+func recordAuditEventTx(exec execer, event AuditEvent) error {
+	before, err := auditState(event.Before)
+	if err != nil {
+		return err
+	}
+	after, err := auditState(event.After)
+	if err != nil {
+		return err
+	}
+
+	_, err = exec.Exec(`
+		INSERT INTO audit_events (actor, impersonated_by, action, group_username, subject, before_state, after_state, zedtoken, request_id, outbox_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, event.Actor, nullString(event.ImpersonatedBy), event.Action, nullString(event.GroupUsername), nullString(event.Subject), before, after,
+		nullString(event.Zedtoken), nullString(event.RequestID), sql.NullInt64{Int64: event.OutboxID, Valid: event.OutboxID != 0})
+	if err != nil {
+		log.Printf("Failed to record audit event %s by %s: %v", event.Action, event.Actor, err)
+		return err
+	}
+
+	log.Printf("[AUDIT] actor=%s impersonated_by=%s action=%s group=%s subject=%s zedtoken=%s request_id=%s",
+		event.Actor, event.ImpersonatedBy, event.Action, event.GroupUsername, event.Subject, event.Zedtoken, event.RequestID)
+	return nil
+}
+
+// Append an event to the audit log on its own, for changes with no Postgres
+// side to share a transaction with
+func recordAuditEvent(event AuditEvent) error {
+	return recordAuditEventTx(db, event)
+}
+
+// Fill in the actor and request ID of an event from the request
+func requestAuditEvent(c *gin.Context, event AuditEvent) AuditEvent {
+	if principal := currentPrincipal(c); principal != nil {
+		if event.Actor == "" {
+			event.Actor = principal.Actor()
+		}
+		event.ImpersonatedBy = principal.ImpersonatedBy
+	}
+	event.RequestID = c.GetString(requestIDContextKey)
+	return event
+}
+
+// Append an event for a change made through the API in the transaction that
+// makes it. A failure is returned so the change is rolled back with it.
+func recordRequestAuditEventTx(c *gin.Context, exec execer, event AuditEvent) error {
+	return recordAuditEventTx(exec, requestAuditEvent(c, event))
+}
+
+// Build the WHERE clause for an audit query from its filters
+func auditQueryFilters(c *gin.Context) (string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if group := c.Query("group"); group != "" {
+		add("group_username = $%d", group)
+	}
+	if actor := c.Query("actor"); actor != "" {
+		add("(actor = $%[1]d OR impersonated_by = $%[1]d)", actor)
+	}
+	if subject := c.Query("subject"); subject != "" {
+		add("subject = $%d", subject)
+	}
+	if action := c.Query("action"); action != "" {
+		// "member.*" matches every member action
+		if strings.HasSuffix(action, ".*") {
+			add("action LIKE $%d", strings.TrimSuffix(action, "*")+"%")
+		} else {
+			add("action = $%d", action)
+		}
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := parseExportTime(from)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid from date. Use YYYY-MM-DD or RFC 3339")
+		}
+		add("created_at >= $%d", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseExportTime(to)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid to date. Use YYYY-MM-DD or RFC 3339")
+		}
+		add("created_at < $%d", t)
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		id, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid cursor")
+		}
+		add("id < $%d", id)
+	}
+
+	if len(conditions) == 0 {
+		return "", args, nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+func scanAuditRecord(rows *sql.Rows) (AuditRecord, error) {
+	var record AuditRecord
+	var before, after string
+	var createdAt time.Time
+	err := rows.Scan(&record.ID, &record.Actor, &record.ImpersonatedBy, &record.Action, &record.GroupUsername,
+		&record.Subject, &before, &after, &record.Zedtoken, &record.RequestID, &createdAt)
+	if err != nil {
+		return record, err
+	}
+	if before != "" {
+		record.Before = json.RawMessage(before)
+	}
+	if after != "" {
+		record.After = json.RawMessage(after)
+	}
+	record.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	return record, nil
+}
+
+// Query the audit log, newest first. Platform admins can see everything;
+// group admins can see their own group's events by filtering on it.
+func getAuditEvents(c *gin.Context) {
+	username := currentUsername(c)
+	group := c.Query("group")
+	allowed := username != "" && checkPlatformPermission(username, "view_audit")
+	if !allowed && group != "" {
+		allowed = checkPrincipalPermission(c, group, "view_audit")
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format. Must be json or csv"})
+		return
+	}
+
+	where, args, err := auditQueryFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Events recorded with an outbox entry take its zedtoken once it is applied
+	query := `
+		SELECT id, actor, COALESCE(impersonated_by, ''), action, COALESCE(group_username, ''), COALESCE(subject, ''),
+		       COALESCE(before_state::text, ''), COALESCE(after_state::text, ''),
+		       COALESCE(zedtoken, (SELECT o.zedtoken FROM spicedb_outbox o WHERE o.id = audit_events.outbox_id), ''),
+		       COALESCE(request_id, ''), created_at
+		FROM audit_events` + where + `
+		ORDER BY id DESC`
+
+	if format == "csv" {
+		exportAuditEvents(c, query, args)
+		return
+	}
+
+	limit := defaultAuditPageSize
+	if v := c.Query("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxAuditPageSize)})
+			return
+		}
+	}
+	args = append(args, limit+1)
+	query += fmt.Sprintf(" LIMIT $%d", len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to query audit events: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit events"})
+		return
+	}
+	defer rows.Close()
+
+	events := []AuditRecord{}
+	for rows.Next() {
+		record, err := scanAuditRecord(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan audit event"})
+			return
+		}
+		events = append(events, record)
+	}
+
+	// Fetching one extra row tells us whether there is another page
+	response := gin.H{"events": events}
+	if len(events) > limit {
+		events = events[:limit]
+		response["events"] = events
+		response["next_cursor"] = strconv.FormatInt(events[limit-1].ID, 10)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Stream every matching audit event as CSV
+func exportAuditEvents(c *gin.Context, query string, args []interface{}) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to export audit events: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export audit events"})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Disposition", `attachment; filename="audit-events.csv"`)
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "created_at", "actor", "impersonated_by", "action", "group", "subject", "before", "after", "zedtoken", "request_id"})
+
+	count := 0
+	for rows.Next() {
+		record, err := scanAuditRecord(rows)
+		if err != nil {
+			// Headers are already sent, so all we can do is cut the export short
+			log.Printf("Failed to scan exported audit event: %v", err)
+			break
+		}
+		w.Write([]string{
+			strconv.FormatInt(record.ID, 10), record.CreatedAt, record.Actor, record.ImpersonatedBy, record.Action,
+			record.GroupUsername, record.Subject, string(record.Before), string(record.After), record.Zedtoken, record.RequestID,
+		})
+		count++
+		if count%500 == 0 {
+			w.Flush()
+			c.Writer.Flush()
+		}
+	}
+	w.Flush()
+
+	log.Printf("Exported %d audit events for %s", count, currentPrincipal(c).Actor())
+}
+
+// Audit state for a subject's role in a group; nil when it has none
+func auditRole(subjectType string, role string) interface{} {
+	if role == "" {
+		return nil
+	}
+	return gin.H{"type": subjectType, "role": role}
+}
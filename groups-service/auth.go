@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const principalContextKey = "principal"
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Type   string   `json:"type"`
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Set when a platform admin is viewing the service as this principal
+	ImpersonatedBy string `json:"impersonated_by,omitempty"`
+}
+
+type authConfig struct {
+	hmacSecret    []byte
+	publicKeys    map[string]crypto.PublicKey
+	issuer        string
+	audience      string
+	allowHeader   bool
+	clockLeeway   time.Duration
+	publicKeyList []crypto.PublicKey
+}
+
+var auth authConfig
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func initAuth() {
+	auth = authConfig{
+		publicKeys:  map[string]crypto.PublicKey{},
+		issuer:      os.Getenv("AUTH_ISSUER"),
+		audience:    os.Getenv("AUTH_AUDIENCE"),
+		allowHeader: os.Getenv("AUTH_DEV_MODE") == "true",
+		clockLeeway: 30 * time.Second,
+	}
+
+	if secret := os.Getenv("AUTH_HMAC_SECRET"); secret != "" {
+		auth.hmacSecret = []byte(secret)
+		log.Println("Authentication: accepting HMAC signed bearer tokens")
+	}
+
+	if path := os.Getenv("AUTH_JWKS_FILE"); path != "" {
+		if err := loadJWKS(path); err != nil {
+			log.Fatalf("Failed to load JWKS file %s: %v", path, err)
+		}
+		log.Printf("Authentication: accepting bearer tokens signed by %d key(s) from %s", len(auth.publicKeyList), path)
+	}
+
+	if auth.allowHeader {
+		log.Println("Authentication: DEVELOPMENT MODE, trusting the X-Username header")
+	}
+
+	if auth.hmacSecret == nil && len(auth.publicKeyList) == 0 && !auth.allowHeader {
+		// API keys alone aren't enough: only users can create service accounts and issue keys
+		log.Fatal("No authentication configured: set AUTH_HMAC_SECRET or AUTH_JWKS_FILE (or AUTH_DEV_MODE=true for local development)")
+	}
+}
+
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// Load RSA and EC public keys from a local JWKS file
+func loadJWKS(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return err
+	}
+
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		var publicKey crypto.PublicKey
+		switch key.Kty {
+		case "RSA":
+			n, err := decodeBase64URL(key.N)
+			if err != nil {
+				return fmt.Errorf("key %s: invalid modulus: %v", key.Kid, err)
+			}
+			e, err := decodeBase64URL(key.E)
+			if err != nil {
+				return fmt.Errorf("key %s: invalid exponent: %v", key.Kid, err)
+			}
+			publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch key.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				return fmt.Errorf("key %s: unsupported curve %s", key.Kid, key.Crv)
+			}
+			x, err := decodeBase64URL(key.X)
+			if err != nil {
+				return fmt.Errorf("key %s: invalid x coordinate: %v", key.Kid, err)
+			}
+			y, err := decodeBase64URL(key.Y)
+			if err != nil {
+				return fmt.Errorf("key %s: invalid y coordinate: %v", key.Kid, err)
+			}
+			publicKey = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		default:
+			continue
+		}
+
+		auth.publicKeyList = append(auth.publicKeyList, publicKey)
+		if key.Kid != "" {
+			auth.publicKeys[key.Kid] = publicKey
+		}
+	}
+
+	if len(auth.publicKeyList) == 0 {
+		return errors.New("no usable signing keys found")
+	}
+	return nil
+}
+
+// Verify a JWT signature for the algorithm named in its header
+func verifyJWTSignature(header jwtHeader, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch header.Alg {
+	case "HS256", "RS256", "ES256":
+		hash = crypto.SHA256
+	case "HS384", "RS384", "ES384":
+		hash = crypto.SHA384
+	case "HS512", "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	if strings.HasPrefix(header.Alg, "HS") {
+		if auth.hmacSecret == nil {
+			return errors.New("HMAC tokens are not accepted")
+		}
+		mac := hmac.New(hash.New, auth.hmacSecret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	// Use the key named by kid, or try every key when the token has none
+	candidates := auth.publicKeyList
+	if header.Kid != "" {
+		key, ok := auth.publicKeys[header.Kid]
+		if !ok {
+			return fmt.Errorf("unknown key id %q", header.Kid)
+		}
+		candidates = []crypto.PublicKey{key}
+	}
+
+	hasher := hash.New()
+	hasher.Write([]byte(signingInput))
+	digest := hasher.Sum(nil)
+
+	for _, key := range candidates {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(header.Alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if strings.HasPrefix(header.Alg, "ES") && len(signature) == 2*size {
+				r := new(big.Int).SetBytes(signature[:size])
+				s := new(big.Int).SetBytes(signature[size:])
+				if ecdsa.Verify(k, digest, r, s) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// Check the audience claim, which may be a string or a list of strings
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Validate a bearer token and return the subject it was issued for
+func validateJWT(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+
+	headerJSON, err := decodeBase64URL(parts[0])
+	if err != nil {
+		return "", errors.New("malformed token header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return "", errors.New("malformed token header")
+	}
+
+	signature, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return "", errors.New("malformed token signature")
+	}
+	if err := verifyJWTSignature(header, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := decodeBase64URL(parts[1])
+	if err != nil {
+		return "", errors.New("malformed token claims")
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return "", errors.New("malformed token claims")
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == nil {
+		return "", errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(*claims.ExpiresAt, 0).Add(auth.clockLeeway)) {
+		return "", errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Add(auth.clockLeeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return "", errors.New("token is not valid yet")
+	}
+	if auth.issuer != "" && claims.Issuer != auth.issuer {
+		return "", errors.New("unexpected token issuer")
+	}
+	if auth.audience != "" && !hasAudience(claims.Audience, auth.audience) {
+		return "", errors.New("unexpected token audience")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+
+	return claims.Subject, nil
+}
+
+// Authenticate the caller and put the principal on the gin context.
+// Only the health check may be called without credentials.
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.URL.Path == "/health" {
+			c.Next()
+			return
+		}
+
+		principal, err := authenticateRequest(c)
+		if err != nil {
+			log.Printf("[AUTH] status=REJECTED path=%s error=%v", c.Request.URL.Path, err)
+			c.Header("WWW-Authenticate", `Bearer realm="groups-service"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+
+		if principal.Method == "api_key" && !apiKeyAllowsRequest(principal, c.Request.Method, c.Request.URL.Path) {
+			log.Printf("[AUTH] status=REJECTED path=%s principal=%s error=insufficient scope", c.Request.URL.Path, principal.Actor())
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key scope does not allow this request"})
+			return
+		}
+
+		c.Set(principalContextKey, principal)
+		c.Next()
+	}
+}
+
+func authenticateRequest(c *gin.Context) (*Principal, error) {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return authenticateAPIKey(strings.TrimSpace(key))
+	}
+
+	if authorization := c.GetHeader("Authorization"); authorization != "" {
+		token, ok := strings.CutPrefix(authorization, "Bearer ")
+		if !ok {
+			return nil, errors.New("unsupported authorization scheme")
+		}
+		token = strings.TrimSpace(token)
+
+		// Service account API keys may also be sent as bearer tokens
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			return authenticateAPIKey(token)
+		}
+
+		subject, err := validateJWT(token)
+		if err != nil {
+			return nil, err
+		}
+		if !isSystemUser(subject) {
+			return nil, fmt.Errorf("token subject %q is not a system user", subject)
+		}
+		return &Principal{Type: "user", ID: subject, Method: "jwt"}, nil
+	}
+
+	// Development mode keeps the old trusted header working
+	if username := c.GetHeader("X-Username"); username != "" && auth.allowHeader {
+		if !isSystemUser(username) {
+			return nil, fmt.Errorf("X-Username %q is not a system user", username)
+		}
+		return &Principal{Type: "user", ID: username, Method: "header"}, nil
+	}
+
+	return nil, errors.New("no credentials")
+}
+
+// Get the authenticated principal for a request
+func currentPrincipal(c *gin.Context) *Principal {
+	value, ok := c.Get(principalContextKey)
+	if !ok {
+		return nil
+	}
+	principal, _ := value.(*Principal)
+	return principal
+}
+
+// Get the username of the authenticated caller, or "" when the caller is not a user
+func currentUsername(c *gin.Context) string {
+	principal := currentPrincipal(c)
+	if principal == nil || principal.Type != "user" {
+		return ""
+	}
+	return principal.ID
+}
+
+// Name the principal in logs and audit records; users keep their bare username
+func (p *Principal) Actor() string {
+	if p.Type == "user" {
+		return p.ID
+	}
+	return p.Type + ":" + p.ID
+}
+
+// Check a group permission for the authenticated caller, whatever its subject type,
+// at the consistency the request asked for (reads only; mutations use the group's own)
+func checkPrincipalPermission(c *gin.Context, groupUsername string, permission string) bool {
+	principal := currentPrincipal(c)
+	if principal == nil {
+		return false
+	}
+	return checkSubjectPermissionWithConsistency(principal.Type, principal.ID, groupUsername, permission, getRequestConsistency(c, groupUsername))
+}
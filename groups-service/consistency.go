@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+)
+
+// Read consistency requested by the client. X-Zedtoken asks for results at least
+// as fresh as a write the client has seen, possibly one made through another
+// service; X-Consistency picks one of SpiceDB's other modes outright. Both only
+// apply to reads, see getRequestConsistency.
+func consistencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := c.GetHeader("X-Zedtoken"); token != "" {
+			c.Set("consistency", &v1.Consistency{
+				Requirement: &v1.Consistency_AtLeastAsFresh{
+					AtLeastAsFresh: &v1.ZedToken{Token: token},
+				},
+			})
+		} else if mode := c.GetHeader("X-Consistency"); mode != "" {
+			switch mode {
+			case "minimize_latency":
+				c.Set("consistency", &v1.Consistency{
+					Requirement: &v1.Consistency_MinimizeLatency{MinimizeLatency: true},
+				})
+			case "fully_consistent":
+				c.Set("consistency", &v1.Consistency{
+					Requirement: &v1.Consistency_FullyConsistent{FullyConsistent: true},
+				})
+			default:
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid X-Consistency. Must be minimize_latency or fully_consistent"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// Get the consistency to read a group with, preferring what the client asked
+// for over the group's stored zedtoken. Only GET and HEAD requests get to pick:
+// a client asking for minimize_latency or an old zedtoken must not be able to
+// slip a mutation past a permission that has already been revoked.
+func getRequestConsistency(c *gin.Context, groupUsername string) *v1.Consistency {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return getConsistencyForGroup(groupUsername)
+	}
+	if value, ok := c.Get("consistency"); ok {
+		consistency := value.(*v1.Consistency)
+		log.Printf("Using client-requested consistency for group %s: %s", groupUsername, consistency.String())
+		return consistency
+	}
+	return getConsistencyForGroup(groupUsername)
+}
+
+// Hand the zedtoken of a write back to the client so it can read its own writes
+func setZedtokenHeader(c *gin.Context, zedtoken string) {
+	if zedtoken != "" {
+		c.Header("X-Zedtoken", zedtoken)
+	}
+}
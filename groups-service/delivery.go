@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	deliveryPollInterval = 5 * time.Second
+	deliveryBatchSize    = 50
+	deliveryBaseBackoff  = 30 * time.Second
+	deliveryMaxBackoff   = time.Hour
+	deliveryLease        = 10 * time.Minute
+)
+
+var validDeliveryModes = map[string]bool{"EVERY": true, "DIGEST": true, "NONE": true}
+
+var validDigestFrequencies = map[string]bool{"DAILY": true, "WEEKLY": true}
+
+// SMTP relay used for outbound group mail
+type smtpRelay struct {
+	addr        string
+	auth        smtp.Auth
+	maxAttempts int
+}
+
+var outboundRelay *smtpRelay
+
+type MessageDelivery struct {
+	RecipientUsername string `json:"recipient_username"`
+	Status            string `json:"status"`
+	Attempts          int    `json:"attempts"`
+	LastError         string `json:"last_error,omitempty"`
+	NextAttemptAt     string `json:"next_attempt_at,omitempty"`
+	DeliveredAt       string `json:"delivered_at,omitempty"`
+}
+
+// Helper function to look up a system user by username
+func findSystemUser(username string) (User, bool) {
+	for _, user := range systemUsers {
+		if user.Username == username {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// Get a member's delivery mode for a group, defaulting to every message
+func getDeliveryMode(exec execer, groupUsername, username string) (string, error) {
+	var mode string
+	err := exec.QueryRow(`
+		SELECT mode FROM delivery_preferences
+		WHERE group_username = $1 AND username = $2
+	`, groupUsername, username).Scan(&mode)
+	if err == sql.ErrNoRows {
+		return "EVERY", nil
+	}
+	return mode, err
+}
+
+// Queue a message for fan-out in the transaction that stores it. The entry is
+// leased from the start: the poster expands it right after commit, and the
+// worker only picks it up if that didn't happen.
+func enqueueMessageFanout(tx *sql.Tx, messageID int) error {
+	_, err := tx.Exec(`
+		INSERT INTO message_fanouts (message_id, next_attempt_at)
+		VALUES ($1, CURRENT_TIMESTAMP + $2::int * INTERVAL '1 second')
+	`, messageID, int(deliveryLease.Seconds()))
+	return err
+}
+
+// Record a delivery row for each effective member of the group the message was
+// posted to, and drop its fan-out entry, in one transaction
+func fanOutMessage(messageID int, groupUsername string) error {
+	members, err := getEffectiveMembersFromSpiceDB(groupUsername)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, member := range members {
+		mode, err := getDeliveryMode(tx, groupUsername, member)
+		if err != nil {
+			return err
+		}
+
+		status := "PENDING"
+		switch mode {
+		case "DIGEST":
+			status = "DIGEST"
+		case "NONE":
+			status = "SKIPPED"
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO message_deliveries (message_id, recipient_username, status)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (message_id, recipient_username) DO NOTHING
+		`, messageID, member, status)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM message_fanouts WHERE message_id = $1", messageID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Queued delivery of message %d in group %s to %d members", messageID, groupUsername, len(members))
+	return nil
+}
+
+// Put a fan-out that failed back on the queue with backoff
+func recordFanoutFailure(messageID int, attempts int, fanoutErr error) {
+	attempts++
+	_, err := db.Exec(`
+		UPDATE message_fanouts
+		SET attempts = $2, last_error = $3, next_attempt_at = CURRENT_TIMESTAMP + $4::int * INTERVAL '1 second'
+		WHERE message_id = $1
+	`, messageID, attempts, fanoutErr.Error(), int(deliveryBackoff(attempts).Seconds()))
+	if err != nil {
+		log.Printf("[DELIVERY] failed to record fan-out failure for message %d: %v", messageID, err)
+	}
+	log.Printf("[DELIVERY] fan-out of message %d failed, attempts=%d error=%v", messageID, attempts, fanoutErr)
+}
+
+// Start the worker that expands messages whose fan-out failed or was cut
+// short. It runs without a relay too, since digest and skipped rows are
+// recorded either way.
+func startFanoutWorker() {
+	go func() {
+		for {
+			processMessageFanouts()
+			time.Sleep(deliveryPollInterval)
+		}
+	}()
+}
+
+type pendingFanout struct {
+	messageID     int
+	groupUsername string
+	attempts      int
+}
+
+// Lease due fan-outs, then expand each one outside the claiming transaction
+func processMessageFanouts() {
+	rows, err := db.Query(`
+		WITH claimed AS (
+			UPDATE message_fanouts
+			SET next_attempt_at = CURRENT_TIMESTAMP + $2::int * INTERVAL '1 second'
+			WHERE message_id IN (
+				SELECT message_id FROM message_fanouts
+				WHERE next_attempt_at <= CURRENT_TIMESTAMP
+				ORDER BY next_attempt_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING message_id, attempts
+		)
+		SELECT c.message_id, m.group_username, c.attempts
+		FROM claimed c
+		JOIN messages m ON m.id = c.message_id
+	`, deliveryBatchSize, int(deliveryLease.Seconds()))
+	if err != nil {
+		log.Printf("[DELIVERY] failed to claim pending fan-outs: %v", err)
+		return
+	}
+
+	var pending []pendingFanout
+	for rows.Next() {
+		var f pendingFanout
+		if err := rows.Scan(&f.messageID, &f.groupUsername, &f.attempts); err != nil {
+			rows.Close()
+			log.Printf("[DELIVERY] failed to scan pending fan-out: %v", err)
+			return
+		}
+		pending = append(pending, f)
+	}
+	rows.Close()
+
+	for _, f := range pending {
+		if err := fanOutMessage(f.messageID, f.groupUsername); err != nil {
+			recordFanoutFailure(f.messageID, f.attempts, err)
+		}
+	}
+}
+
+// Start the outbound delivery worker when an SMTP relay is configured
+func startDeliveryWorker() {
+	addr := os.Getenv("SMTP_RELAY_ADDR")
+	if addr == "" {
+		log.Println("Outbound delivery disabled (set SMTP_RELAY_ADDR to enable)")
+		return
+	}
+
+	relay := &smtpRelay{addr: addr, maxAttempts: 8}
+	if username := os.Getenv("SMTP_RELAY_USERNAME"); username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		relay.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_RELAY_PASSWORD"), host)
+	}
+	if v, err := strconv.Atoi(os.Getenv("DELIVERY_MAX_ATTEMPTS")); err == nil && v > 0 {
+		relay.maxAttempts = v
+	}
+	outboundRelay = relay
+
+	log.Printf("Outbound delivery via SMTP relay %s (max attempts %d)", addr, relay.maxAttempts)
+	go func() {
+		for {
+			processPendingDeliveries()
+			time.Sleep(deliveryPollInterval)
+		}
+	}()
+}
+
+// Backoff before the next attempt after the given number of failed attempts
+func deliveryBackoff(attempts int) time.Duration {
+	backoff := time.Duration(float64(deliveryBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if backoff > deliveryMaxBackoff || backoff <= 0 {
+		return deliveryMaxBackoff
+	}
+	return backoff
+}
+
+// Claim a batch of due deliveries, send them, and record each result as it
+// happens. Nothing is sent inside a transaction, so a failed status update
+// can't roll back mail that already went out.
+func processPendingDeliveries() {
+	pending, err := claimPendingDeliveries()
+	if err != nil {
+		log.Printf("[DELIVERY] failed to claim pending deliveries: %v", err)
+		return
+	}
+
+	for _, p := range pending {
+		err := sendGroupMessage(&p.message, p.recipient)
+		if err == nil {
+			_, err = db.Exec(`
+				UPDATE message_deliveries
+				SET status = 'SENT', attempts = attempts + 1, last_error = NULL, delivered_at = CURRENT_TIMESTAMP
+				WHERE id = $1
+			`, p.id)
+			if err != nil {
+				log.Printf("[DELIVERY] failed to record delivery %d: %v", p.id, err)
+			}
+			log.Printf("[DELIVERY] status=SENT message=%d group=%s recipient=%s", p.message.ID, p.message.GroupUsername, p.recipient)
+			continue
+		}
+
+		attempts := p.attempts + 1
+		status := "PENDING"
+		if attempts >= outboundRelay.maxAttempts {
+			status = "FAILED"
+		}
+		nextAttempt := time.Now().Add(deliveryBackoff(attempts))
+		_, dbErr := db.Exec(`
+			UPDATE message_deliveries
+			SET status = $1, attempts = $2, last_error = $3, next_attempt_at = $4
+			WHERE id = $5
+		`, status, attempts, err.Error(), nextAttempt, p.id)
+		if dbErr != nil {
+			log.Printf("[DELIVERY] failed to record delivery %d: %v", p.id, dbErr)
+		}
+		log.Printf("[DELIVERY] status=%s message=%d group=%s recipient=%s attempts=%d error=%v", status, p.message.ID, p.message.GroupUsername, p.recipient, attempts, err)
+	}
+}
+
+type pendingDelivery struct {
+	id        int
+	recipient string
+	attempts  int
+	message   GroupMessage
+}
+
+// Lease due deliveries to this worker by pushing their next attempt past the
+// lease. A worker that dies mid-batch leaves its deliveries to be retried once
+// the lease runs out. SKIP LOCKED lets several replicas share the queue.
+func claimPendingDeliveries() ([]pendingDelivery, error) {
+	rows, err := db.Query(`
+		WITH claimed AS (
+			UPDATE message_deliveries
+			SET next_attempt_at = CURRENT_TIMESTAMP + $2::int * INTERVAL '1 second'
+			WHERE id IN (
+				SELECT id FROM message_deliveries
+				WHERE status = 'PENDING' AND next_attempt_at <= CURRENT_TIMESTAMP
+				ORDER BY next_attempt_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, recipient_username, attempts, message_id
+		)
+		SELECT d.id, d.recipient_username, d.attempts,
+		       m.id, m.group_username, m.sender_username, COALESCE(m.subject, ''), m.body,
+		       COALESCE(m.message_id, ''), COALESCE(m.in_reply_to, '')
+		FROM claimed d
+		JOIN messages m ON m.id = d.message_id
+	`, deliveryBatchSize, int(deliveryLease.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []pendingDelivery
+	for rows.Next() {
+		var p pendingDelivery
+		err := rows.Scan(&p.id, &p.recipient, &p.attempts,
+			&p.message.ID, &p.message.GroupUsername, &p.message.SenderUsername, &p.message.Subject, &p.message.Body,
+			&p.message.MessageID, &p.message.InReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
+
+// Write a header line, encoding non-ASCII values
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	fmt.Fprintf(buf, "%s: %s\r\n", name, mime.QEncoding.Encode("utf-8", value))
+}
+
+// Normalize line endings to CRLF as required on the wire
+func crlf(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// Send a single group message to one member through the relay
+func sendGroupMessage(msg *GroupMessage, recipient string) error {
+	groupAddress := emailAddress(msg.GroupUsername)
+	senderName := msg.SenderUsername
+	if user, ok := findSystemUser(msg.SenderUsername); ok {
+		senderName = user.Name
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s <%s>\r\n", mime.QEncoding.Encode("utf-8", senderName+" via "+msg.GroupUsername), groupAddress)
+	fmt.Fprintf(&buf, "Reply-To: <%s>\r\n", groupAddress)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", emailAddress(recipient))
+	writeHeader(&buf, "Subject", msg.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", msg.MessageID)
+	if msg.InReplyTo != "" {
+		fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", msg.InReplyTo)
+		fmt.Fprintf(&buf, "References: %s\r\n", msg.InReplyTo)
+	}
+	fmt.Fprintf(&buf, "List-Id: <%s.%s>\r\n", msg.GroupUsername, emailDomain)
+	fmt.Fprintf(&buf, "List-Post: <mailto:%s>\r\n", groupAddress)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(crlf(msg.Body))
+
+	return relayMail(groupAddress, emailAddress(recipient), buf.Bytes())
+}
+
+// Hand a composed message to the configured SMTP relay
+func relayMail(from string, to string, message []byte) error {
+	return smtp.SendMail(outboundRelay.addr, outboundRelay.auth, from, []string{to}, message)
+}
+
+func getDeliveryPreference(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	// Only members have a delivery preference
+	username := currentUsername(c)
+	if username == "" || !checkPrincipalPermission(c, groupUsername, "view_members") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	mode, frequency := "EVERY", "DAILY"
+	err := db.QueryRow(`
+		SELECT mode, digest_frequency FROM delivery_preferences
+		WHERE group_username = $1 AND username = $2
+	`, groupUsername, username).Scan(&mode, &frequency)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch delivery preference"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": groupUsername, "username": username, "mode": mode, "digest_frequency": frequency})
+}
+
+func updateDeliveryPreference(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	// Only members have a delivery preference
+	username := currentUsername(c)
+	if username == "" || !checkPrincipalPermission(c, groupUsername, "view_members") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	type UpdateDeliveryPreferenceRequest struct {
+		Mode            string `json:"mode" binding:"required"`
+		DigestFrequency string `json:"digest_frequency"`
+	}
+
+	var req UpdateDeliveryPreferenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !validDeliveryModes[req.Mode] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode. Must be EVERY, DIGEST, or NONE"})
+		return
+	}
+
+	if req.DigestFrequency == "" {
+		req.DigestFrequency = "DAILY"
+	}
+	if !validDigestFrequencies[req.DigestFrequency] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid digest frequency. Must be DAILY or WEEKLY"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update delivery preference"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Keep the previous preference for the audit log; no row means the defaults
+	beforeMode, beforeFrequency := "EVERY", "DAILY"
+	err = tx.QueryRow(`
+		SELECT mode, digest_frequency FROM delivery_preferences
+		WHERE group_username = $1 AND username = $2
+		FOR UPDATE
+	`, groupUsername, username).Scan(&beforeMode, &beforeFrequency)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch delivery preference"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO delivery_preferences (group_username, username, mode, digest_frequency)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (group_username, username)
+		DO UPDATE SET mode = EXCLUDED.mode, digest_frequency = EXCLUDED.digest_frequency, updated_at = CURRENT_TIMESTAMP
+	`, groupUsername, username, req.Mode, req.DigestFrequency)
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "delivery_preference.updated",
+			GroupUsername: groupUsername,
+			Subject:       username,
+			Before:        gin.H{"mode": beforeMode, "digest_frequency": beforeFrequency},
+			After:         gin.H{"mode": req.Mode, "digest_frequency": req.DigestFrequency},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to update delivery preference for %s in group %s: %v", username, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update delivery preference"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": groupUsername, "username": username, "mode": req.Mode, "digest_frequency": req.DigestFrequency})
+}
+
+func getMessageDeliveries(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	// Check permission to add members (same permission for viewing delivery state)
+	username := currentUsername(c)
+	if username == "" || !checkPrincipalPermission(c, groupUsername, "add_member") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	messageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message id"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT d.recipient_username, d.status, d.attempts, COALESCE(d.last_error, ''), d.next_attempt_at, d.delivered_at
+		FROM message_deliveries d
+		JOIN messages m ON m.id = d.message_id
+		WHERE d.message_id = $1 AND m.group_username = $2
+		ORDER BY d.recipient_username
+	`, messageID, groupUsername)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch message deliveries"})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []MessageDelivery{}
+	for rows.Next() {
+		var delivery MessageDelivery
+		var nextAttemptAt, deliveredAt sql.NullTime
+		err := rows.Scan(&delivery.RecipientUsername, &delivery.Status, &delivery.Attempts,
+			&delivery.LastError, &nextAttemptAt, &deliveredAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan message delivery"})
+			return
+		}
+		if delivery.Status == "PENDING" && nextAttemptAt.Valid {
+			delivery.NextAttemptAt = nextAttemptAt.Time.Format("2006-01-02 15:04:05")
+		}
+		if deliveredAt.Valid {
+			delivery.DeliveredAt = deliveredAt.Time.Format("2006-01-02 15:04:05")
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	digestPollInterval = time.Minute
+	digestLease        = 15 * time.Minute
+)
+
+var digestPeriods = map[string]time.Duration{
+	"DAILY":  24 * time.Hour,
+	"WEEKLY": 7 * 24 * time.Hour,
+}
+
+type digestRun struct {
+	id          int
+	username    string
+	frequency   string
+	periodStart time.Time
+	periodEnd   time.Time
+	attempts    int
+}
+
+type digestThread struct {
+	Subject  string
+	Messages []GroupMessage
+}
+
+type digestGroup struct {
+	Username string
+	Email    string
+	Threads  []*digestThread
+}
+
+type digestContent struct {
+	Name      string
+	Frequency string
+	Since     string
+	Groups    []*digestGroup
+	Count     int
+}
+
+var digestTextTemplate = texttemplate.Must(texttemplate.New("digest").Parse(`Hi {{.Name}},
+
+Here is your {{.Frequency}} digest with {{.Count}} new message(s) since {{.Since}}.
+{{range .Groups}}
+== {{.Username}} ({{.Email}}) ==
+{{range .Threads}}
+-- {{.Subject}} --
+{{range .Messages}}
+From {{.SenderUsername}} at {{.CreatedAt}}:
+{{.Body}}
+{{end}}{{end}}{{end}}`))
+
+var digestHTMLTemplate = htmltemplate.Must(htmltemplate.New("digest").Parse(`<html><body>
+<p>Hi {{.Name}},</p>
+<p>Here is your {{.Frequency}} digest with {{.Count}} new message(s) since {{.Since}}.</p>
+{{range .Groups}}<h2>{{.Username}} <small>&lt;{{.Email}}&gt;</small></h2>
+{{range .Threads}}<h3>{{.Subject}}</h3>
+{{range .Messages}}<div style="margin-bottom:1em">
+<p><strong>{{.SenderUsername}}</strong> <small>{{.CreatedAt}}</small></p>
+<pre style="white-space:pre-wrap">{{.Body}}</pre>
+</div>
+{{end}}{{end}}{{end}}</body></html>`))
+
+// Start the digest scheduler. Digests are sent through the outbound relay, so
+// the scheduler only runs when outbound delivery is enabled.
+func startDigestScheduler() {
+	if outboundRelay == nil {
+		log.Println("Digest scheduler disabled (outbound delivery is not configured)")
+		return
+	}
+
+	log.Println("Digest scheduler started")
+	go func() {
+		for {
+			scheduleDigestRuns()
+			processDigestRuns()
+			time.Sleep(digestPollInterval)
+		}
+	}()
+}
+
+// Record a run for every digest subscriber whose period has elapsed
+func scheduleDigestRuns() {
+	rows, err := db.Query(`
+		SELECT DISTINCT username, digest_frequency
+		FROM delivery_preferences
+		WHERE mode = 'DIGEST'
+	`)
+	if err != nil {
+		log.Printf("[DIGEST] failed to fetch digest subscribers: %v", err)
+		return
+	}
+
+	type subscriber struct {
+		username  string
+		frequency string
+	}
+	var subscribers []subscriber
+	for rows.Next() {
+		var s subscriber
+		if err := rows.Scan(&s.username, &s.frequency); err != nil {
+			rows.Close()
+			log.Printf("[DIGEST] failed to scan digest subscriber: %v", err)
+			return
+		}
+		subscribers = append(subscribers, s)
+	}
+	rows.Close()
+
+	now := time.Now().UTC()
+	for _, s := range subscribers {
+		period := digestPeriods[s.frequency]
+
+		// Each digest starts where the previous one ended
+		var lastEnd time.Time
+		err := db.QueryRow(`
+			SELECT COALESCE(MAX(period_end), $3)
+			FROM digest_runs
+			WHERE username = $1 AND frequency = $2
+		`, s.username, s.frequency, now.Add(-period)).Scan(&lastEnd)
+		if err != nil {
+			log.Printf("[DIGEST] failed to fetch last digest for %s: %v", s.username, err)
+			continue
+		}
+		if now.Sub(lastEnd) < period {
+			continue
+		}
+
+		// The unique period constraint keeps replicas from scheduling the same digest twice
+		_, err = db.Exec(`
+			INSERT INTO digest_runs (username, frequency, period_start, period_end)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (username, frequency, period_start) DO NOTHING
+		`, s.username, s.frequency, lastEnd, now)
+		if err != nil {
+			log.Printf("[DIGEST] failed to schedule digest for %s: %v", s.username, err)
+		}
+	}
+}
+
+// Send every pending digest run, including ones interrupted by a restart.
+// Each run is claimed and its outcome recorded in its own statement, so a
+// failure on one run never causes the others to be sent again.
+func processDigestRuns() {
+	runs, err := claimDigestRuns()
+	if err != nil {
+		log.Printf("[DIGEST] failed to claim pending digests: %v", err)
+		return
+	}
+
+	for _, run := range runs {
+		count, err := sendDigest(run)
+		if err != nil {
+			attempts := run.attempts + 1
+			status := "PENDING"
+			if attempts >= outboundRelay.maxAttempts {
+				status = "FAILED"
+			}
+			log.Printf("[DIGEST] status=%s user=%s frequency=%s attempts=%d error=%v", status, run.username, run.frequency, attempts, err)
+			_, err = db.Exec(`
+				UPDATE digest_runs SET status = $1, attempts = $2, last_error = $3 WHERE id = $4
+			`, status, attempts, err.Error(), run.id)
+			if err != nil {
+				log.Printf("[DIGEST] failed to record digest run %d: %v", run.id, err)
+			}
+			continue
+		}
+
+		status := "SENT"
+		if count == 0 {
+			status = "EMPTY"
+		}
+		if err := recordDigestSent(run, status, count); err != nil {
+			log.Printf("[DIGEST] failed to record digest run %d: %v", run.id, err)
+			continue
+		}
+		log.Printf("[DIGEST] status=%s user=%s frequency=%s messages=%d", status, run.username, run.frequency, count)
+	}
+}
+
+// Mark pending runs SENDING before anything goes to the relay. A run left
+// SENDING by a crash is picked up again once the lease runs out, so at most
+// the digest that was in flight can arrive twice.
+func claimDigestRuns() ([]digestRun, error) {
+	rows, err := db.Query(`
+		UPDATE digest_runs SET status = 'SENDING', claimed_at = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT id FROM digest_runs
+			WHERE status = 'PENDING'
+			   OR (status = 'SENDING' AND claimed_at <= CURRENT_TIMESTAMP - $1::int * INTERVAL '1 second')
+			ORDER BY period_end
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, username, frequency, period_start, period_end, attempts
+	`, int(digestLease.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []digestRun
+	for rows.Next() {
+		var run digestRun
+		if err := rows.Scan(&run.id, &run.username, &run.frequency, &run.periodStart, &run.periodEnd, &run.attempts); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// Record a sent digest and mark the per-recipient delivery rows it covered as delivered
+func recordDigestSent(run digestRun, status string, count int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE digest_runs
+		SET status = $1, message_count = $2, attempts = attempts + 1, last_error = NULL, sent_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, status, count, run.id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE message_deliveries d
+		SET status = 'SENT', delivered_at = CURRENT_TIMESTAMP
+		FROM messages m, delivery_preferences p
+		WHERE m.id = d.message_id
+		  AND p.group_username = m.group_username AND p.username = d.recipient_username
+		  AND d.recipient_username = $1 AND d.status = 'DIGEST'
+		  AND p.digest_frequency = $2
+		  AND m.created_at > $3 AND m.created_at <= $4
+	`, run.username, run.frequency, run.periodStart, run.periodEnd)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Build the digest contents for a run, only including groups the member can still read
+func buildDigest(run digestRun) (*digestContent, error) {
+	rows, err := db.Query(`
+		SELECT m.id, m.group_username, m.sender_username, COALESCE(m.subject, ''), m.body,
+		       COALESCE(m.thread_id, m.id), m.created_at
+		FROM message_deliveries d
+		JOIN messages m ON m.id = d.message_id
+		JOIN delivery_preferences p ON p.group_username = m.group_username AND p.username = d.recipient_username
+		WHERE d.recipient_username = $1 AND d.status = 'DIGEST'
+		  AND p.digest_frequency = $2
+		  AND m.created_at > $3 AND m.created_at <= $4
+		ORDER BY m.group_username, m.created_at
+	`, run.username, run.frequency, run.periodStart, run.periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []GroupMessage
+	for rows.Next() {
+		var msg GroupMessage
+		var createdAt time.Time
+		err := rows.Scan(&msg.ID, &msg.GroupUsername, &msg.SenderUsername, &msg.Subject, &msg.Body, &msg.ThreadID, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		msg.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	name := run.username
+	if user, ok := findSystemUser(run.username); ok {
+		name = user.Name
+	}
+	content := &digestContent{
+		Name:      name,
+		Frequency: strings.ToLower(run.frequency),
+		Since:     run.periodStart.Format("2006-01-02 15:04"),
+	}
+
+	groups := map[string]*digestGroup{}
+	threads := map[int]*digestThread{}
+	readable := map[string]bool{}
+	for _, msg := range messages {
+		allowed, checked := readable[msg.GroupUsername]
+		if !checked {
+			allowed = checkPermission(run.username, msg.GroupUsername, "read_archive")
+			readable[msg.GroupUsername] = allowed
+		}
+		if !allowed {
+			continue
+		}
+
+		group, ok := groups[msg.GroupUsername]
+		if !ok {
+			group = &digestGroup{Username: msg.GroupUsername, Email: emailAddress(msg.GroupUsername)}
+			groups[msg.GroupUsername] = group
+			content.Groups = append(content.Groups, group)
+		}
+		thread, ok := threads[msg.ThreadID]
+		if !ok {
+			subject := msg.Subject
+			if subject == "" {
+				subject = "(no subject)"
+			}
+			thread = &digestThread{Subject: subject}
+			threads[msg.ThreadID] = thread
+			group.Threads = append(group.Threads, thread)
+		}
+		thread.Messages = append(thread.Messages, msg)
+		content.Count++
+	}
+
+	sort.Slice(content.Groups, func(i, j int) bool {
+		return content.Groups[i].Username < content.Groups[j].Username
+	})
+
+	return content, nil
+}
+
+// Render and send a digest, returning how many messages it contained
+func sendDigest(run digestRun) (int, error) {
+	content, err := buildDigest(run)
+	if err != nil {
+		return 0, err
+	}
+	if content.Count == 0 {
+		return 0, nil
+	}
+
+	var text, html bytes.Buffer
+	if err := digestTextTemplate.Execute(&text, content); err != nil {
+		return 0, err
+	}
+	if err := digestHTMLTemplate.Execute(&html, content); err != nil {
+		return 0, err
+	}
+
+	boundaryBytes := make([]byte, 12)
+	rand.Read(boundaryBytes)
+	boundary := "digest-" + hex.EncodeToString(boundaryBytes)
+
+	from := emailAddress("digest")
+	subject := fmt.Sprintf("Your %s group digest: %d new message(s)", content.Frequency, content.Count)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s <%s>\r\n", mime.QEncoding.Encode("utf-8", "Groups digest"), from)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", emailAddress(run.username))
+	writeHeader(&buf, "Subject", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", newMessageID())
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n", boundary)
+	buf.WriteString("\r\n")
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(crlf(text.String()))
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(crlf(html.String()))
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+
+	if err := relayMail(from, emailAddress(run.username), buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return content.Count, nil
+}
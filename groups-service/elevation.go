@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Longest break-glass elevation that can be requested
+const maxElevationHours = 24
+
+// A member's request for temporary admin on a group
+type ElevationRequest struct {
+	ID             int    `json:"id"`
+	GroupUsername  string `json:"group_username"`
+	Requester      string `json:"requester"`
+	Justification  string `json:"justification"`
+	DurationHours  int    `json:"duration_hours"`
+	Status         string `json:"status"`
+	DecidedBy      string `json:"decided_by,omitempty"`
+	DecidedAt      string `json:"decided_at,omitempty"`
+	DecisionReason string `json:"decision_reason,omitempty"`
+	ExpiresAt      string `json:"expires_at,omitempty"`
+	Zedtoken       string `json:"zedtoken,omitempty"`
+	EndedBy        string `json:"ended_by,omitempty"`
+	EndedAt        string `json:"ended_at,omitempty"`
+	CreatedAt      string `json:"created_at"`
+}
+
+const elevationColumns = `id, group_username, requester, justification, duration_hours, status, decided_by, decided_at,
+	decision_reason, expires_at, zedtoken, ended_by, ended_at, created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanElevationRequest(row rowScanner) (ElevationRequest, error) {
+	var e ElevationRequest
+	var decidedBy, decisionReason, zedtoken, endedBy sql.NullString
+	var decidedAt, expiresAt, endedAt sql.NullTime
+	var createdAt time.Time
+	err := row.Scan(&e.ID, &e.GroupUsername, &e.Requester, &e.Justification, &e.DurationHours, &e.Status,
+		&decidedBy, &decidedAt, &decisionReason, &expiresAt, &zedtoken, &endedBy, &endedAt, &createdAt)
+	if err != nil {
+		return e, err
+	}
+
+	e.DecidedBy = decidedBy.String
+	if decidedAt.Valid {
+		e.DecidedAt = decidedAt.Time.Format("2006-01-02 15:04:05")
+	}
+	e.DecisionReason = decisionReason.String
+	e.ExpiresAt = formatExpiry(expiresAt)
+	e.Zedtoken = zedtoken.String
+	e.EndedBy = endedBy.String
+	if endedAt.Valid {
+		e.EndedAt = endedAt.Time.Format("2006-01-02 15:04:05")
+	}
+	e.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	return e, nil
+}
+
+func getElevationRequest(id int, groupUsername string) (ElevationRequest, error) {
+	row := db.QueryRow(`SELECT `+elevationColumns+` FROM elevation_requests WHERE id = $1 AND group_username = $2`, id, groupUsername)
+	return scanElevationRequest(row)
+}
+
+// Mark approved elevations whose time is up as expired. Called by the expiry
+// job in the transaction that queues removal of the lapsed admin relationships.
+func expireElevations(tx *sql.Tx) ([]ElevationRequest, error) {
+	rows, err := tx.Query(`
+		UPDATE elevation_requests SET status = 'EXPIRED', ended_at = CURRENT_TIMESTAMP
+		WHERE status = 'APPROVED' AND expires_at <= CURRENT_TIMESTAMP
+		RETURNING ` + elevationColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []ElevationRequest
+	for rows.Next() {
+		e, err := scanElevationRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, e)
+	}
+	return expired, rows.Err()
+}
+
+// Reply 404 or 409 for a request that couldn't move out of the expected status
+func elevationStatusConflict(c *gin.Context, id int, groupUsername string) {
+	e, err := getElevationRequest(id, groupUsername)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Elevation request not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch elevation request"})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Elevation request is already %s", strings.ToLower(e.Status))})
+}
+
+// An optional reason given with a decision
+func bindDecisionReason(c *gin.Context) (string, bool) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", false
+	}
+	return req.Reason, true
+}
+
+// List a group's elevation requests. Admins see them all; anyone else only
+// their own.
+func getElevationRequests(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	requester := ""
+	if !checkPrincipalPermission(c, groupUsername, "add_member") {
+		requester = currentUsername(c)
+		if requester == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			return
+		}
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", "PENDING", "APPROVED", "DENIED", "CANCELLED", "REVOKED", "EXPIRED":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status. Must be PENDING, APPROVED, DENIED, CANCELLED, REVOKED, or EXPIRED"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+elevationColumns+`
+		FROM elevation_requests
+		WHERE group_username = $1 AND ($2 = '' OR requester = $2) AND ($3 = '' OR status = $3)
+		ORDER BY created_at DESC, id DESC
+	`, groupUsername, requester, status)
+	if err != nil {
+		log.Printf("Failed to fetch elevation requests for group %s: %v", groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch elevation requests"})
+		return
+	}
+	defer rows.Close()
+
+	requests := []ElevationRequest{}
+	for rows.Next() {
+		e, err := scanElevationRequest(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan elevation request"})
+			return
+		}
+		requests = append(requests, e)
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// Ask for admin on a group for a few hours. Only direct MEMBERs can ask, and
+// only once at a time; the group's owners are told about the request.
+func requestElevation(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	username := currentUsername(c)
+	if username == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only users can request elevation"})
+		return
+	}
+
+	type ElevationRequestBody struct {
+		Hours         int    `json:"hours" binding:"required"`
+		Justification string `json:"justification" binding:"required"`
+	}
+
+	var req ElevationRequestBody
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Hours < 1 || req.Hours > maxElevationHours {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("hours must be between 1 and %d", maxElevationHours)})
+		return
+	}
+	req.Justification = strings.TrimSpace(req.Justification)
+	if req.Justification == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A justification is required"})
+		return
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM groups WHERE username = $1)", groupUsername).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check group existence"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	role, err := getSubjectRole(groupUsername, "user", username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch your role"})
+		return
+	}
+	switch role {
+	case "MEMBER":
+	case "":
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only members of the group can request elevation"})
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You are already an admin of this group"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request elevation"})
+		return
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`
+		INSERT INTO elevation_requests (group_username, requester, justification, duration_hours)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (group_username, requester) WHERE status IN ('PENDING', 'APPROVED') DO NOTHING
+		RETURNING `+elevationColumns,
+		groupUsername, username, req.Justification, req.Hours)
+	elevation, err := scanElevationRequest(row)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already have a pending or active elevation for this group"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to record elevation request by %s for group %s: %v", username, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request elevation"})
+		return
+	}
+
+	// Owners following the group's event stream see the request straight away
+	err = recordGroupEvent(tx, &GroupEvent{
+		Type:          "elevation.requested",
+		GroupUsername: groupUsername,
+		SubjectType:   "user",
+		SubjectID:     username,
+		Actor:         username,
+		Data:          eventData(map[string]interface{}{"elevation": elevation.ID, "hours": req.Hours, "justification": req.Justification}),
+	})
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "elevation.requested",
+			GroupUsername: groupUsername,
+			Subject:       username,
+			After:         elevation,
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to record elevation event for group %s: %v", groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request elevation"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request elevation"})
+		return
+	}
+
+	if outboundRelay != nil {
+		owners, err := getGroupOwnersFromSpiceDB(groupUsername, getConsistencyForGroup(groupUsername))
+		if err != nil {
+			log.Printf("Failed to fetch owners of group %s for elevation request %d: %v", groupUsername, elevation.ID, err)
+		}
+		for _, owner := range owners {
+			if err := sendElevationRequestNotice(owner, elevation); err != nil {
+				log.Printf("Failed to email owner %s about elevation request %d: %v", owner, elevation.ID, err)
+			}
+		}
+	}
+
+	c.JSON(http.StatusCreated, elevation)
+}
+
+// Email a group owner a request waiting for their decision
+func sendElevationRequestNotice(owner string, elevation ElevationRequest) error {
+	from := emailAddress("noreply")
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "%s is asking for admin on %s for %d hour(s):\n\n", elevation.Requester, emailAddress(elevation.GroupUsername), elevation.DurationHours)
+	fmt.Fprintf(&body, "  %s\n\n", elevation.Justification)
+	fmt.Fprintf(&body, "Approve or deny elevation request %d from the group's elevations.\n", elevation.ID)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s <%s>\r\n", mime.QEncoding.Encode("utf-8", "Groups"), from)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", emailAddress(owner))
+	writeHeader(&buf, "Subject", fmt.Sprintf("%s requests admin on %s", elevation.Requester, elevation.GroupUsername))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", newMessageID())
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(crlf(body.String()))
+
+	return relayMail(from, emailAddress(owner), buf.Bytes())
+}
+
+// Grant a pending request. The admin relationship is written with the expiry
+// caveat through the outbox, and its metadata row carries the expiry so the
+// expiry job removes it when the time is up.
+func approveElevation(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	if !checkPrincipalPermission(c, groupUsername, "add_member") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	approver := currentUsername(c)
+	if approver == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only users can approve elevation"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Elevation request not found"})
+		return
+	}
+	reason, ok := bindDecisionReason(c)
+	if !ok {
+		return
+	}
+
+	// Break-glass admin can't be used to hand out more of it
+	var temporary bool
+	err = db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM membership_metadata
+			WHERE group_username = $1 AND subject_type = 'user' AND subject_id = $2 AND relation = 'admin' AND expires_at IS NOT NULL
+		)
+	`, groupUsername, approver).Scan(&temporary)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check your role"})
+		return
+	}
+	if temporary {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Temporarily elevated admins can't approve elevation"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve elevation"})
+		return
+	}
+	defer tx.Rollback()
+
+	var requester, status string
+	var hours int
+	err = tx.QueryRow(`
+		SELECT requester, duration_hours, status FROM elevation_requests
+		WHERE id = $1 AND group_username = $2
+		FOR UPDATE
+	`, id, groupUsername).Scan(&requester, &hours, &status)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Elevation request not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch elevation request"})
+		return
+	}
+	if status != "PENDING" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Elevation request is already %s", strings.ToLower(status))})
+		return
+	}
+	if requester == approver {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Elevation must be approved by another owner"})
+		return
+	}
+
+	role, err := getSubjectRole(groupUsername, "user", requester)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch requester's role"})
+		return
+	}
+	if role != "MEMBER" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Requester is no longer a MEMBER of the group"})
+		return
+	}
+
+	// Seconds only, to match the expiry SpiceDB hands back through Watch
+	expiresAt := sql.NullTime{Time: time.Now().Add(time.Duration(hours) * time.Hour).UTC().Truncate(time.Second), Valid: true}
+
+	// The approving owner already knows when it ends, so no expiry notice is sent
+	_, err = tx.Exec(`
+		INSERT INTO membership_metadata (group_username, subject_type, subject_id, relation, added_by, note, expires_at, expiry_notified_at)
+		SELECT $1, 'user', $2, 'admin', $3, justification, $4, CURRENT_TIMESTAMP
+		FROM elevation_requests WHERE id = $5
+		ON CONFLICT (group_username, subject_type, subject_id, relation)
+		DO UPDATE SET added_by = EXCLUDED.added_by, note = EXCLUDED.note, expires_at = EXCLUDED.expires_at,
+		              expiry_notified_at = EXCLUDED.expiry_notified_at, updated_at = CURRENT_TIMESTAMP
+	`, groupUsername, requester, approver, expiresAt, id)
+	if err != nil {
+		log.Printf("Failed to record elevation metadata for %s in group %s: %v", requester, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve elevation"})
+		return
+	}
+
+	outboxID, err := enqueueOutboxEntry(tx, outboxEntry{
+		groupUsername: groupUsername,
+		operation:     "TOUCH",
+		relation:      "admin",
+		subjectType:   "user",
+		subjectID:     requester,
+		expiresAt:     expiresAt,
+	})
+	if err != nil {
+		log.Printf("Failed to queue elevation of %s in group %s: %v", requester, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve elevation"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE elevation_requests
+		SET status = 'APPROVED', decided_by = $2, decided_at = CURRENT_TIMESTAMP, decision_reason = $3, expires_at = $4
+		WHERE id = $1
+	`, id, approver, nullString(reason), expiresAt)
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "elevation.approved",
+			GroupUsername: groupUsername,
+			Subject:       requester,
+			Before:        gin.H{"type": "user", "role": role},
+			After:         gin.H{"elevation": id, "role": "OWNER", "expires_at": formatExpiry(expiresAt), "reason": reason},
+			OutboxID:      outboxID,
+		})
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve elevation"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve elevation"})
+		return
+	}
+
+	syncStatus, zedtoken := applyOutboxEntryNow(outboxID)
+	if zedtoken != "" {
+		if _, err := db.Exec("UPDATE elevation_requests SET zedtoken = $2 WHERE id = $1", id, zedtoken); err != nil {
+			log.Printf("Failed to record zedtoken of elevation %d: %v", id, err)
+		}
+	}
+	setZedtokenHeader(c, zedtoken)
+
+	elevation, err := getElevationRequest(id, groupUsername)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch elevation request"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"elevation": elevation, "sync_status": syncStatus})
+}
+
+// Turn down a pending request
+func denyElevation(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	if !checkPrincipalPermission(c, groupUsername, "add_member") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Elevation request not found"})
+		return
+	}
+	reason, ok := bindDecisionReason(c)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deny elevation"})
+		return
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`
+		UPDATE elevation_requests
+		SET status = 'DENIED', decided_by = $3, decided_at = CURRENT_TIMESTAMP, decision_reason = $4
+		WHERE id = $1 AND group_username = $2 AND status = 'PENDING'
+		RETURNING `+elevationColumns,
+		id, groupUsername, currentPrincipal(c).Actor(), nullString(reason))
+	elevation, err := scanElevationRequest(row)
+	if err == sql.ErrNoRows {
+		elevationStatusConflict(c, id, groupUsername)
+		return
+	}
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "elevation.denied",
+			GroupUsername: groupUsername,
+			Subject:       elevation.Requester,
+			After:         gin.H{"elevation": id, "reason": reason},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to deny elevation request %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deny elevation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, elevation)
+}
+
+// Withdraw a pending request, or end an active elevation early. The requester
+// can do either for their own request; admins can for anyone's.
+func endElevation(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Elevation request not found"})
+		return
+	}
+
+	elevation, err := getElevationRequest(id, groupUsername)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Elevation request not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch elevation request"})
+		return
+	}
+
+	if currentUsername(c) != elevation.Requester && !checkPrincipalPermission(c, groupUsername, "add_member") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	actor := currentPrincipal(c).Actor()
+
+	switch elevation.Status {
+	case "PENDING":
+		elevation, err = cancelElevation(c, id, groupUsername, actor)
+		if err == sql.ErrNoRows {
+			elevationStatusConflict(c, id, groupUsername)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to cancel elevation request %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel elevation request"})
+			return
+		}
+		c.JSON(http.StatusOK, elevation)
+
+	case "APPROVED":
+		syncStatus, zedtoken, err := revokeElevation(c, elevation, actor)
+		if err == sql.ErrNoRows {
+			elevationStatusConflict(c, id, groupUsername)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to revoke elevation %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke elevation"})
+			return
+		}
+		setZedtokenHeader(c, zedtoken)
+
+		elevation, err = getElevationRequest(id, groupUsername)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch elevation request"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"elevation": elevation, "sync_status": syncStatus})
+
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Elevation request is already %s", strings.ToLower(elevation.Status))})
+	}
+}
+
+// Withdraw a pending request and audit it. Returns sql.ErrNoRows if it was
+// decided first.
+func cancelElevation(c *gin.Context, id int, groupUsername, actor string) (ElevationRequest, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return ElevationRequest{}, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`
+		UPDATE elevation_requests SET status = 'CANCELLED', ended_by = $2, ended_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'PENDING'
+		RETURNING `+elevationColumns,
+		id, actor)
+	elevation, err := scanElevationRequest(row)
+	if err != nil {
+		return elevation, err
+	}
+
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:        "elevation.cancelled",
+		GroupUsername: groupUsername,
+		Subject:       elevation.Requester,
+		Before:        gin.H{"elevation": id, "status": "PENDING"},
+	})
+	if err != nil {
+		return elevation, err
+	}
+	return elevation, tx.Commit()
+}
+
+// Take away an active elevation's admin relationship ahead of its expiry, and
+// audit it in the same transaction. The metadata row is locked before the
+// request, in the same order as the expiry job, and only an expiring admin
+// relationship is removed, so an owner made permanent in the meantime keeps
+// their role. Returns sql.ErrNoRows if the elevation ended first.
+func revokeElevation(c *gin.Context, elevation ElevationRequest, actor string) (string, string, error) {
+	id, groupUsername, requester := elevation.ID, elevation.GroupUsername, elevation.Requester
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		DELETE FROM membership_metadata
+		WHERE group_username = $1 AND subject_type = 'user' AND subject_id = $2 AND relation = 'admin' AND expires_at IS NOT NULL
+	`, groupUsername, requester)
+	if err != nil {
+		return "", "", err
+	}
+
+	var outboxID int64
+	if removed, _ := result.RowsAffected(); removed > 0 {
+		outboxID, err = enqueueOutboxEntry(tx, outboxEntry{
+			groupUsername: groupUsername,
+			operation:     "DELETE",
+			relation:      "admin",
+			subjectType:   "user",
+			subjectID:     requester,
+		})
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	result, err = tx.Exec(`
+		UPDATE elevation_requests SET status = 'REVOKED', ended_by = $2, ended_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'APPROVED'
+	`, id, actor)
+	if err != nil {
+		return "", "", err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return "", "", sql.ErrNoRows
+	}
+
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:        "elevation.revoked",
+		GroupUsername: groupUsername,
+		Subject:       requester,
+		Before:        gin.H{"elevation": id, "role": "OWNER", "expires_at": elevation.ExpiresAt},
+		OutboxID:      outboxID,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+
+	if outboxID == 0 {
+		return "APPLIED", "", nil
+	}
+	syncStatus, zedtoken := applyOutboxEntryNow(outboxID)
+	return syncStatus, zedtoken, nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+)
+
+// Postgres channel that announces new rows in group_events
+const groupEventsChannel = "group_events"
+
+const (
+	eventStreamHeartbeat = 15 * time.Second
+	eventStreamBatchSize = 500
+)
+
+// Either the database or a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Append an event to the group event log and wake every replica's live streams
+// once it commits
+func recordGroupEvent(exec execer, event *GroupEvent) error {
+	var data sql.NullString
+	if len(event.Data) > 0 {
+		data = sql.NullString{String: string(event.Data), Valid: true}
+	}
+
+	err := exec.QueryRow(`
+		INSERT INTO group_events (event_type, group_username, subject_type, subject_id, subject_relation, role, previous_role, zedtoken, actor, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+	`, event.Type, event.GroupUsername, nullString(event.SubjectType), nullString(event.SubjectID),
+		nullString(event.SubjectRelation), nullString(event.Role), nullString(event.PreviousRole),
+		nullString(event.Zedtoken), nullString(event.Actor), data).Scan(&event.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = exec.Exec("SELECT pg_notify($1, $2)", groupEventsChannel, strconv.FormatInt(event.ID, 10))
+	return err
+}
+
+// Record an event that isn't part of a larger transaction, logging failures.
+// The change itself has already been made, so it isn't undone.
+func publishGroupEvent(event GroupEvent) {
+	if err := recordGroupEvent(db, &event); err != nil {
+		log.Printf("Warning: Failed to record %s event for group %s: %v", event.Type, event.GroupUsername, err)
+	}
+}
+
+// Encode event details for GroupEvent.Data
+func eventData(data interface{}) json.RawMessage {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+// Wakes live event streams on this replica when new events are recorded
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]bool
+}
+
+var groupEventHub = &eventHub{subscribers: make(map[chan struct{}]bool)}
+
+func (h *eventHub) subscribe() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	wake := make(chan struct{}, 1)
+	h.subscribers[wake] = true
+	return wake
+}
+
+func (h *eventHub) unsubscribe(wake chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, wake)
+}
+
+// Wake every subscriber; a subscriber that is already due to wake is skipped
+func (h *eventHub) broadcast() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for wake := range h.subscribers {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Where a reader is in group_events. Event IDs come from a sequence and are
+// taken when a row is inserted, not when it commits, so a transaction that
+// commits late can add an event below one a reader has already passed. Readers
+// therefore order events by the ID of the transaction that wrote them and only
+// read events from transactions below the snapshot xmin: every one of those has
+// finished, and every transaction still to commit is at or above it, so nothing
+// can appear behind the position.
+type eventPosition struct {
+	xid string
+	id  int64
+}
+
+// Read events after the given position, optionally for a single group
+func readGroupEvents(after eventPosition, groupUsername string) ([]GroupEvent, error) {
+	rows, err := db.Query(`
+		SELECT id, xid::text, event_type, group_username, COALESCE(subject_type, ''), COALESCE(subject_id, ''),
+		       COALESCE(subject_relation, ''), COALESCE(role, ''), COALESCE(previous_role, ''),
+		       COALESCE(zedtoken, ''), COALESCE(actor, ''), COALESCE(payload::text, ''), created_at
+		FROM group_events
+		WHERE (xid, id) > ($1::xid8, $2)
+		  AND xid < pg_snapshot_xmin(pg_current_snapshot())
+		  AND ($3 = '' OR group_username = $3)
+		ORDER BY xid, id
+		LIMIT $4
+	`, after.xid, after.id, groupUsername, eventStreamBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []GroupEvent
+	for rows.Next() {
+		var event GroupEvent
+		var data string
+		var createdAt time.Time
+		err := rows.Scan(&event.ID, &event.position.xid, &event.Type, &event.GroupUsername, &event.SubjectType, &event.SubjectID,
+			&event.SubjectRelation, &event.Role, &event.PreviousRole,
+			&event.Zedtoken, &event.Actor, &data, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		if data != "" {
+			event.Data = json.RawMessage(data)
+		}
+		event.position.id = event.ID
+		event.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Read a single event by ID
+func getGroupEvent(id int64) (*GroupEvent, error) {
+	var event GroupEvent
+	var data string
+	var createdAt time.Time
+	err := db.QueryRow(`
+		SELECT id, event_type, group_username, COALESCE(subject_type, ''), COALESCE(subject_id, ''),
+		       COALESCE(subject_relation, ''), COALESCE(role, ''), COALESCE(previous_role, ''),
+		       COALESCE(zedtoken, ''), COALESCE(actor, ''), COALESCE(payload::text, ''), created_at
+		FROM group_events
+		WHERE id = $1
+	`, id).Scan(&event.ID, &event.Type, &event.GroupUsername, &event.SubjectType, &event.SubjectID,
+		&event.SubjectRelation, &event.Role, &event.PreviousRole,
+		&event.Zedtoken, &event.Actor, &data, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	if data != "" {
+		event.Data = json.RawMessage(data)
+	}
+	event.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	return &event, nil
+}
+
+// Find the position just after an event that a reader has seen, given its ID
+func groupEventPosition(id int64) (eventPosition, error) {
+	position := eventPosition{xid: "0", id: id}
+	err := db.QueryRow("SELECT xid::text FROM group_events WHERE id <= $1 ORDER BY id DESC LIMIT 1", id).Scan(&position.xid)
+	if err == sql.ErrNoRows {
+		return position, nil
+	}
+	return position, err
+}
+
+// The position of the newest event no reader can be overtaken on
+func currentGroupEventPosition() (eventPosition, error) {
+	position := eventPosition{xid: "0"}
+	err := db.QueryRow(`
+		SELECT xid::text, id
+		FROM group_events
+		WHERE xid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY xid DESC, id DESC
+		LIMIT 1
+	`).Scan(&position.xid, &position.id)
+	if err == sql.ErrNoRows {
+		return position, nil
+	}
+	return position, err
+}
+
+// Find where a stream starts. Reconnecting clients send the ID of the last
+// event they saw as Last-Event-ID (or last_event_id, since EventSource can't
+// set headers on its first request); new clients start from now.
+func eventStreamStart(c *gin.Context) (eventPosition, error) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			return eventPosition{}, err
+		}
+		return groupEventPosition(id)
+	}
+	return currentGroupEventPosition()
+}
+
+func writeEventStreamEvent(w io.Writer, event *GroupEvent) {
+	encoded, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, encoded)
+}
+
+// Stream events as Server-Sent Events until the client goes away or loses
+// access. allow decides which events the caller may see; recheck runs on
+// every heartbeat and ends the stream when it returns false.
+func streamGroupEvents(c *gin.Context, groupUsername string, after eventPosition, allow func(*GroupEvent) bool, recheck func() bool) {
+	wake := groupEventHub.subscribe()
+	defer groupEventHub.unsubscribe(wake)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", 3000)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		for {
+			events, err := readGroupEvents(after, groupUsername)
+			if err != nil {
+				log.Printf("Failed to read group events after %d: %v", after.id, err)
+				break
+			}
+			for i := range events {
+				after = events[i].position
+				if allow(&events[i]) {
+					writeEventStreamEvent(c.Writer, &events[i])
+				}
+			}
+			c.Writer.Flush()
+			if len(events) < eventStreamBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-wake:
+		case <-heartbeat.C:
+			if !recheck() {
+				fmt.Fprint(c.Writer, "event: revoked\ndata: {}\n\n")
+				c.Writer.Flush()
+				return
+			}
+			fmt.Fprint(c.Writer, ": keepalive\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+// Stream changes to one group to members who can view it
+func getGroupEvents(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	if !checkPrincipalPermission(c, groupUsername, "view_members") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	canReadArchive := checkPrincipalPermission(c, groupUsername, "read_archive")
+
+	after, err := eventStreamStart(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+		return
+	}
+
+	allow := func(event *GroupEvent) bool {
+		return event.Type != "message.created" || canReadArchive
+	}
+	// Losing read_archive stops new messages but keeps the stream open
+	recheck := func() bool {
+		if !checkPrincipalPermission(c, groupUsername, "view_members") {
+			return false
+		}
+		canReadArchive = checkPrincipalPermission(c, groupUsername, "read_archive")
+		return true
+	}
+	streamGroupEvents(c, groupUsername, after, allow, recheck)
+}
+
+// Look up the groups a subject has a permission on
+func lookupPermittedGroups(subjectType string, subjectID string, permission string) (map[string]bool, error) {
+	request := &v1.LookupResourcesRequest{
+		ResourceObjectType: "group",
+		Permission:         permission,
+		Subject: &v1.SubjectReference{
+			Object: &v1.ObjectReference{
+				ObjectType: subjectType,
+				ObjectId:   subjectID,
+			},
+		},
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{
+				FullyConsistent: true,
+			},
+		},
+		Context: caveatContext(),
+	}
+
+	log.Printf("[SPICEDB] operation=LookupResources resource_type=group permission=%s subject_type=%s subject_id=%s", permission, subjectType, subjectID)
+
+	stream, err := spicedbClient.LookupResources(context.Background(), request)
+	if err != nil {
+		log.Printf("[SPICEDB] operation=LookupResources status=ERROR error=%v", err)
+		return nil, err
+	}
+
+	groups := make(map[string]bool)
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[SPICEDB] operation=LookupResources status=ERROR error=%v", err)
+			return nil, err
+		}
+		if resp.Permissionship != v1.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION {
+			continue
+		}
+		groups[resp.ResourceObjectId] = true
+	}
+
+	log.Printf("[SPICEDB] operation=LookupResources status=SUCCESS group_count=%d", len(groups))
+	return groups, nil
+}
+
+// Stream changes to every group the caller can view. New messages are only
+// sent for groups whose archive the caller can read, as in getGroupEvents. The
+// sets of groups are refreshed on each heartbeat and whenever the caller's own
+// membership changes.
+func getMyEvents(c *gin.Context) {
+	principal := currentPrincipal(c)
+
+	groups, err := lookupPermittedGroups(principal.Type, principal.ID, "view_members")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up groups"})
+		return
+	}
+	archives, err := lookupPermittedGroups(principal.Type, principal.ID, "read_archive")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up groups"})
+		return
+	}
+
+	after, err := eventStreamStart(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+		return
+	}
+
+	refresh := func() bool {
+		updated, err := lookupPermittedGroups(principal.Type, principal.ID, "view_members")
+		if err != nil {
+			// Keep streaming with the groups we already know about
+			return true
+		}
+		updatedArchives, err := lookupPermittedGroups(principal.Type, principal.ID, "read_archive")
+		if err != nil {
+			return true
+		}
+		groups, archives = updated, updatedArchives
+		return true
+	}
+	allow := func(event *GroupEvent) bool {
+		if event.SubjectType == principal.Type && event.SubjectID == principal.ID && event.Type != "message.created" {
+			refresh()
+			// Tell the caller they were removed, even though they've lost access
+			if event.Type == "member.removed" {
+				return true
+			}
+		}
+		if event.Type == "message.created" {
+			return groups[event.GroupUsername] && archives[event.GroupUsername]
+		}
+		return groups[event.GroupUsername]
+	}
+	streamGroupEvents(c, "", after, allow, refresh)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Caveat on expiring relationships; see spicedb-schema.yaml
+const expiryCaveatName = "not_expired"
+
+const (
+	expiryInterval      = time.Minute
+	defaultExpiryNotice = 72 * time.Hour
+)
+
+// Context sent with every check and lookup so expiring relationships are
+// evaluated against the current time. Without it SpiceDB can only answer
+// CONDITIONAL for them, which every caller treats as no access.
+func caveatContext() *structpb.Struct {
+	return &structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			"now": structpb.NewStringValue(time.Now().UTC().Format(time.RFC3339)),
+		},
+	}
+}
+
+// The caveat that makes a relationship lapse at expiresAt
+func expiryCaveat(expiresAt time.Time) *v1.ContextualizedCaveat {
+	return &v1.ContextualizedCaveat{
+		CaveatName: expiryCaveatName,
+		Context: &structpb.Struct{
+			Fields: map[string]*structpb.Value{
+				"expires_at": structpb.NewStringValue(expiresAt.UTC().Format(time.RFC3339)),
+			},
+		},
+	}
+}
+
+// When a relationship lapses, if it has an expiry caveat
+func relationshipExpiry(rel *v1.Relationship) (time.Time, bool) {
+	caveat := rel.GetOptionalCaveat()
+	if caveat.GetCaveatName() != expiryCaveatName {
+		return time.Time{}, false
+	}
+	value, ok := caveat.GetContext().GetFields()["expires_at"]
+	if !ok {
+		return time.Time{}, false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value.GetStringValue())
+	if err != nil {
+		return time.Time{}, false
+	}
+	return expiresAt, true
+}
+
+func formatExpiry(expiresAt sql.NullTime) string {
+	if !expiresAt.Valid {
+		return ""
+	}
+	return expiresAt.Time.UTC().Format(time.RFC3339)
+}
+
+// Parse a requested expiry, which must be in the future
+func parseExpiry(value string) (time.Time, error) {
+	expiresAt, err := parseExportTime(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid expires_at. Use YYYY-MM-DD or RFC 3339")
+	}
+	if !expiresAt.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("expires_at must be in the future")
+	}
+	return expiresAt, nil
+}
+
+// Start the job that warns owners about memberships about to lapse and
+// removes lapsed ones. The caveat already denies access once a membership has
+// expired; removing the relationship keeps listings, events and history honest.
+func startExpiryJob() {
+	notice := defaultExpiryNotice
+	if v := os.Getenv("MEMBERSHIP_EXPIRY_NOTICE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Printf("Invalid MEMBERSHIP_EXPIRY_NOTICE %q, using %v", v, defaultExpiryNotice)
+		} else {
+			notice = d
+		}
+	}
+
+	log.Printf("Membership expiry job running every %v, notifying owners %v ahead", expiryInterval, notice)
+	go func() {
+		for {
+			notifyExpiringMemberships(notice)
+			removeExpiredMemberships()
+			time.Sleep(expiryInterval)
+		}
+	}()
+}
+
+type expiringMembership struct {
+	subjectType string
+	subjectID   string
+	relation    string
+	expiresAt   time.Time
+}
+
+// Tell each group's owners, once, about memberships lapsing within the notice
+// period. Each group is claimed and marked notified in its own transaction, and
+// the emails go out after it commits, so no transaction waits on the relay and
+// a failure in one group doesn't hold back the others.
+func notifyExpiringMemberships(notice time.Duration) {
+	rows, err := db.Query(`
+		SELECT DISTINCT group_username
+		FROM membership_metadata
+		WHERE expires_at > CURRENT_TIMESTAMP
+		  AND expires_at <= CURRENT_TIMESTAMP + $1::int * INTERVAL '1 second'
+		  AND expiry_notified_at IS NULL
+	`, int(notice.Seconds()))
+	if err != nil {
+		log.Printf("[EXPIRY] failed to fetch expiring memberships: %v", err)
+		return
+	}
+
+	var groups []string
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			rows.Close()
+			log.Printf("[EXPIRY] failed to scan expiring membership: %v", err)
+			return
+		}
+		groups = append(groups, group)
+	}
+	rows.Close()
+
+	for _, group := range groups {
+		expiring, err := claimExpiryNotices(group, notice)
+		if err != nil {
+			log.Printf("[EXPIRY] failed to record expiry notice for group %s: %v", group, err)
+			continue
+		}
+		if len(expiring) == 0 {
+			// Another replica got there first
+			continue
+		}
+
+		owners, err := getGroupOwnersFromSpiceDB(group, getConsistencyForGroup(group))
+		if err != nil {
+			log.Printf("[EXPIRY] failed to fetch owners of group %s: %v", group, err)
+			continue
+		}
+		if outboundRelay != nil {
+			for _, owner := range owners {
+				if err := sendExpiryNotice(group, owner, expiring); err != nil {
+					log.Printf("[EXPIRY] failed to email owner %s of group %s: %v", owner, group, err)
+				}
+			}
+		}
+
+		log.Printf("[EXPIRY] notified %d owners of group %s about %d expiring memberships", len(owners), group, len(expiring))
+	}
+}
+
+// Mark a group's memberships lapsing within the notice period as notified and
+// record the member.expiring event, returning the memberships to tell owners about
+func claimExpiryNotices(group string, notice time.Duration) ([]expiringMembership, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE membership_metadata SET expiry_notified_at = CURRENT_TIMESTAMP
+		WHERE (group_username, subject_type, subject_id, relation) IN (
+			SELECT group_username, subject_type, subject_id, relation FROM membership_metadata
+			WHERE group_username = $1
+			  AND expires_at > CURRENT_TIMESTAMP
+			  AND expires_at <= CURRENT_TIMESTAMP + $2::int * INTERVAL '1 second'
+			  AND expiry_notified_at IS NULL
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING subject_type, subject_id, relation, expires_at
+	`, group, int(notice.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	var expiring []expiringMembership
+	for rows.Next() {
+		var m expiringMembership
+		if err := rows.Scan(&m.subjectType, &m.subjectID, &m.relation, &m.expiresAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expiring = append(expiring, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(expiring) == 0 {
+		return nil, nil
+	}
+	sort.SliceStable(expiring, func(i, j int) bool { return expiring[i].expiresAt.Before(expiring[j].expiresAt) })
+
+	var lapsing []map[string]string
+	for _, m := range expiring {
+		lapsing = append(lapsing, map[string]string{
+			"type":       m.subjectType,
+			"username":   m.subjectID,
+			"role":       relationRole(m.relation),
+			"expires_at": m.expiresAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	err = recordGroupEvent(tx, &GroupEvent{
+		Type:          "member.expiring",
+		GroupUsername: group,
+		Actor:         "system:expiry",
+		Data:          eventData(map[string]interface{}{"members": lapsing}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return expiring, tx.Commit()
+}
+
+// Email a group owner the memberships about to lapse
+func sendExpiryNotice(group string, owner string, memberships []expiringMembership) error {
+	from := emailAddress("noreply")
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "These memberships of %s are about to expire:\n\n", emailAddress(group))
+	for _, m := range memberships {
+		fmt.Fprintf(&body, "  %s (%s) expires %s\n", m.subjectID, relationRole(m.relation), m.expiresAt.Format("2006-01-02 15:04 MST"))
+	}
+	body.WriteString("\nExtend a membership by setting a new expires_at on it, or let it lapse.\n")
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s <%s>\r\n", mime.QEncoding.Encode("utf-8", "Groups"), from)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", emailAddress(owner))
+	writeHeader(&buf, "Subject", fmt.Sprintf("%d membership(s) of %s expiring soon", len(memberships), group))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", newMessageID())
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(crlf(body.String()))
+
+	return relayMail(from, emailAddress(owner), buf.Bytes())
+}
+
+// Queue the removal of every lapsed relationship. The metadata row goes in the
+// same transaction, so an extension racing the job either lands first and
+// keeps the membership, or is queued after the removal and restores it.
+func removeExpiredMemberships() {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[EXPIRY] failed to begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		DELETE FROM membership_metadata
+		WHERE expires_at <= CURRENT_TIMESTAMP
+		RETURNING group_username, subject_type, subject_id, relation, expires_at
+	`)
+	if err != nil {
+		log.Printf("[EXPIRY] failed to fetch expired memberships: %v", err)
+		return
+	}
+
+	type expired struct {
+		group string
+		expiringMembership
+	}
+	var lapsed []expired
+	for rows.Next() {
+		var e expired
+		if err := rows.Scan(&e.group, &e.subjectType, &e.subjectID, &e.relation, &e.expiresAt); err != nil {
+			rows.Close()
+			log.Printf("[EXPIRY] failed to scan expired membership: %v", err)
+			return
+		}
+		lapsed = append(lapsed, e)
+	}
+	rows.Close()
+
+	expiredElevations, err := expireElevations(tx)
+	if err != nil {
+		log.Printf("[EXPIRY] failed to expire elevations: %v", err)
+		return
+	}
+	if len(lapsed) == 0 && len(expiredElevations) == 0 {
+		return
+	}
+
+	for _, e := range lapsed {
+		outboxID, err := enqueueOutboxEntry(tx, outboxEntry{
+			groupUsername: e.group,
+			operation:     "DELETE",
+			relation:      e.relation,
+			subjectType:   e.subjectType,
+			subjectID:     e.subjectID,
+		})
+		if err == nil {
+			err = recordAuditEventTx(tx, AuditEvent{
+				Actor:         "system:expiry",
+				Action:        "member.expired",
+				GroupUsername: e.group,
+				Subject:       e.subjectID,
+				Before:        map[string]string{"type": e.subjectType, "role": relationRole(e.relation), "expires_at": e.expiresAt.Format("2006-01-02 15:04:05")},
+				OutboxID:      outboxID,
+			})
+		}
+		if err != nil {
+			log.Printf("[EXPIRY] failed to queue removal of %s %s from group %s: %v", e.subjectType, e.subjectID, e.group, err)
+			return
+		}
+	}
+
+	for _, elevation := range expiredElevations {
+		err := recordAuditEventTx(tx, AuditEvent{
+			Actor:         "system:expiry",
+			Action:        "elevation.expired",
+			GroupUsername: elevation.GroupUsername,
+			Subject:       elevation.Requester,
+			Before:        gin.H{"elevation": elevation.ID, "expires_at": elevation.ExpiresAt},
+		})
+		if err != nil {
+			log.Printf("[EXPIRY] failed to audit expiry of elevation %d: %v", elevation.ID, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("[EXPIRY] failed to commit expired memberships: %v", err)
+		return
+	}
+
+	for _, e := range lapsed {
+		log.Printf("[EXPIRY] membership of %s %s in group %s expired at %s", e.subjectType, e.subjectID, e.group, e.expiresAt.Format("2006-01-02 15:04:05"))
+	}
+}
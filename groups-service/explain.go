@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+)
+
+// One step of a permission check, as traced by SpiceDB
+type ExplainNode struct {
+	Resource   string         `json:"resource"`
+	Permission string         `json:"permission"`
+	Kind       string         `json:"kind"`
+	Subject    string         `json:"subject"`
+	Result     string         `json:"result"`
+	Cached     bool           `json:"cached,omitempty"`
+	Duration   string         `json:"duration,omitempty"`
+	Children   []*ExplainNode `json:"children,omitempty"`
+}
+
+func formatObject(object *v1.ObjectReference) string {
+	if object == nil {
+		return ""
+	}
+	return object.ObjectType + ":" + object.ObjectId
+}
+
+func formatSubject(subject *v1.SubjectReference) string {
+	if subject == nil {
+		return ""
+	}
+	formatted := formatObject(subject.Object)
+	if subject.OptionalRelation != "" {
+		formatted += "#" + subject.OptionalRelation
+	}
+	return formatted
+}
+
+// Convert a SpiceDB debug trace into an explanation tree
+func buildExplainNode(trace *v1.CheckDebugTrace) *ExplainNode {
+	node := &ExplainNode{
+		Resource:   formatObject(trace.GetResource()),
+		Permission: trace.GetPermission(),
+		Subject:    formatSubject(trace.GetSubject()),
+		Cached:     trace.GetWasCachedResult(),
+	}
+
+	switch trace.GetPermissionType() {
+	case v1.CheckDebugTrace_PERMISSION_TYPE_RELATION:
+		node.Kind = "relation"
+	case v1.CheckDebugTrace_PERMISSION_TYPE_PERMISSION:
+		node.Kind = "permission"
+	}
+
+	switch trace.GetResult() {
+	case v1.CheckDebugTrace_PERMISSIONSHIP_HAS_PERMISSION:
+		node.Result = "granted"
+	case v1.CheckDebugTrace_PERMISSIONSHIP_CONDITIONAL_PERMISSION:
+		node.Result = "conditional"
+	default:
+		node.Result = "denied"
+	}
+
+	if duration := trace.GetDuration(); duration != nil {
+		node.Duration = duration.AsDuration().String()
+	}
+
+	for _, child := range trace.GetSubProblems().GetTraces() {
+		node.Children = append(node.Children, buildExplainNode(child))
+	}
+	return node
+}
+
+// Render an explanation tree as indented text, one check per line
+func renderExplainTree(node *ExplainNode, depth int, lines []string) []string {
+	marker := "✗"
+	switch node.Result {
+	case "granted":
+		marker = "✓"
+	case "conditional":
+		marker = "?"
+	}
+
+	line := fmt.Sprintf("%s%s %s#%s (%s)", strings.Repeat("  ", depth), marker, node.Resource, node.Permission, node.Kind)
+	if node.Cached {
+		line += " [cached]"
+	}
+	lines = append(lines, line)
+
+	for _, child := range node.Children {
+		lines = renderExplainTree(child, depth+1, lines)
+	}
+	return lines
+}
+
+func explainGroupPermission(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	// Only platform admins may see why other users can or can't do something
+	username := currentUsername(c)
+	if username == "" || !checkPlatformPermission(username, "explain_permissions") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	subjectUsername := c.Query("user")
+	permission := c.Query("permission")
+	if subjectUsername == "" || permission == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The user and permission query parameters are required"})
+		return
+	}
+
+	request := &v1.CheckPermissionRequest{
+		Resource: &v1.ObjectReference{
+			ObjectType: "group",
+			ObjectId:   groupUsername,
+		},
+		Permission: permission,
+		Subject: &v1.SubjectReference{
+			Object: &v1.ObjectReference{
+				ObjectType: "user",
+				ObjectId:   subjectUsername,
+			},
+		},
+		Consistency: getRequestConsistency(c, groupUsername),
+		Context:     caveatContext(),
+		WithTracing: true,
+	}
+
+	log.Printf("[SPICEDB] operation=CheckPermission tracing=true resource_type=group resource_id=%s permission=%s subject_type=user subject_id=%s",
+		groupUsername, permission, subjectUsername)
+
+	resp, err := spicedbClient.CheckPermission(context.Background(), request)
+	if err != nil {
+		log.Printf("[SPICEDB] operation=CheckPermission status=ERROR error=%v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to check permission: %v", err)})
+		return
+	}
+
+	log.Printf("[SPICEDB] operation=CheckPermission status=SUCCESS permissionship=%s", resp.Permissionship.String())
+
+	response := gin.H{
+		"group":      groupUsername,
+		"user":       subjectUsername,
+		"permission": permission,
+		"allowed":    resp.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION,
+	}
+	if resp.CheckedAt != nil {
+		response["checked_at"] = resp.CheckedAt.Token
+	}
+
+	if trace := resp.GetDebugTrace().GetCheck(); trace != nil {
+		tree := buildExplainNode(trace)
+		response["tree"] = tree
+		response["explanation"] = renderExplainTree(tree, 0, nil)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
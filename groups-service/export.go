@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Parse an export range bound given as an RFC 3339 timestamp or a plain date
+func parseExportTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// Write a message in mboxrd format, quoting body lines that start with "From "
+func writeMboxMessage(w *bufio.Writer, msg *GroupMessage, createdAt time.Time) {
+	fmt.Fprintf(w, "From %s %s\n", emailAddress(msg.SenderUsername), createdAt.UTC().Format(time.ANSIC))
+	fmt.Fprintf(w, "From: <%s>\n", emailAddress(msg.SenderUsername))
+	fmt.Fprintf(w, "To: <%s>\n", emailAddress(msg.GroupUsername))
+	fmt.Fprintf(w, "Subject: %s\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(w, "Date: %s\n", createdAt.Format(time.RFC1123Z))
+	if msg.MessageID != "" {
+		fmt.Fprintf(w, "Message-ID: %s\n", msg.MessageID)
+	}
+	if msg.InReplyTo != "" {
+		fmt.Fprintf(w, "In-Reply-To: %s\n", msg.InReplyTo)
+	}
+	w.WriteString("MIME-Version: 1.0\n")
+	w.WriteString("Content-Type: text/plain; charset=utf-8\n")
+	w.WriteString("Content-Transfer-Encoding: 8bit\n\n")
+
+	for _, line := range strings.Split(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			w.WriteString(">")
+		}
+		w.WriteString(line)
+		w.WriteString("\n")
+	}
+	w.WriteString("\n")
+}
+
+func exportGroupMessages(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	// Check permission to read the archive
+	principal := currentPrincipal(c)
+	if !checkPrincipalPermission(c, groupUsername, "read_archive") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "mbox")
+	if format != "mbox" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format. Must be mbox or json"})
+		return
+	}
+
+	// Optional date range, inclusive of from and exclusive of to
+	query := `
+		SELECT id, sender_username, COALESCE(subject, ''), body, COALESCE(message_id, ''),
+		       COALESCE(in_reply_to, ''), COALESCE(thread_id, id), created_at
+		FROM messages
+		WHERE group_username = $1`
+	args := []interface{}{groupUsername}
+	if from := c.Query("from"); from != "" {
+		t, err := parseExportTime(from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date. Use YYYY-MM-DD or RFC 3339"})
+			return
+		}
+		args = append(args, t)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseExportTime(to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date. Use YYYY-MM-DD or RFC 3339"})
+			return
+		}
+		args = append(args, t)
+		query += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+	query += " ORDER BY created_at, id"
+
+	exists, err := groupExists(groupUsername)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check group existence"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	// Rows are read from the connection one at a time and written straight to
+	// the response, so the archive is never held in memory
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to export messages for group %s: %v", groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export messages"})
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("%s-messages.%s", groupUsername, format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "mbox" {
+		c.Header("Content-Type", "application/mbox")
+	} else {
+		c.Header("Content-Type", "application/json")
+	}
+	c.Status(http.StatusOK)
+
+	w := bufio.NewWriterSize(c.Writer, 64*1024)
+	if format == "json" {
+		w.WriteString("[")
+	}
+
+	count := 0
+	for rows.Next() {
+		msg := GroupMessage{GroupUsername: groupUsername}
+		var createdAt time.Time
+		err := rows.Scan(&msg.ID, &msg.SenderUsername, &msg.Subject, &msg.Body, &msg.MessageID,
+			&msg.InReplyTo, &msg.ThreadID, &createdAt)
+		if err != nil {
+			// Headers are already sent, so all we can do is cut the stream short
+			log.Printf("Failed to scan exported message for group %s: %v", groupUsername, err)
+			break
+		}
+		msg.CreatedAt = createdAt.Format(time.RFC3339)
+
+		if format == "json" {
+			if count > 0 {
+				w.WriteString(",")
+			}
+			encoded, _ := json.Marshal(msg)
+			w.Write(encoded)
+		} else {
+			writeMboxMessage(w, &msg, createdAt)
+		}
+		count++
+
+		if count%500 == 0 {
+			w.Flush()
+			c.Writer.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to export messages for group %s: %v", groupUsername, err)
+	}
+
+	if format == "json" {
+		w.WriteString("]")
+	}
+	w.Flush()
+
+	log.Printf("Exported %d messages from group %s as %s for %s", count, groupUsername, format, principal.Actor())
+}
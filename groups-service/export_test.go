@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExportTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+		ok    bool
+	}{
+		{"2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), true},
+		{"2024-03-01T12:30:00Z", time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC), true},
+		{"2024-03-01T12:30:00+02:00", time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC), true},
+		{"03/01/2024", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExportTime(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseExportTime(%q) error = %v, want ok=%v", tt.value, err, tt.ok)
+			continue
+		}
+		if tt.ok && !got.Equal(tt.want) {
+			t.Errorf("parseExportTime(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func writeTestMbox(msgs ...*GroupMessage) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	createdAt := time.Date(2024, 3, 1, 9, 5, 0, 0, time.UTC)
+	for _, msg := range msgs {
+		writeMboxMessage(w, msg, createdAt)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func TestWriteMboxMessageHeaders(t *testing.T) {
+	emailDomain = "company.com"
+
+	out := writeTestMbox(&GroupMessage{
+		GroupUsername:  "eng",
+		SenderUsername: "achen",
+		Subject:        "Café menu",
+		Body:           "Hello",
+		MessageID:      "<2@company.com>",
+		InReplyTo:      "<1@company.com>",
+	})
+
+	want := "From achen@company.com Fri Mar  1 09:05:00 2024\n" +
+		"From: <achen@company.com>\n" +
+		"To: <eng@company.com>\n" +
+		"Subject: =?utf-8?q?Caf=C3=A9_menu?=\n" +
+		"Date: Fri, 01 Mar 2024 09:05:00 +0000\n" +
+		"Message-ID: <2@company.com>\n" +
+		"In-Reply-To: <1@company.com>\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: text/plain; charset=utf-8\n" +
+		"Content-Transfer-Encoding: 8bit\n" +
+		"\n" +
+		"Hello\n" +
+		"\n"
+	if out != want {
+		t.Errorf("writeMboxMessage wrote\n%s\nwant\n%s", out, want)
+	}
+}
+
+// mboxrd quotes every body line matching ^>*From  with one more '>', so a
+// reader can split on "From " lines and strip one '>' to get the body back
+func TestWriteMboxMessageEscapesFromLines(t *testing.T) {
+	emailDomain = "company.com"
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"From here on, use the new VPN.", ">From here on, use the new VPN."},
+		{">From the last message:", ">>From the last message:"},
+		{">>From two levels up", ">>>From two levels up"},
+		{"From", "From"},
+		{"Fromage is French for cheese", "Fromage is French for cheese"},
+		{" From with a leading space", " From with a leading space"},
+		{"> quoted text", "> quoted text"},
+		{"from lowercase", "from lowercase"},
+	}
+
+	for _, tt := range tests {
+		out := writeTestMbox(&GroupMessage{GroupUsername: "eng", SenderUsername: "achen", Body: "First line\n" + tt.line})
+		body := out[strings.Index(out, "\n\n")+2:]
+		if want := "First line\n" + tt.want + "\n\n"; body != want {
+			t.Errorf("Body line %q written as %q, want %q", tt.line, body, want)
+		}
+	}
+}
+
+func TestWriteMboxMessageKeepsMessagesApart(t *testing.T) {
+	emailDomain = "company.com"
+
+	out := writeTestMbox(
+		&GroupMessage{GroupUsername: "eng", SenderUsername: "achen", Subject: "One", Body: "From the top\r\nsecond line\r\n"},
+		&GroupMessage{GroupUsername: "eng", SenderUsername: "tkim", Subject: "Two", Body: ">From a quote"},
+	)
+
+	if strings.Contains(out, "\r") {
+		t.Errorf("Output contains CR: %q", out)
+	}
+
+	var separators int
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "From ") {
+			separators++
+		}
+	}
+	if separators != 2 {
+		t.Errorf("Found %d From_ lines, want 2 in\n%s", separators, out)
+	}
+	if !strings.Contains(out, "\n>From the top\nsecond line\n") {
+		t.Errorf("First body not escaped as expected:\n%s", out)
+	}
+	if !strings.Contains(out, "\n>>From a quote\n") {
+		t.Errorf("Second body not escaped as expected:\n%s", out)
+	}
+}
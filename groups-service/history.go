@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+)
+
+// A period during which a subject held a relation on a group
+type MembershipInterval struct {
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	Type      string `json:"type"`
+	StartedAt string `json:"started_at,omitempty"`
+	EndedAt   string `json:"ended_at,omitempty"`
+	// Set when a time is when the Watch consumer saw the change rather than
+	// when it was written, which trails the write by the consumer's lag
+	StartedAtApproximate bool `json:"started_at_approximate,omitempty"`
+	EndedAtApproximate   bool `json:"ended_at_approximate,omitempty"`
+}
+
+// Open and close membership intervals for relationship changes seen through
+// the Watch API. Intervals are timed when the write was made, where the service
+// made it; changes written elsewhere are timed when they are consumed.
+func applyMembershipIntervalUpdates(tx *sql.Tx, updates []*v1.RelationshipUpdate, zedtoken string) error {
+	writtenAt, err := zedtokenWriteTime(tx, zedtoken)
+	if err != nil {
+		return err
+	}
+	for _, update := range updates {
+		rel := update.Relationship
+		var err error
+		if update.Operation == v1.RelationshipUpdate_OPERATION_DELETE {
+			err = closeMembershipInterval(tx, rel, zedtoken, writtenAt)
+		} else {
+			err = openMembershipInterval(tx, rel, zedtoken, writtenAt, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find when the service made the SpiceDB write a zedtoken came from. The write
+// paths keep it against the token: the outbox when it applies an entry, the
+// scheduler when it applies a change, and the audit log for writes made by the
+// member handlers. Writes made outside the service, or whose record hasn't
+// committed yet, have no time.
+func zedtokenWriteTime(tx *sql.Tx, zedtoken string) (sql.NullTime, error) {
+	var writtenAt sql.NullTime
+	if zedtoken == "" {
+		return writtenAt, nil
+	}
+	err := tx.QueryRow(`
+		SELECT LEAST(
+			(SELECT MIN(applied_at) FROM spicedb_outbox WHERE zedtoken = $1),
+			(SELECT MIN(applied_at) FROM scheduled_membership_changes WHERE zedtoken = $1),
+			(SELECT MIN(created_at) FROM audit_events WHERE zedtoken = $1)
+		)
+	`, zedtoken).Scan(&writtenAt)
+	return writtenAt, err
+}
+
+// Open an interval at writtenAt, or now when the write time isn't known
+func openMembershipInterval(tx *sql.Tx, rel *v1.Relationship, zedtoken string, writtenAt sql.NullTime, backfilled bool) error {
+	_, err := tx.Exec(`
+		INSERT INTO membership_intervals (group_username, subject_type, subject_id, relation, started_zedtoken, backfilled, started_at, started_approximate)
+		SELECT $1, $2, $3, $4, $5, $6, COALESCE($7, CURRENT_TIMESTAMP), $7 IS NULL
+		WHERE NOT EXISTS (
+			SELECT 1 FROM membership_intervals
+			WHERE group_username = $1 AND subject_type = $2 AND subject_id = $3 AND relation = $4 AND ended_at IS NULL
+		)
+	`, rel.Resource.ObjectId, rel.Subject.Object.ObjectType, rel.Subject.Object.ObjectId, rel.Relation, nullString(zedtoken), backfilled, writtenAt)
+	return err
+}
+
+// Close an interval at writtenAt, or now when the write time isn't known
+func closeMembershipInterval(tx *sql.Tx, rel *v1.Relationship, zedtoken string, writtenAt sql.NullTime) error {
+	_, err := tx.Exec(`
+		UPDATE membership_intervals
+		SET ended_at = GREATEST(COALESCE($6, CURRENT_TIMESTAMP), started_at), ended_zedtoken = $5, ended_approximate = $6 IS NULL
+		WHERE group_username = $1 AND subject_type = $2 AND subject_id = $3 AND relation = $4 AND ended_at IS NULL
+	`, rel.Resource.ObjectId, rel.Subject.Object.ObjectType, rel.Subject.Object.ObjectId, rel.Relation, nullString(zedtoken), writtenAt)
+	return err
+}
+
+// Bring the open intervals in line with a snapshot of every group
+// relationship, for when the consumer starts without a checkpoint. Changes
+// made before the snapshot are unknown: relationships without an open interval
+// get a backfilled one starting now, and open intervals for relationships that
+// are gone are closed now.
+func resyncMembershipIntervals(tx *sql.Tx, relationships []*v1.Relationship, zedtoken string) error {
+	type intervalKey struct {
+		group, subjectType, subjectID, relation string
+	}
+
+	rows, err := tx.Query(`
+		SELECT group_username, subject_type, subject_id, relation
+		FROM membership_intervals WHERE ended_at IS NULL
+	`)
+	if err != nil {
+		return err
+	}
+	open := make(map[intervalKey]bool)
+	for rows.Next() {
+		var key intervalKey
+		if err := rows.Scan(&key.group, &key.subjectType, &key.subjectID, &key.relation); err != nil {
+			rows.Close()
+			return err
+		}
+		open[key] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	opened, closed := 0, 0
+	current := make(map[intervalKey]bool)
+	for _, rel := range relationships {
+		key := intervalKey{rel.Resource.ObjectId, rel.Subject.Object.ObjectType, rel.Subject.Object.ObjectId, rel.Relation}
+		current[key] = true
+		if open[key] {
+			continue
+		}
+		if err := openMembershipInterval(tx, rel, zedtoken, sql.NullTime{}, true); err != nil {
+			return err
+		}
+		opened++
+	}
+
+	for key := range open {
+		if current[key] {
+			continue
+		}
+		rel := &v1.Relationship{
+			Resource: &v1.ObjectReference{ObjectType: "group", ObjectId: key.group},
+			Relation: key.relation,
+			Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: key.subjectType, ObjectId: key.subjectID}},
+		}
+		if err := closeMembershipInterval(tx, rel, zedtoken, sql.NullTime{}); err != nil {
+			return err
+		}
+		closed++
+	}
+
+	log.Printf("[WATCH] resynced membership history from snapshot at %s opened=%d closed=%d", zedtoken, opened, closed)
+	return nil
+}
+
+// Look up who held a relation on a group at a given moment
+func getMembershipAsOf(groupUsername string, asOf time.Time) ([]MembershipInterval, error) {
+	rows, err := db.Query(`
+		SELECT subject_id, subject_type, relation, started_at, backfilled, started_approximate, ended_at, ended_approximate
+		FROM membership_intervals
+		WHERE group_username = $1
+		  AND subject_type IN ('user', 'service_account')
+		  AND started_at <= $2
+		  AND (ended_at IS NULL OR ended_at > $2)
+		ORDER BY subject_type, subject_id, relation
+	`, groupUsername, asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []MembershipInterval{}
+	for rows.Next() {
+		var member MembershipInterval
+		var relation string
+		var startedAt time.Time
+		var backfilled bool
+		var endedAt sql.NullTime
+		if err := rows.Scan(&member.Username, &member.Type, &relation, &startedAt, &backfilled, &member.StartedAtApproximate, &endedAt, &member.EndedAtApproximate); err != nil {
+			return nil, err
+		}
+		member.Role = relationRole(relation)
+		// A backfilled interval began at some unknown time before history did
+		if backfilled {
+			member.StartedAtApproximate = false
+		} else {
+			member.StartedAt = startedAt.Format("2006-01-02 15:04:05")
+		}
+		if endedAt.Valid {
+			member.EndedAt = endedAt.Time.Format("2006-01-02 15:04:05")
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// Membership as it was at ?as_of=, for incident reviews. Past membership is
+// audit information, so it needs view_audit rather than view_members.
+func getGroupMembersAsOf(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	username := currentUsername(c)
+	allowed := username != "" && checkPlatformPermission(username, "view_audit")
+	if !allowed && !checkPrincipalPermission(c, groupUsername, "view_audit") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	asOf, err := parseExportTime(c.Query("as_of"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid as_of. Use YYYY-MM-DD or RFC 3339"})
+		return
+	}
+
+	var historyStart sql.NullTime
+	if err := db.QueryRow("SELECT MIN(started_at) FROM membership_intervals").Scan(&historyStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch membership history"})
+		return
+	}
+	if !historyStart.Valid || asOf.Before(historyStart.Time) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Membership history does not go back that far"})
+		return
+	}
+
+	members, err := getMembershipAsOf(groupUsername, asOf)
+	if err != nil {
+		log.Printf("Failed to fetch membership of group %s as of %v: %v", groupUsername, asOf, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch membership history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// Whether the relation an event names was already held, according to the history
+func hasOpenMembershipInterval(tx *sql.Tx, event *GroupEvent) (bool, error) {
+	relation, _ := roleRelation(event.Role)
+	var exists bool
+	err := tx.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM membership_intervals
+			WHERE group_username = $1 AND subject_type = $2 AND subject_id = $3 AND relation = $4 AND ended_at IS NULL
+		)
+	`, event.GroupUsername, event.SubjectType, event.SubjectID, relation).Scan(&exists)
+	return exists, err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+)
+
+// The single platform object that holds platform-wide roles
+const platformObjectID = "main"
+
+// Check a platform-wide permission for a user
+func checkPlatformPermission(username string, permission string) bool {
+	request := &v1.CheckPermissionRequest{
+		Resource: &v1.ObjectReference{
+			ObjectType: "platform",
+			ObjectId:   platformObjectID,
+		},
+		Permission: permission,
+		Subject: &v1.SubjectReference{
+			Object: &v1.ObjectReference{
+				ObjectType: "user",
+				ObjectId:   username,
+			},
+		},
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{
+				FullyConsistent: true,
+			},
+		},
+	}
+
+	log.Printf("[SPICEDB] operation=CheckPermission resource_type=platform resource_id=%s permission=%s subject_type=user subject_id=%s",
+		platformObjectID, permission, username)
+
+	resp, err := spicedbClient.CheckPermission(context.Background(), request)
+	if err != nil {
+		log.Printf("[SPICEDB] operation=CheckPermission status=ERROR error=%v", err)
+		return false
+	}
+
+	log.Printf("[SPICEDB] operation=CheckPermission status=SUCCESS permissionship=%s", resp.Permissionship.String())
+	return resp.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+}
+
+// Let platform admins view the service as another user with the X-Act-As header.
+// Impersonation is read-only and every impersonated request is audited.
+func impersonationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		target := c.GetHeader("X-Act-As")
+		if target == "" {
+			c.Next()
+			return
+		}
+
+		admin := currentUsername(c)
+		if admin == "" || !checkPlatformPermission(admin, "impersonate") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Only platform admins may act as another user"})
+			return
+		}
+
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Impersonated requests are read-only"})
+			return
+		}
+
+		if !isSystemUser(target) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "X-Act-As must name a valid system user"})
+			return
+		}
+
+		err := recordAuditEvent(AuditEvent{
+			Actor:          target,
+			ImpersonatedBy: admin,
+			Action:         "impersonation.request",
+			Subject:        target,
+			RequestID:      c.GetString(requestIDContextKey),
+			After: map[string]string{
+				"method": c.Request.Method,
+				"path":   c.Request.URL.RequestURI(),
+			},
+		})
+		if err != nil {
+			// Impersonation without an audit trail is not allowed
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to record impersonation"})
+			return
+		}
+
+		log.Printf("[AUTH] impersonation admin=%s target=%s path=%s", admin, target, c.Request.URL.Path)
+		c.Set(principalContextKey, &Principal{Type: "user", ID: target, Method: "impersonation", ImpersonatedBy: admin})
+		c.Header("X-Acting-As", target)
+		c.Next()
+	}
+}
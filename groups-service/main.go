@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -28,6 +30,7 @@ type Group struct {
 	Visibility  string   `json:"visibility" db:"visibility"`
 	Zedtoken    string   `json:"zedtoken,omitempty" db:"zedtoken"`
 	Owners      []string `json:"owners"`
+	SyncStatus  string   `json:"sync_status,omitempty"`
 	CreatedAt   string   `json:"created_at" db:"created_at"`
 }
 
@@ -49,6 +52,7 @@ type User struct {
 var (
 	db            *sql.DB
 	spicedbClient *authzed.Client
+	emailDomain   string
 )
 
 // Hardcoded users list - source of truth for all users in the system
@@ -155,6 +159,36 @@ func initializeTestData() {
 		})
 	}
 
+	// achen is the demo's platform admin and may view the service as other users.
+	// Written on its own with TOUCH so it lands even when SpiceDB already holds
+	// the sample memberships and the CREATE batch below fails.
+	platformAdmin := &v1.WriteRelationshipsRequest{
+		Updates: []*v1.RelationshipUpdate{
+			{
+				Operation: v1.RelationshipUpdate_OPERATION_TOUCH,
+				Relationship: &v1.Relationship{
+					Resource: &v1.ObjectReference{
+						ObjectType: "platform",
+						ObjectId:   platformObjectID,
+					},
+					Relation: "admin",
+					Subject: &v1.SubjectReference{
+						Object: &v1.ObjectReference{
+							ObjectType: "user",
+							ObjectId:   "achen",
+						},
+					},
+				},
+			},
+		},
+	}
+	log.Printf("[SPICEDB] operation=WriteRelationships context=initialization action=TOUCH resource_type=platform resource_id=%s relation=admin subject_type=user subject_id=achen", platformObjectID)
+	if resp, err := spicedbClient.WriteRelationships(context.Background(), platformAdmin); err != nil {
+		log.Printf("[SPICEDB] operation=WriteRelationships context=initialization status=ERROR error=%v", err)
+	} else {
+		log.Printf("[SPICEDB] operation=WriteRelationships context=initialization status=SUCCESS written_at=%s", resp.WrittenAt.Token)
+	}
+
 	if len(updates) > 0 {
 		request := &v1.WriteRelationshipsRequest{
 			Updates: updates,
@@ -179,17 +213,36 @@ func initializeTestData() {
 		} else {
 			log.Printf("[SPICEDB] operation=WriteRelationships context=initialization status=SUCCESS written_at=%s update_count=%d", resp.WrittenAt.Token, len(updates))
 
-			// Store zedtokens for both test groups
+			// Store zedtokens for both test groups. This runs before the server
+			// accepts requests, so no other write can race it.
+			tx, err := db.Begin()
+			if err != nil {
+				log.Printf("Warning: Failed to store initial zedtokens: %v", err)
+				return
+			}
+			defer tx.Rollback()
 			for _, groupUsername := range []string{"engineering", "product"} {
-				if err := storeGroupZedtoken(groupUsername, resp.WrittenAt.Token); err != nil {
+				if _, err := storeGroupZedtoken(tx, groupUsername, resp.WrittenAt.Token); err != nil {
 					log.Printf("Warning: Failed to store initial zedtoken for group %s: %v", groupUsername, err)
 				}
 			}
+			if err := tx.Commit(); err != nil {
+				log.Printf("Warning: Failed to store initial zedtokens: %v", err)
+			}
 		}
 	}
 }
 
 func checkPermission(username string, groupUsername string, permission string) bool {
+	return checkSubjectPermission("user", username, groupUsername, permission)
+}
+
+// Check a group permission for any subject type (users or service accounts)
+func checkSubjectPermission(subjectType string, subjectID string, groupUsername string, permission string) bool {
+	return checkSubjectPermissionWithConsistency(subjectType, subjectID, groupUsername, permission, getConsistencyForGroup(groupUsername))
+}
+
+func checkSubjectPermissionWithConsistency(subjectType string, subjectID string, groupUsername string, permission string, consistency *v1.Consistency) bool {
 	request := &v1.CheckPermissionRequest{
 		Resource: &v1.ObjectReference{
 			ObjectType: "group",
@@ -198,11 +251,12 @@ func checkPermission(username string, groupUsername string, permission string) b
 		Permission: permission,
 		Subject: &v1.SubjectReference{
 			Object: &v1.ObjectReference{
-				ObjectType: "user",
-				ObjectId:   username,
+				ObjectType: subjectType,
+				ObjectId:   subjectID,
 			},
 		},
-		Consistency: getConsistencyForGroup(groupUsername),
+		Consistency: consistency,
+		Context:     caveatContext(),
 	}
 
 	// Log the SpiceDB check request parameters
@@ -222,21 +276,28 @@ func checkPermission(username string, groupUsername string, permission string) b
 	return resp.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
 }
 
-func addSpiceDBRelationship(groupUsername string, username string, role string) error {
-	var relation string
-	switch role {
-	case "OWNER", "MANAGER":
-		relation = "admin"
-	case "MEMBER":
-		relation = "member"
-	default:
-		return fmt.Errorf("invalid role: %s", role)
+func addSpiceDBRelationship(groupUsername string, username string, role string) (string, error) {
+	return addSpiceDBSubjectRelationship(groupUsername, "user", username, role)
+}
+
+// Write a group role for a subject, returning the zedtoken of the write
+func addSpiceDBSubjectRelationship(groupUsername string, subjectType string, subjectID string, role string) (string, error) {
+	return addSpiceDBSubjectRelationshipWithExpiry(groupUsername, subjectType, subjectID, role, sql.NullTime{})
+}
+
+// Write a group role for a subject that lapses at expiresAt, if set. TOUCH
+// replaces a lapsed relationship the expiry job hasn't removed yet, so such a
+// subject can be added again.
+func addSpiceDBSubjectRelationshipWithExpiry(groupUsername string, subjectType string, subjectID string, role string, expiresAt sql.NullTime) (string, error) {
+	relation, ok := roleRelation(role)
+	if !ok {
+		return "", fmt.Errorf("invalid role: %s", role)
 	}
 
 	request := &v1.WriteRelationshipsRequest{
 		Updates: []*v1.RelationshipUpdate{
 			{
-				Operation: v1.RelationshipUpdate_OPERATION_CREATE,
+				Operation: v1.RelationshipUpdate_OPERATION_TOUCH,
 				Relationship: &v1.Relationship{
 					Resource: &v1.ObjectReference{
 						ObjectType: "group",
@@ -245,8 +306,8 @@ func addSpiceDBRelationship(groupUsername string, username string, role string)
 					Relation: relation,
 					Subject: &v1.SubjectReference{
 						Object: &v1.ObjectReference{
-							ObjectType: "user",
-							ObjectId:   username,
+							ObjectType: subjectType,
+							ObjectId:   subjectID,
 						},
 					},
 				},
@@ -254,29 +315,33 @@ func addSpiceDBRelationship(groupUsername string, username string, role string)
 		},
 	}
 
-	// Log the SpiceDB write request parameters
-	log.Printf("[SPICEDB] operation=WriteRelationships action=CREATE resource_type=group resource_id=%s relation=%s subject_type=user subject_id=%s",
-		groupUsername, relation, username)
-
-	resp, err := spicedbClient.WriteRelationships(context.Background(), request)
-	if err != nil {
-		log.Printf("[SPICEDB] operation=WriteRelationships status=ERROR error=%v", err)
-		return err
+	if expiresAt.Valid {
+		request.Updates[0].Relationship.OptionalCaveat = expiryCaveat(expiresAt.Time)
 	}
 
-	// Log the response and store zedtoken
-	log.Printf("[SPICEDB] operation=WriteRelationships status=SUCCESS written_at=%s", resp.WrittenAt.Token)
+	// Log the SpiceDB write request parameters
+	log.Printf("[SPICEDB] operation=WriteRelationships action=TOUCH resource_type=group resource_id=%s relation=%s subject_type=%s subject_id=%s expires_at=%s",
+		groupUsername, relation, subjectType, subjectID, formatExpiry(expiresAt))
 
-	// Store the zedtoken for future consistency
-	if err := storeGroupZedtoken(groupUsername, resp.WrittenAt.Token); err != nil {
-		log.Printf("Warning: Failed to store zedtoken for group %s: %v", groupUsername, err)
-		// Don't fail the operation if zedtoken storage fails
-	}
+	return writeGroupRelationships(groupUsername, func() (string, error) {
+		resp, err := spicedbClient.WriteRelationships(context.Background(), request)
+		if err != nil {
+			log.Printf("[SPICEDB] operation=WriteRelationships status=ERROR error=%v", err)
+			return "", err
+		}
 
-	return nil
+		// Log the response; the zedtoken is stored under the group's write lock
+		log.Printf("[SPICEDB] operation=WriteRelationships status=SUCCESS written_at=%s", resp.WrittenAt.Token)
+		return resp.WrittenAt.Token, nil
+	})
+}
+
+func removeSpiceDBRelationship(groupUsername string, username string) (string, error) {
+	return removeSpiceDBSubjectRelationship(groupUsername, "user", username)
 }
 
-func removeSpiceDBRelationship(groupUsername string, username string) error {
+// Remove every group role for a subject, returning the zedtoken of the write
+func removeSpiceDBSubjectRelationship(groupUsername string, subjectType string, subjectID string) (string, error) {
 	// Remove both admin and member relationships
 	updates := []*v1.RelationshipUpdate{
 		{
@@ -289,8 +354,8 @@ func removeSpiceDBRelationship(groupUsername string, username string) error {
 				Relation: "admin",
 				Subject: &v1.SubjectReference{
 					Object: &v1.ObjectReference{
-						ObjectType: "user",
-						ObjectId:   username,
+						ObjectType: subjectType,
+						ObjectId:   subjectID,
 					},
 				},
 			},
@@ -305,8 +370,8 @@ func removeSpiceDBRelationship(groupUsername string, username string) error {
 				Relation: "member",
 				Subject: &v1.SubjectReference{
 					Object: &v1.ObjectReference{
-						ObjectType: "user",
-						ObjectId:   username,
+						ObjectType: subjectType,
+						ObjectId:   subjectID,
 					},
 				},
 			},
@@ -318,27 +383,80 @@ func removeSpiceDBRelationship(groupUsername string, username string) error {
 	}
 
 	// Log the SpiceDB write request parameters
-	log.Printf("[SPICEDB] operation=WriteRelationships action=DELETE resource_type=group resource_id=%s subject_type=user subject_id=%s relations=admin,member", groupUsername, username)
+	log.Printf("[SPICEDB] operation=WriteRelationships action=DELETE resource_type=group resource_id=%s subject_type=%s subject_id=%s relations=admin,member", groupUsername, subjectType, subjectID)
 
-	resp, err := spicedbClient.WriteRelationships(context.Background(), request)
-	if err != nil {
-		log.Printf("[SPICEDB] operation=WriteRelationships status=ERROR error=%v", err)
-		return err
+	return writeGroupRelationships(groupUsername, func() (string, error) {
+		resp, err := spicedbClient.WriteRelationships(context.Background(), request)
+		if err != nil {
+			log.Printf("[SPICEDB] operation=WriteRelationships status=ERROR error=%v", err)
+			return "", err
+		}
+
+		// Log the response; the zedtoken is stored under the group's write lock
+		log.Printf("[SPICEDB] operation=WriteRelationships status=SUCCESS written_at=%s", resp.WrittenAt.Token)
+		return resp.WrittenAt.Token, nil
+	})
+}
+
+// Move a subject to a different group role in a single write, so it never
+// holds neither relation in between. Returns the zedtoken of the write.
+func setSpiceDBSubjectRole(groupUsername string, subjectType string, subjectID string, role string, expiresAt sql.NullTime) (string, error) {
+	relation, ok := roleRelation(role)
+	if !ok {
+		return "", fmt.Errorf("invalid role: %s", role)
+	}
+	otherRelation := "member"
+	if relation == "member" {
+		otherRelation = "admin"
 	}
 
-	// Log the response and store zedtoken
-	log.Printf("[SPICEDB] operation=WriteRelationships status=SUCCESS written_at=%s", resp.WrittenAt.Token)
+	subject := &v1.SubjectReference{
+		Object: &v1.ObjectReference{
+			ObjectType: subjectType,
+			ObjectId:   subjectID,
+		},
+	}
+	resource := &v1.ObjectReference{
+		ObjectType: "group",
+		ObjectId:   groupUsername,
+	}
 
-	// Store the zedtoken for future consistency
-	if err := storeGroupZedtoken(groupUsername, resp.WrittenAt.Token); err != nil {
-		log.Printf("Warning: Failed to store zedtoken for group %s: %v", groupUsername, err)
-		// Don't fail the operation if zedtoken storage fails
+	touch := &v1.Relationship{Resource: resource, Relation: relation, Subject: subject}
+	if expiresAt.Valid {
+		touch.OptionalCaveat = expiryCaveat(expiresAt.Time)
 	}
 
-	return nil
+	request := &v1.WriteRelationshipsRequest{
+		Updates: []*v1.RelationshipUpdate{
+			{
+				Operation:    v1.RelationshipUpdate_OPERATION_DELETE,
+				Relationship: &v1.Relationship{Resource: resource, Relation: otherRelation, Subject: subject},
+			},
+			{
+				Operation:    v1.RelationshipUpdate_OPERATION_TOUCH,
+				Relationship: touch,
+			},
+		},
+	}
+
+	// Log the SpiceDB write request parameters
+	log.Printf("[SPICEDB] operation=WriteRelationships action=DELETE,TOUCH resource_type=group resource_id=%s relation=%s subject_type=%s subject_id=%s replaces=%s expires_at=%s",
+		groupUsername, relation, subjectType, subjectID, otherRelation, formatExpiry(expiresAt))
+
+	return writeGroupRelationships(groupUsername, func() (string, error) {
+		resp, err := spicedbClient.WriteRelationships(context.Background(), request)
+		if err != nil {
+			log.Printf("[SPICEDB] operation=WriteRelationships status=ERROR error=%v", err)
+			return "", err
+		}
+
+		// Log the response; the zedtoken is stored under the group's write lock
+		log.Printf("[SPICEDB] operation=WriteRelationships status=SUCCESS written_at=%s", resp.WrittenAt.Token)
+		return resp.WrittenAt.Token, nil
+	})
 }
 
-func deleteSpiceDBGroup(groupUsername string) error {
+func deleteSpiceDBGroup(groupUsername string) (string, error) {
 	// Delete all relationships for this group
 	filter := &v1.RelationshipFilter{
 		ResourceType:       "group",
@@ -352,22 +470,32 @@ func deleteSpiceDBGroup(groupUsername string) error {
 	// Log the SpiceDB delete request parameters
 	log.Printf("[SPICEDB] operation=DeleteRelationships resource_type=group resource_id=%s", groupUsername)
 
-	resp, err := spicedbClient.DeleteRelationships(context.Background(), request)
-	if err != nil {
-		log.Printf("[SPICEDB] operation=DeleteRelationships status=ERROR error=%v", err)
-		return err
-	}
+	return writeGroupRelationships(groupUsername, func() (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), outboxWriteTimeout)
+		defer cancel()
+		resp, err := spicedbClient.DeleteRelationships(ctx, request)
+		if err != nil {
+			log.Printf("[SPICEDB] operation=DeleteRelationships status=ERROR error=%v", err)
+			return "", err
+		}
 
-	// Log the response and store zedtoken
-	log.Printf("[SPICEDB] operation=DeleteRelationships status=SUCCESS deleted_at=%s", resp.DeletedAt.Token)
+		// Log the response; the zedtoken is stored under the group's write lock
+		log.Printf("[SPICEDB] operation=DeleteRelationships status=SUCCESS deleted_at=%s", resp.DeletedAt.Token)
+		return resp.DeletedAt.Token, nil
+	})
+}
 
-	// Store the zedtoken for future consistency
-	if err := storeGroupZedtoken(groupUsername, resp.DeletedAt.Token); err != nil {
-		log.Printf("Warning: Failed to store zedtoken for group %s: %v", groupUsername, err)
-		// Don't fail the operation if zedtoken storage fails
+func initConfig() {
+	emailDomain = strings.ToLower(os.Getenv("EMAIL_DOMAIN"))
+	if emailDomain == "" {
+		emailDomain = "company.com"
 	}
+	log.Printf("Using email domain %s", emailDomain)
+}
 
-	return nil
+// Build the email address for a user or group username
+func emailAddress(username string) string {
+	return fmt.Sprintf("%s@%s", username, emailDomain)
 }
 
 func initDB() {
@@ -406,6 +534,8 @@ func initDB() {
 	}
 
 	log.Println("Database connected and schema initialized")
+
+	startNotificationListener(databaseURL)
 }
 
 func logMiddleware() gin.HandlerFunc {
@@ -429,16 +559,35 @@ func logMiddleware() gin.HandlerFunc {
 			path = path + "?" + raw
 		}
 
-		log.Printf("[HTTP] method=%s path=%s status=%d latency=%v ip=%s",
-			method, path, statusCode, latency, clientIP)
+		log.Printf("[HTTP] method=%s path=%s status=%d latency=%v ip=%s request_id=%s",
+			method, path, statusCode, latency, clientIP, c.GetString(requestIDContextKey))
+	}
+}
+
+const requestIDContextKey = "request_id"
+
+// Tag each request with an ID, reusing the caller's X-Request-ID when it
+// looks sane so a request can be traced from the frontend into the audit log
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := strings.TrimSpace(c.GetHeader("X-Request-ID"))
+		if requestID == "" || len(requestID) > 100 {
+			buf := make([]byte, 16)
+			rand.Read(buf)
+			requestID = hex.EncodeToString(buf)
+		}
+		c.Set(requestIDContextKey, requestID)
+		c.Header("X-Request-ID", requestID)
+		c.Next()
 	}
 }
 
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Username")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Username, X-API-Key, X-Act-As, X-Zedtoken, X-Consistency, X-Request-ID")
+		c.Header("Access-Control-Expose-Headers", "X-Zedtoken, X-Acting-As, X-Request-ID")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
 			return
@@ -459,6 +608,13 @@ func getGroups(c *gin.Context) {
 	}
 	defer rows.Close()
 
+	// Groups whose SpiceDB changes are still queued
+	pendingSync, err := getGroupsWithPendingSync()
+	if err != nil {
+		log.Printf("Failed to fetch pending SpiceDB changes: %v", err)
+		pendingSync = map[string]bool{}
+	}
+
 	var groups []Group
 	for rows.Next() {
 		var group Group
@@ -473,13 +629,17 @@ func getGroups(c *gin.Context) {
 			return
 		}
 		group.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
-		group.Email = fmt.Sprintf("%s@company.com", group.Username)
+		group.Email = emailAddress(group.Username)
 		if zedtoken.Valid {
 			group.Zedtoken = zedtoken.String
 		}
+		group.SyncStatus = "APPLIED"
+		if pendingSync[group.Username] {
+			group.SyncStatus = "PENDING"
+		}
 
 		// Fetch owners for this group from SpiceDB
-		owners, err := getGroupOwnersFromSpiceDB(group.Username)
+		owners, err := getGroupOwnersFromSpiceDB(group.Username, getRequestConsistency(c, group.Username))
 		if err != nil {
 			log.Printf("Failed to fetch owners for group %s: %v", group.Username, err)
 			group.Owners = []string{}
@@ -503,16 +663,23 @@ func isSystemUser(username string) bool {
 	return false
 }
 
-// Helper function to validate that a username doesn't conflict with existing groups or users
-func validateUsername(username string) error {
+// Helper function to validate that a username doesn't conflict with existing groups, aliases or users.
+// Call it in the transaction that claims the name.
+func validateUsername(tx *sql.Tx, username string) error {
 	// Check if it conflicts with system users
 	if isSystemUser(username) {
 		return fmt.Errorf("username '%s' conflicts with an existing user", username)
 	}
 
+	// Groups and aliases of the same name wait on each other here, so the
+	// second to commit sees the first
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", "username:"+username); err != nil {
+		return fmt.Errorf("failed to lock username: %v", err)
+	}
+
 	// Check if it conflicts with existing groups
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM groups WHERE username = $1)", username).Scan(&exists)
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM groups WHERE username = $1)", username).Scan(&exists)
 	if err != nil {
 		return fmt.Errorf("failed to check existing groups: %v", err)
 	}
@@ -520,41 +687,114 @@ func validateUsername(username string) error {
 		return fmt.Errorf("username '%s' conflicts with an existing group", username)
 	}
 
+	// Check if it conflicts with existing group aliases
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM group_aliases WHERE alias = $1)", username).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check existing aliases: %v", err)
+	}
+	if exists {
+		return fmt.Errorf("username '%s' conflicts with an existing group alias", username)
+	}
+
 	return nil
 }
 
 // Zedtoken management functions
 
-// Store zedtoken for a group after SpiceDB mutations
-func storeGroupZedtoken(groupUsername, zedtoken string) error {
-	_, err := db.Exec(`
+// Store zedtoken for a group after SpiceDB mutations, returning its new
+// zedtoken_seq. Callers must hold the group's write lock so tokens are stored
+// in the order SpiceDB issued them.
+func storeGroupZedtoken(tx *sql.Tx, groupUsername, zedtoken string) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(`
 		UPDATE groups 
-		SET zedtoken = $1, updated_at = CURRENT_TIMESTAMP 
+		SET zedtoken = $1, zedtoken_seq = zedtoken_seq + 1, updated_at = CURRENT_TIMESTAMP 
 		WHERE username = $2
-	`, zedtoken, groupUsername)
+		RETURNING zedtoken_seq
+	`, zedtoken, groupUsername).Scan(&seq)
+	if err == sql.ErrNoRows {
+		// The group has been deleted; there is nothing left to read
+		return 0, nil
+	}
 	if err != nil {
 		log.Printf("Failed to store zedtoken for group %s: %v", groupUsername, err)
-		return err
+		return 0, err
 	}
-	log.Printf("Stored zedtoken for group %s: %s", groupUsername, zedtoken)
-	return nil
+
+	// Let other replicas refresh their cached token once this commits
+	notification := zedtokenNotification{Group: groupUsername, Token: zedtoken, Seq: seq}
+	if err := notifyZedtoken(tx, notification); err != nil {
+		log.Printf("Failed to publish zedtoken for group %s: %v", groupUsername, err)
+		return 0, err
+	}
+
+	log.Printf("Stored zedtoken for group %s: %s (seq %d)", groupUsername, zedtoken, seq)
+	return seq, nil
+}
+
+// Run a SpiceDB write against a group and store the zedtoken it returns.
+//
+// Writes that finish out of order would otherwise let an older token replace a
+// newer one, so writes to the same group are serialized with a transaction-scoped
+// advisory lock held from before the SpiceDB call until the token is stored.
+// Each write then sees every earlier one, its token is newer than theirs, and the
+// stored token and zedtoken_seq only ever move forward.
+func writeGroupRelationships(groupUsername string, write func() (string, error)) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", "group-write:"+groupUsername); err != nil {
+		log.Printf("Failed to lock group %s for writing: %v", groupUsername, err)
+		return "", err
+	}
+
+	zedtoken, err := write()
+	if err != nil {
+		return "", err
+	}
+
+	// Store the zedtoken for future consistency
+	seq, err := storeGroupZedtoken(tx, groupUsername, zedtoken)
+	if err != nil {
+		log.Printf("Warning: Failed to store zedtoken for group %s: %v", groupUsername, err)
+		// Don't fail the operation if zedtoken storage fails
+		return zedtoken, nil
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Warning: Failed to store zedtoken for group %s: %v", groupUsername, err)
+		return zedtoken, nil
+	}
+	if seq > 0 {
+		zedtokens.set(groupUsername, zedtoken, seq)
+	}
+
+	return zedtoken, nil
 }
 
 // Get consistency requirement for a group based on stored zedtoken
 func getConsistencyForGroup(groupUsername string) *v1.Consistency {
 	var zedtoken sql.NullString
-	err := db.QueryRow(`
-		SELECT zedtoken 
-		FROM groups 
-		WHERE username = $1
-	`, groupUsername).Scan(&zedtoken)
-	if err != nil {
-		log.Printf("Failed to get zedtoken for group %s, using immediate consistency: %v", groupUsername, err)
-		return &v1.Consistency{
-			Requirement: &v1.Consistency_FullyConsistent{
-				FullyConsistent: true,
-			},
+	if cached, ok := zedtokens.get(groupUsername); ok {
+		zedtoken = sql.NullString{String: cached.token, Valid: cached.token != ""}
+	} else {
+		var seq int64
+		err := db.QueryRow(`
+			SELECT zedtoken, zedtoken_seq 
+			FROM groups 
+			WHERE username = $1
+		`, groupUsername).Scan(&zedtoken, &seq)
+		if err != nil {
+			log.Printf("Failed to get zedtoken for group %s, using immediate consistency: %v", groupUsername, err)
+			return &v1.Consistency{
+				Requirement: &v1.Consistency_FullyConsistent{
+					FullyConsistent: true,
+				},
+			}
 		}
+		zedtokens.set(groupUsername, zedtoken.String, seq)
 	}
 
 	if zedtoken.Valid {
@@ -577,14 +817,14 @@ func getConsistencyForGroup(groupUsername string) *v1.Consistency {
 // SpiceDB query functions to read relationships
 
 // Get all members of a group from SpiceDB
-func getGroupMembersFromSpiceDB(groupUsername string) ([]map[string]string, error) {
+func getGroupMembersFromSpiceDB(groupUsername string, consistency *v1.Consistency) ([]map[string]string, error) {
 	// Query SpiceDB for subjects that have any relation to the group
 	request := &v1.ReadRelationshipsRequest{
 		RelationshipFilter: &v1.RelationshipFilter{
 			ResourceType:       "group",
 			OptionalResourceId: groupUsername,
 		},
-		Consistency: getConsistencyForGroup(groupUsername),
+		Consistency: consistency,
 	}
 
 	log.Printf("[SPICEDB] operation=ReadRelationships resource_type=group resource_id=%s", groupUsername)
@@ -607,17 +847,26 @@ func getGroupMembersFromSpiceDB(groupUsername string) ([]map[string]string, erro
 		}
 
 		rel := response.Relationship
-		if rel.Subject.Object.ObjectType == "user" {
+		subjectType := rel.Subject.Object.ObjectType
+		if subjectType == "user" || subjectType == "service_account" {
 			// Map SpiceDB relations to roles
 			role := "MEMBER"
 			if rel.Relation == "admin" {
 				role = "OWNER" // In our schema, admin includes both OWNER and MANAGER
 			}
 
-			members = append(members, map[string]string{
+			member := map[string]string{
 				"username": rel.Subject.Object.ObjectId,
 				"role":     role,
-			})
+				"type":     subjectType,
+			}
+			if expiresAt, ok := relationshipExpiry(rel); ok {
+				if !expiresAt.After(time.Now()) {
+					continue // lapsed, waiting for the expiry job to remove it
+				}
+				member["expires_at"] = expiresAt.Local().Format("2006-01-02 15:04:05")
+			}
+			members = append(members, member)
 		}
 	}
 
@@ -625,15 +874,70 @@ func getGroupMembersFromSpiceDB(groupUsername string) ([]map[string]string, erro
 	return members, nil
 }
 
+// Get a subject's current role in a group from SpiceDB, or "" if it has none
+func getSubjectRole(groupUsername string, subjectType string, subjectID string) (string, error) {
+	return readSubjectRole(groupUsername, subjectType, subjectID, false)
+}
+
+// Get a subject's role in a group including relationships that have lapsed but
+// not been removed yet, for changes such as extending an expiry that can bring
+// them back
+func getSubjectRoleIncludingLapsed(groupUsername string, subjectType string, subjectID string) (string, error) {
+	return readSubjectRole(groupUsername, subjectType, subjectID, true)
+}
+
+func readSubjectRole(groupUsername string, subjectType string, subjectID string, includeLapsed bool) (string, error) {
+	request := &v1.ReadRelationshipsRequest{
+		RelationshipFilter: &v1.RelationshipFilter{
+			ResourceType:       "group",
+			OptionalResourceId: groupUsername,
+			OptionalSubjectFilter: &v1.SubjectFilter{
+				SubjectType:       subjectType,
+				OptionalSubjectId: subjectID,
+			},
+		},
+		Consistency: getConsistencyForGroup(groupUsername),
+	}
+
+	log.Printf("[SPICEDB] operation=ReadRelationships resource_type=group resource_id=%s subject_type=%s subject_id=%s",
+		groupUsername, subjectType, subjectID)
+
+	stream, err := spicedbClient.ReadRelationships(context.Background(), request)
+	if err != nil {
+		log.Printf("[SPICEDB] operation=ReadRelationships status=ERROR error=%v", err)
+		return "", err
+	}
+
+	role := ""
+	for {
+		response, err := stream.Recv()
+		if err != nil {
+			if err.Error() == "EOF" {
+				break
+			}
+			log.Printf("[SPICEDB] operation=ReadRelationships status=ERROR error=%v", err)
+			return "", err
+		}
+		if expiresAt, ok := relationshipExpiry(response.Relationship); ok && !includeLapsed && !expiresAt.After(time.Now()) {
+			continue // lapsed, waiting for the expiry job to remove it
+		}
+		if role != "OWNER" {
+			role = relationRole(response.Relationship.Relation)
+		}
+	}
+
+	return role, nil
+}
+
 // Get owners of a group from SpiceDB
-func getGroupOwnersFromSpiceDB(groupUsername string) ([]string, error) {
+func getGroupOwnersFromSpiceDB(groupUsername string, consistency *v1.Consistency) ([]string, error) {
 	request := &v1.ReadRelationshipsRequest{
 		RelationshipFilter: &v1.RelationshipFilter{
 			ResourceType:       "group",
 			OptionalResourceId: groupUsername,
 			OptionalRelation:   "admin", // Only get admin relationships (which include owners)
 		},
-		Consistency: getConsistencyForGroup(groupUsername),
+		Consistency: consistency,
 	}
 
 	log.Printf("[SPICEDB] operation=ReadRelationships resource_type=group resource_id=%s relation=admin", groupUsername)
@@ -656,6 +960,9 @@ func getGroupOwnersFromSpiceDB(groupUsername string) ([]string, error) {
 		}
 
 		rel := response.Relationship
+		if expiresAt, ok := relationshipExpiry(rel); ok && !expiresAt.After(time.Now()) {
+			continue // lapsed, waiting for the expiry job to remove it
+		}
 		if rel.Subject.Object.ObjectType == "user" {
 			owners = append(owners, rel.Subject.Object.ObjectId)
 		}
@@ -706,7 +1013,7 @@ func getPublicGroups(c *gin.Context) {
 			return
 		}
 		group.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
-		group.Email = fmt.Sprintf("%s@company.com", group.Username)
+		group.Email = emailAddress(group.Username)
 
 		groups = append(groups, group)
 	}
@@ -726,20 +1033,28 @@ func createGroup(c *gin.Context) {
 		req.Visibility = "PUBLIC"
 	}
 
-	// Validate username doesn't conflict with users or existing groups
-	if err := validateUsername(req.Username); err != nil {
-		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
-		return
-	}
-
 	// Validate that the owner is a valid system user
 	if !isSystemUser(req.OwnerUsername) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Owner username '%s' is not a valid system user", req.OwnerUsername)})
 		return
 	}
 
-	// Insert the group
-	_, err := db.Exec(`
+	// Insert the group and queue its owner for SpiceDB in one transaction, so
+	// a group can't exist without an owner on the way
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Validate username doesn't conflict with users, existing groups or aliases
+	if err := validateUsername(tx, req.Username); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = tx.Exec(`
 		INSERT INTO groups (username, name, description, visibility) 
 		VALUES ($1, $2, $3, $4)
 	`, req.Username, req.Name, req.Description, req.Visibility)
@@ -750,22 +1065,68 @@ func createGroup(c *gin.Context) {
 	}
 
 	// Add creator as owner in SpiceDB (SpiceDB is the sole source of truth)
-	err = addSpiceDBRelationship(req.Username, req.OwnerUsername, "OWNER")
+	outboxID, err := enqueueOutboxEntry(tx, outboxEntry{
+		groupUsername: req.Username,
+		operation:     "TOUCH",
+		relation:      "admin",
+		subjectType:   "user",
+		subjectID:     req.OwnerUsername,
+	})
+	if err != nil {
+		log.Printf("Failed to queue SpiceDB owner for group %s: %v", req.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+
+	// The row may reach Postgres before or after the watcher sees the write;
+	// either way it keeps the creator
+	err = upsertMembershipMetadata(tx, req.Username, "user", req.OwnerUsername, "admin", currentPrincipal(c).Actor(), nil, sql.NullTime{})
+	if err != nil {
+		log.Printf("Failed to record owner metadata for group %s: %v", req.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+
+	err = recordGroupEvent(tx, &GroupEvent{
+		Type:          "group.created",
+		GroupUsername: req.Username,
+		Actor:         currentPrincipal(c).Actor(),
+		Data:          eventData(gin.H{"name": req.Name, "visibility": req.Visibility, "owner": req.OwnerUsername}),
+	})
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "group.created",
+			GroupUsername: req.Username,
+			Subject:       req.OwnerUsername,
+			After:         gin.H{"name": req.Name, "description": req.Description, "visibility": req.Visibility, "owner": req.OwnerUsername},
+			OutboxID:      outboxID,
+		})
+	}
 	if err != nil {
-		log.Printf("Failed to add SpiceDB relationship for group %s: %v", req.Username, err)
-		// Don't fail the request if SpiceDB fails, but log it
+		log.Printf("Failed to record creation of group %s: %v", req.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to create group: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+
+	syncStatus, zedtoken := applyOutboxEntryNow(outboxID)
+	setZedtokenHeader(c, zedtoken)
+
 	// Fetch the created group
 	var group Group
 	var createdAt time.Time
-	var zedtoken sql.NullString
+	var storedZedtoken sql.NullString
 	err = db.QueryRow(`
 		SELECT username, name, description, visibility, zedtoken, created_at 
 		FROM groups WHERE username = $1
 	`, req.Username).Scan(
 		&group.Username, &group.Name, &group.Description,
-		&group.Visibility, &zedtoken, &createdAt,
+		&group.Visibility, &storedZedtoken, &createdAt,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch created group"})
@@ -773,15 +1134,19 @@ func createGroup(c *gin.Context) {
 	}
 
 	group.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
-	group.Email = fmt.Sprintf("%s@company.com", group.Username)
-	if zedtoken.Valid {
-		group.Zedtoken = zedtoken.String
+	group.Email = emailAddress(group.Username)
+	if storedZedtoken.Valid {
+		group.Zedtoken = storedZedtoken.String
 	}
 
+	group.SyncStatus = syncStatus
+
 	// Fetch owners for the created group from SpiceDB
-	owners, err := getGroupOwnersFromSpiceDB(req.Username)
-	if err != nil {
-		log.Printf("Failed to fetch owners for created group %s: %v", req.Username, err)
+	owners, err := getGroupOwnersFromSpiceDB(req.Username, getConsistencyForGroup(req.Username))
+	if err != nil || syncStatus != "APPLIED" {
+		if err != nil {
+			log.Printf("Failed to fetch owners for created group %s: %v", req.Username, err)
+		}
 		group.Owners = []string{req.OwnerUsername} // fallback to creator
 	} else {
 		group.Owners = owners
@@ -791,33 +1156,67 @@ func createGroup(c *gin.Context) {
 }
 
 func getGroupMembers(c *gin.Context) {
+	if c.Query("as_of") != "" {
+		getGroupMembersAsOf(c)
+		return
+	}
+
 	groupUsername := c.Param("username")
 
 	// Check permission to view members
-	username := c.GetHeader("X-Username")
-	if username == "" || !checkPermission(username, groupUsername, "view_members") {
+	if !checkPrincipalPermission(c, groupUsername, "view_members") {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
 		return
 	}
 
 	// Fetch members from SpiceDB
-	memberData, err := getGroupMembersFromSpiceDB(groupUsername)
+	memberData, err := getGroupMembersFromSpiceDB(groupUsername, getRequestConsistency(c, groupUsername))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group members"})
 		return
 	}
 
+	// Merge in what Postgres knows about each membership. It is only
+	// informational, so the members are still returned without it.
+	metadata, err := getMembershipMetadata(groupUsername)
+	if err != nil {
+		log.Printf("Failed to fetch membership metadata for group %s: %v", groupUsername, err)
+	}
+	showNotes := false
+	for _, m := range metadata {
+		if m.Note != "" {
+			showNotes = checkPrincipalPermission(c, groupUsername, "add_member")
+			break
+		}
+	}
+
 	type Member struct {
-		Username string `json:"username"`
-		Role     string `json:"role"`
+		Username  string `json:"username"`
+		Role      string `json:"role"`
+		Type      string `json:"type"`
+		ExpiresAt string `json:"expires_at,omitempty"`
+		JoinedAt  string `json:"joined_at,omitempty"`
+		AddedBy   string `json:"added_by,omitempty"`
+		Note      string `json:"note,omitempty"`
 	}
 
 	var members []Member
 	for _, memberInfo := range memberData {
-		members = append(members, Member{
-			Username: memberInfo["username"],
-			Role:     memberInfo["role"],
-		})
+		member := Member{
+			Username:  memberInfo["username"],
+			Role:      memberInfo["role"],
+			Type:      memberInfo["type"],
+			ExpiresAt: memberInfo["expires_at"],
+		}
+		relation, _ := roleRelation(member.Role)
+		if m, ok := metadata[membershipKey(member.Type, member.Username, relation)]; ok {
+			member.JoinedAt = m.JoinedAt.Format("2006-01-02 15:04:05")
+			member.AddedBy = m.AddedBy
+			if showNotes {
+				member.Note = m.Note
+			}
+		}
+		members = append(members, member)
 	}
 
 	c.JSON(http.StatusOK, members)
@@ -827,15 +1226,17 @@ func addGroupMember(c *gin.Context) {
 	groupUsername := c.Param("username")
 
 	// Check permission to add members
-	username := c.GetHeader("X-Username")
-	if username == "" || !checkPermission(username, groupUsername, "add_member") {
+	if !checkPrincipalPermission(c, groupUsername, "add_member") {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
 		return
 	}
 
 	type AddMemberRequest struct {
-		Username string `json:"username" binding:"required"`
-		Role     string `json:"role" binding:"required"`
+		Username  string  `json:"username" binding:"required"`
+		Role      string  `json:"role" binding:"required"`
+		Type      string  `json:"type"`
+		Note      *string `json:"note"`
+		ExpiresAt string  `json:"expires_at"`
 	}
 
 	var req AddMemberRequest
@@ -850,9 +1251,41 @@ func addGroupMember(c *gin.Context) {
 		return
 	}
 
-	// Validate that the user being added is a valid system user
-	if !isSystemUser(req.Username) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Username '%s' is not a valid system user", req.Username)})
+	// Memberships can be time-bounded; access lapses by itself at expires_at
+	var expiresAt sql.NullTime
+	if req.ExpiresAt != "" {
+		if req.Role != "MEMBER" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only MEMBER memberships can expire"})
+			return
+		}
+		t, err := parseExpiry(req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		expiresAt = sql.NullTime{Time: t, Valid: true}
+	}
+
+	// Validate that the subject being added is a valid system user or service account
+	switch req.Type {
+	case "", "user":
+		req.Type = "user"
+		if !isSystemUser(req.Username) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Username '%s' is not a valid system user", req.Username)})
+			return
+		}
+	case "service_account":
+		exists, err := serviceAccountExists(req.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check service account existence"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Service account '%s' does not exist", req.Username)})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type. Must be user or service_account"})
 		return
 	}
 
@@ -869,64 +1302,184 @@ func addGroupMember(c *gin.Context) {
 		return
 	}
 
-	// Add member to group in SpiceDB (SpiceDB is the sole source of truth)
-	err = addSpiceDBRelationship(groupUsername, req.Username, req.Role)
+	// Capture the subject's role before the change for the audit log
+	previousRole, err := getSubjectRole(groupUsername, req.Type, req.Username)
+	if err != nil {
+		log.Printf("Failed to read current role of %s %s in group %s: %v", req.Type, req.Username, groupUsername, err)
+	}
+
+	// Record the membership, queue the SpiceDB write (SpiceDB is the sole source
+	// of truth) and audit the change in one transaction
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Failed to add SpiceDB relationship for user %s in group %s: %v", req.Username, groupUsername, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member to group"})
 		return
 	}
+	defer tx.Rollback()
 
-	c.JSON(http.StatusOK, gin.H{"message": "Member added successfully"})
+	relation, _ := roleRelation(req.Role)
+	err = upsertMembershipMetadata(tx, groupUsername, req.Type, req.Username, relation, currentPrincipal(c).Actor(), req.Note, expiresAt)
+	if err != nil {
+		log.Printf("Failed to record membership metadata for %s %s in group %s: %v", req.Type, req.Username, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member to group"})
+		return
+	}
+
+	outboxID, err := enqueueOutboxEntry(tx, outboxEntry{
+		groupUsername: groupUsername,
+		operation:     "TOUCH",
+		relation:      relation,
+		subjectType:   req.Type,
+		subjectID:     req.Username,
+		expiresAt:     expiresAt,
+	})
+	if err != nil {
+		log.Printf("Failed to queue SpiceDB relationship for %s %s in group %s: %v", req.Type, req.Username, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member to group"})
+		return
+	}
+
+	after := gin.H{"type": req.Type, "role": req.Role}
+	if expiresAt.Valid {
+		after["expires_at"] = formatExpiry(expiresAt)
+	}
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:        "member.added",
+		GroupUsername: groupUsername,
+		Subject:       req.Username,
+		Before:        auditRole(req.Type, previousRole),
+		After:         after,
+		OutboxID:      outboxID,
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to add %s %s to group %s: %v", req.Type, req.Username, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member to group"})
+		return
+	}
+
+	syncStatus, zedtoken := applyOutboxEntryNow(outboxID)
+	setZedtokenHeader(c, zedtoken)
+	c.JSON(http.StatusOK, gin.H{"message": "Member added successfully", "sync_status": syncStatus})
 }
 
 func removeGroupMember(c *gin.Context) {
 	groupUsername := c.Param("username")
 	memberUsername := c.Param("memberusername")
+	memberType := c.DefaultQuery("type", "user")
 
 	// Check permission to add members (same permission for removing)
-	requesterUsername := c.GetHeader("X-Username")
-	if requesterUsername == "" || !checkPermission(requesterUsername, groupUsername, "add_member") {
+	if !checkPrincipalPermission(c, groupUsername, "add_member") {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
 		return
 	}
 
-	// Remove member from group in SpiceDB (SpiceDB is the sole source of truth)
-	err := removeSpiceDBRelationship(groupUsername, memberUsername)
+	if memberType != "user" && memberType != "service_account" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type. Must be user or service_account"})
+		return
+	}
+
+	// Capture the subject's role before the change for the audit log
+	previousRole, err := getSubjectRole(groupUsername, memberType, memberUsername)
+	if err != nil {
+		log.Printf("Failed to read current role of %s %s in group %s: %v", memberType, memberUsername, groupUsername, err)
+	}
+
+	// Drop the membership, queue the removal of both roles from SpiceDB (SpiceDB
+	// is the sole source of truth) and audit the change in one transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member from group"})
+		return
+	}
+	defer tx.Rollback()
+
+	err = deleteMembershipMetadata(tx, groupUsername, memberType, memberUsername)
 	if err != nil {
-		log.Printf("Failed to remove SpiceDB relationship for user %s in group %s: %v", memberUsername, groupUsername, err)
+		log.Printf("Failed to delete membership metadata for %s %s in group %s: %v", memberType, memberUsername, groupUsername, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member from group"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+	// A group's entries are applied in order, so the removal is complete once
+	// the last one is; that is the one the audit event points at
+	var outboxIDs []int64
+	for _, relation := range []string{"admin", "member"} {
+		outboxID, err := enqueueOutboxEntry(tx, outboxEntry{
+			groupUsername: groupUsername,
+			operation:     "DELETE",
+			relation:      relation,
+			subjectType:   memberType,
+			subjectID:     memberUsername,
+		})
+		if err != nil {
+			log.Printf("Failed to queue SpiceDB removal for %s %s in group %s: %v", memberType, memberUsername, groupUsername, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member from group"})
+			return
+		}
+		outboxIDs = append(outboxIDs, outboxID)
+	}
+
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:        "member.removed",
+		GroupUsername: groupUsername,
+		Subject:       memberUsername,
+		Before:        auditRole(memberType, previousRole),
+		OutboxID:      outboxIDs[len(outboxIDs)-1],
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to remove %s %s from group %s: %v", memberType, memberUsername, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member from group"})
+		return
+	}
+
+	var syncStatus, zedtoken string
+	for _, outboxID := range outboxIDs {
+		if syncStatus, zedtoken = applyOutboxEntryNow(outboxID); syncStatus != "APPLIED" {
+			break
+		}
+	}
+	setZedtokenHeader(c, zedtoken)
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully", "sync_status": syncStatus})
 }
 
 func deleteGroup(c *gin.Context) {
 	groupUsername := c.Param("username")
 
 	// Check permission to delete group
-	username := c.GetHeader("X-Username")
-	if username == "" || !checkPermission(username, groupUsername, "delete") {
+	if !checkPrincipalPermission(c, groupUsername, "delete") {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
 		return
 	}
 
-	// Check if group exists
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM groups WHERE username = $1)", groupUsername).Scan(&exists)
+	// Check if group exists, keeping its settings for the audit log
+	var name, description, visibility string
+	err := db.QueryRow("SELECT name, COALESCE(description, ''), visibility FROM groups WHERE username = $1", groupUsername).
+		Scan(&name, &description, &visibility)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check group existence"})
 		return
 	}
 
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+	// Delete the group (CASCADE will handle memberships and messages) and
+	// queue the SpiceDB cleanup in the same transaction
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
 		return
 	}
+	defer tx.Rollback()
 
-	// Delete the group (CASCADE will handle memberships and messages)
-	_, err = db.Exec("DELETE FROM groups WHERE username = $1", groupUsername)
+	_, err = tx.Exec("DELETE FROM groups WHERE username = $1", groupUsername)
 	if err != nil {
 		log.Printf("Failed to delete group %s: %v", groupUsername, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
@@ -934,30 +1487,85 @@ func deleteGroup(c *gin.Context) {
 	}
 
 	// Clean up SpiceDB relationships
-	err = deleteSpiceDBGroup(groupUsername)
+	outboxID, err := enqueueOutboxEntry(tx, outboxEntry{groupUsername: groupUsername, operation: "DELETE_GROUP"})
+	if err != nil {
+		log.Printf("Failed to queue SpiceDB cleanup for group %s: %v", groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
+		return
+	}
+
+	deleted := &GroupEvent{
+		Type:          "group.deleted",
+		GroupUsername: groupUsername,
+		Actor:         currentPrincipal(c).Actor(),
+	}
+	err = recordGroupEvent(tx, deleted)
+	if err == nil {
+		err = retireGroupWebhooks(tx, groupUsername, deleted.ID)
+	}
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "group.deleted",
+			GroupUsername: groupUsername,
+			Before:        gin.H{"name": name, "description": description, "visibility": visibility},
+			OutboxID:      outboxID,
+		})
+	}
 	if err != nil {
-		log.Printf("Failed to clean up SpiceDB relationships for group %s: %v", groupUsername, err)
+		log.Printf("Failed to record deletion of group %s: %v", groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to delete group %s: %v", groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
+		return
 	}
+	evictGroupZedtoken(groupUsername)
 
-	log.Printf("Group %s deleted successfully", groupUsername)
-	c.JSON(http.StatusOK, gin.H{"message": "Group deleted successfully"})
+	syncStatus, zedtoken := applyOutboxEntryNow(outboxID)
+	setZedtokenHeader(c, zedtoken)
+
+	log.Printf("Group %s deleted successfully (SpiceDB cleanup %s)", groupUsername, syncStatus)
+	c.JSON(http.StatusOK, gin.H{"message": "Group deleted successfully", "sync_status": syncStatus})
 }
 
 func main() {
+	initConfig()
+	initAuth()
 	initDB()
 	defer db.Close()
 	initSpiceDB()
+	startOutboxWorker()
+	startReconcileJob()
+	startExpiryJob()
+	startMembershipScheduler()
+	startGroupWatcher()
+	startWebhookWorker()
+	startSMTPServer()
+	startFanoutWorker()
+	startDeliveryWorker()
+	startDigestScheduler()
+	startRetentionJob()
 
 	// Disable Gin's default logger and use our custom one
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
+	r.Use(requestIDMiddleware())
 	r.Use(logMiddleware())
 	r.Use(corsMiddleware())
+	r.Use(authMiddleware())
+	r.Use(impersonationMiddleware())
+	r.Use(consistencyMiddleware())
 
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "healthy", "service": "groups"})
 	})
 
+	// Runtime and cache metrics, for platform admins only
+	r.GET("/debug/vars", getDebugVars)
+
 	// Public API endpoints
 	r.GET("/api/users", getUsers)
 	r.GET("/api/groups", getPublicGroups)
@@ -968,6 +1576,58 @@ func main() {
 	r.GET("/groups/:username/members", getGroupMembers)
 	r.POST("/groups/:username/members", addGroupMember)
 	r.DELETE("/groups/:username/members/:memberusername", removeGroupMember)
+	r.PATCH("/groups/:username/members/:memberusername", updateMember)
+	r.GET("/groups/:username/scheduled-changes", getScheduledChanges)
+	r.POST("/groups/:username/scheduled-changes", scheduleMembershipChange)
+	r.DELETE("/groups/:username/scheduled-changes/:id", cancelScheduledChange)
+	r.GET("/groups/:username/elevations", getElevationRequests)
+	r.POST("/groups/:username/elevations", requestElevation)
+	r.POST("/groups/:username/elevations/:id/approve", approveElevation)
+	r.POST("/groups/:username/elevations/:id/deny", denyElevation)
+	r.DELETE("/groups/:username/elevations/:id", endElevation)
+
+	r.GET("/groups/:username/aliases", getGroupAliases)
+	r.POST("/groups/:username/aliases", addGroupAlias)
+	r.DELETE("/groups/:username/aliases/:alias", removeGroupAlias)
+
+	r.GET("/groups/:username/delivery-preference", getDeliveryPreference)
+	r.PUT("/groups/:username/delivery-preference", updateDeliveryPreference)
+	r.GET("/groups/:username/messages/:id/deliveries", getMessageDeliveries)
+	r.GET("/groups/:username/messages/export", exportGroupMessages)
+	r.GET("/groups/:username/explain", explainGroupPermission)
+	r.GET("/groups/:username/events", getGroupEvents)
+	r.GET("/groups/:username/webhooks", getWebhooks)
+	r.POST("/groups/:username/webhooks", createWebhook)
+	r.DELETE("/groups/:username/webhooks/:id", deleteWebhook)
+	r.GET("/groups/:username/webhooks/:id/deliveries", getWebhookDeliveries)
+	r.POST("/groups/:username/webhooks/:id/deliveries/:deliveryId/redeliver", redeliverWebhook)
+	r.GET("/me/events", getMyEvents)
+	r.GET("/groups/:username/retention", getGroupRetention)
+	r.PUT("/groups/:username/retention", updateGroupRetention)
+
+	// Service accounts and API keys
+	r.GET("/service-accounts", getServiceAccounts)
+	r.POST("/service-accounts", createServiceAccount)
+	r.GET("/service-accounts/:name/keys", getAPIKeys)
+	r.POST("/service-accounts/:name/keys", createAPIKey)
+	r.DELETE("/service-accounts/:name/keys/:id", revokeAPIKey)
+
+	// Webhooks for every group
+	r.GET("/webhooks", getWebhooks)
+	r.POST("/webhooks", createWebhook)
+	r.DELETE("/webhooks/:id", deleteWebhook)
+	r.GET("/webhooks/:id/deliveries", getWebhookDeliveries)
+	r.POST("/webhooks/:id/deliveries/:deliveryId/redeliver", redeliverWebhook)
+
+	// Platform administration
+	r.GET("/admin/reconcile", getDriftReport)
+	r.POST("/admin/reconcile", reconcileDrift)
+
+	// Audit log
+	r.GET("/audit", getAuditEvents)
+
+	// Mail delivery endpoints
+	r.POST("/resolve-recipients", resolveRecipientsHandler)
 
 	log.Println("Groups service starting on port 3001")
 	r.Run(":3001")
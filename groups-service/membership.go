@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+)
+
+// What Postgres knows about a group relationship that SpiceDB can't hold
+type MembershipMetadata struct {
+	SubjectType string
+	SubjectID   string
+	Relation    string
+	AddedBy     string
+	Note        string
+	JoinedAt    time.Time
+}
+
+// Map an API role to the SpiceDB group relation that grants it
+func roleRelation(role string) (string, bool) {
+	switch role {
+	case "OWNER", "MANAGER":
+		return "admin", true
+	case "MEMBER":
+		return "member", true
+	}
+	return "", false
+}
+
+// Record who added a subject to a group and when the membership expires. A
+// row the watcher already created for the same relationship keeps its
+// joined_at, and a nil note leaves any existing note alone.
+func upsertMembershipMetadata(exec execer, groupUsername, subjectType, subjectID, relation, addedBy string, note *string, expiresAt sql.NullTime) error {
+	_, err := exec.Exec(`
+		INSERT INTO membership_metadata (group_username, subject_type, subject_id, relation, added_by, note, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (group_username, subject_type, subject_id, relation)
+		DO UPDATE SET added_by = EXCLUDED.added_by,
+		              note = COALESCE(EXCLUDED.note, membership_metadata.note),
+		              expires_at = EXCLUDED.expires_at,
+		              expiry_notified_at = NULL,
+		              updated_at = CURRENT_TIMESTAMP
+	`, groupUsername, subjectType, subjectID, relation, nullString(addedBy), note, expiresAt)
+	return err
+}
+
+// Forget every relation a subject had in a group
+func deleteMembershipMetadata(exec execer, groupUsername, subjectType, subjectID string) error {
+	_, err := exec.Exec(`
+		DELETE FROM membership_metadata
+		WHERE group_username = $1 AND subject_type = $2 AND subject_id = $3
+	`, groupUsername, subjectType, subjectID)
+	return err
+}
+
+// Load the metadata for a group's relationships, keyed by subject and relation
+func getMembershipMetadata(groupUsername string) (map[string]MembershipMetadata, error) {
+	rows, err := db.Query(`
+		SELECT subject_type, subject_id, relation, COALESCE(added_by, ''), COALESCE(note, ''), joined_at
+		FROM membership_metadata
+		WHERE group_username = $1
+	`, groupUsername)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make(map[string]MembershipMetadata)
+	for rows.Next() {
+		var m MembershipMetadata
+		if err := rows.Scan(&m.SubjectType, &m.SubjectID, &m.Relation, &m.AddedBy, &m.Note, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		metadata[membershipKey(m.SubjectType, m.SubjectID, m.Relation)] = m
+	}
+	return metadata, rows.Err()
+}
+
+func membershipKey(subjectType, subjectID, relation string) string {
+	return subjectType + ":" + subjectID + "#" + relation
+}
+
+// Keep membership_metadata in step with relationship changes seen through the
+// Watch API, including ones made outside this service. Rows written by the
+// handlers keep who added them, but always take their expiry from SpiceDB;
+// relationships on groups Postgres doesn't know about are skipped.
+func applyMembershipMetadataUpdates(tx *sql.Tx, updates []*v1.RelationshipUpdate) error {
+	for _, update := range updates {
+		rel := update.Relationship
+		if update.Operation == v1.RelationshipUpdate_OPERATION_DELETE {
+			_, err := tx.Exec(`
+				DELETE FROM membership_metadata
+				WHERE group_username = $1 AND subject_type = $2 AND subject_id = $3 AND relation = $4
+			`, rel.Resource.ObjectId, rel.Subject.Object.ObjectType, rel.Subject.Object.ObjectId, rel.Relation)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var expiresAt sql.NullTime
+		if t, ok := relationshipExpiry(rel); ok {
+			expiresAt = sql.NullTime{Time: t, Valid: true}
+		}
+
+		_, err := tx.Exec(`
+			INSERT INTO membership_metadata (group_username, subject_type, subject_id, relation, expires_at)
+			SELECT $1, $2, $3, $4, $5
+			WHERE EXISTS (SELECT 1 FROM groups WHERE username = $1)
+			ON CONFLICT (group_username, subject_type, subject_id, relation) DO UPDATE
+			SET expires_at = EXCLUDED.expires_at,
+			    expiry_notified_at = CASE
+			        WHEN membership_metadata.expires_at IS DISTINCT FROM EXCLUDED.expires_at THEN NULL
+			        ELSE membership_metadata.expiry_notified_at
+			    END
+		`, rel.Resource.ObjectId, rel.Subject.Object.ObjectType, rel.Subject.Object.ObjectId, rel.Relation, expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Change a member's admin note or expiry. Extending a membership rewrites its
+// SpiceDB relationship with the new expiry; an empty expires_at makes it
+// permanent.
+func updateMember(c *gin.Context) {
+	groupUsername := c.Param("username")
+	memberUsername := c.Param("memberusername")
+	memberType := c.DefaultQuery("type", "user")
+
+	// Notes and expiry are for admins, so they need the same permission as adding members
+	if !checkPrincipalPermission(c, groupUsername, "add_member") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	type UpdateMemberRequest struct {
+		Note      *string `json:"note"`
+		ExpiresAt *string `json:"expires_at"`
+	}
+
+	var req UpdateMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Note == nil && req.ExpiresAt == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update. Set note or expires_at"})
+		return
+	}
+
+	var expiresAt sql.NullTime
+	if req.ExpiresAt != nil && *req.ExpiresAt != "" {
+		t, err := parseExpiry(*req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		expiresAt = sql.NullTime{Time: t, Valid: true}
+	}
+
+	response := gin.H{"username": memberUsername, "type": memberType}
+
+	if req.ExpiresAt != nil {
+		// A membership that has just lapsed can still be extended, until the
+		// expiry job removes it
+		role, err := getSubjectRoleIncludingLapsed(groupUsername, memberType, memberUsername)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch member"})
+			return
+		}
+		if role == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+		if role != "MEMBER" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only MEMBER memberships can expire"})
+			return
+		}
+
+		syncStatus, zedtoken, err := updateMembershipExpiry(c, groupUsername, memberType, memberUsername, expiresAt)
+		if err != nil {
+			log.Printf("Failed to update expiry of %s %s in group %s: %v", memberType, memberUsername, groupUsername, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member expiry"})
+			return
+		}
+		setZedtokenHeader(c, zedtoken)
+
+		response["expires_at"] = formatExpiry(expiresAt)
+		response["sync_status"] = syncStatus
+	}
+
+	if req.Note != nil {
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member note"})
+			return
+		}
+		defer tx.Rollback()
+
+		var before string
+		err = tx.QueryRow(`
+			SELECT COALESCE(MAX(note), '') FROM membership_metadata
+			WHERE group_username = $1 AND subject_type = $2 AND subject_id = $3
+		`, groupUsername, memberType, memberUsername).Scan(&before)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch member note"})
+			return
+		}
+
+		// An empty note clears it
+		result, err := tx.Exec(`
+			UPDATE membership_metadata SET note = $4, updated_at = CURRENT_TIMESTAMP
+			WHERE group_username = $1 AND subject_type = $2 AND subject_id = $3
+		`, groupUsername, memberType, memberUsername, nullString(*req.Note))
+		if err != nil {
+			log.Printf("Failed to update note for %s %s in group %s: %v", memberType, memberUsername, groupUsername, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member note"})
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "member.note_updated",
+			GroupUsername: groupUsername,
+			Subject:       memberUsername,
+			Before:        gin.H{"note": before},
+			After:         gin.H{"note": *req.Note},
+		})
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Failed to update note for %s %s in group %s: %v", memberType, memberUsername, groupUsername, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member note"})
+			return
+		}
+
+		response["note"] = *req.Note
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Set a member's expiry in Postgres, queue the SpiceDB rewrite and audit the
+// change in one transaction, then apply it straight away
+func updateMembershipExpiry(c *gin.Context, groupUsername, subjectType, subjectID string, expiresAt sql.NullTime) (string, string, error) {
+	var before sql.NullTime
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		SELECT expires_at FROM membership_metadata
+		WHERE group_username = $1 AND subject_type = $2 AND subject_id = $3 AND relation = 'member'
+		FOR UPDATE
+	`, groupUsername, subjectType, subjectID).Scan(&before)
+	if err != nil && err != sql.ErrNoRows {
+		return "", "", err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO membership_metadata (group_username, subject_type, subject_id, relation, expires_at)
+		VALUES ($1, $2, $3, 'member', $4)
+		ON CONFLICT (group_username, subject_type, subject_id, relation) DO UPDATE
+		SET expires_at = EXCLUDED.expires_at, expiry_notified_at = NULL, updated_at = CURRENT_TIMESTAMP
+	`, groupUsername, subjectType, subjectID, expiresAt)
+	if err != nil {
+		return "", "", err
+	}
+
+	outboxID, err := enqueueOutboxEntry(tx, outboxEntry{
+		groupUsername: groupUsername,
+		operation:     "TOUCH",
+		relation:      "member",
+		subjectType:   subjectType,
+		subjectID:     subjectID,
+		expiresAt:     expiresAt,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:        "member.expiry_updated",
+		GroupUsername: groupUsername,
+		Subject:       subjectID,
+		Before:        gin.H{"expires_at": formatExpiry(before)},
+		After:         gin.H{"expires_at": formatExpiry(expiresAt)},
+		OutboxID:      outboxID,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", "", err
+	}
+
+	syncStatus, zedtoken := applyOutboxEntryNow(outboxID)
+	return syncStatus, zedtoken, nil
+}
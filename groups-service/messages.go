@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"strings"
+)
+
+type GroupMessage struct {
+	ID             int    `json:"id"`
+	GroupUsername  string `json:"group_username"`
+	SenderUsername string `json:"sender_username"`
+	Subject        string `json:"subject"`
+	Body           string `json:"body"`
+	MessageID      string `json:"message_id"`
+	InReplyTo      string `json:"in_reply_to,omitempty"`
+	ThreadID       int    `json:"thread_id"`
+	CreatedAt      string `json:"created_at"`
+}
+
+// Generate a Message-ID for messages that arrive without one
+func newMessageID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return "<" + hex.EncodeToString(buf) + "@" + emailDomain + ">"
+}
+
+// Find the thread a reply belongs to. Replies join the thread of the message
+// they answer; anything else starts a new thread.
+func findThreadID(tx *sql.Tx, groupUsername string, inReplyTo string) (sql.NullInt64, error) {
+	var threadID sql.NullInt64
+	if inReplyTo == "" {
+		return threadID, nil
+	}
+	err := tx.QueryRow(`
+		SELECT COALESCE(thread_id, id)
+		FROM messages
+		WHERE group_username = $1 AND message_id = $2
+		ORDER BY id
+		LIMIT 1
+	`, groupUsername, inReplyTo).Scan(&threadID)
+	if err == sql.ErrNoRows {
+		return sql.NullInt64{}, nil
+	}
+	return threadID, err
+}
+
+// Store copies of a message in several groups' archives in one transaction,
+// so either every group gets it or none does and the sender can safely retry
+func storeGroupMessages(msgs []*GroupMessage) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, msg := range msgs {
+		if err := insertGroupMessage(tx, msg); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		log.Printf("Stored message %d in group %s from %s (thread %d)", msg.ID, msg.GroupUsername, msg.SenderUsername, msg.ThreadID)
+
+		// Fan the message out to members now; if that fails the fan-out
+		// worker retries it from the queued entry
+		if err := fanOutMessage(msg.ID, msg.GroupUsername); err != nil {
+			recordFanoutFailure(msg.ID, 0, err)
+		}
+	}
+
+	return nil
+}
+
+// Store a message in a group's archive, threading it under the message it replies to
+func insertGroupMessage(tx *sql.Tx, msg *GroupMessage) error {
+	if msg.MessageID == "" {
+		msg.MessageID = newMessageID()
+	}
+	msg.MessageID = strings.TrimSpace(msg.MessageID)
+	msg.InReplyTo = strings.TrimSpace(msg.InReplyTo)
+
+	threadID, err := findThreadID(tx, msg.GroupUsername, msg.InReplyTo)
+	if err != nil {
+		return err
+	}
+
+	var inReplyTo sql.NullString
+	if msg.InReplyTo != "" {
+		inReplyTo = sql.NullString{String: msg.InReplyTo, Valid: true}
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO messages (group_username, sender_username, subject, body, message_id, in_reply_to, thread_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, msg.GroupUsername, msg.SenderUsername, msg.Subject, msg.Body, msg.MessageID, inReplyTo, threadID).Scan(&msg.ID)
+	if err != nil {
+		return err
+	}
+
+	// New threads are rooted at their first message
+	if !threadID.Valid {
+		if _, err := tx.Exec("UPDATE messages SET thread_id = id WHERE id = $1", msg.ID); err != nil {
+			return err
+		}
+		msg.ThreadID = msg.ID
+	} else {
+		msg.ThreadID = int(threadID.Int64)
+	}
+
+	if err := enqueueMessageFanout(tx, msg.ID); err != nil {
+		return err
+	}
+
+	return recordGroupEvent(tx, &GroupEvent{
+		Type:          "message.created",
+		GroupUsername: msg.GroupUsername,
+		SubjectType:   "user",
+		SubjectID:     msg.SenderUsername,
+		Actor:         msg.SenderUsername,
+		Data: eventData(map[string]interface{}{
+			"message_id": msg.ID,
+			"subject":    msg.Subject,
+			"thread_id":  msg.ThreadID,
+		}),
+	})
+}
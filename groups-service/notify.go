@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Listen for Postgres notifications from every replica: stored zedtokens keep
+// the token cache in step, and new group events wake live event streams
+func startNotificationListener(databaseURL string) {
+	listener := pq.NewListener(databaseURL, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			// Anything could have changed while we weren't listening
+			zedtokens.reset(true)
+			groupEventHub.broadcast()
+			log.Printf("Listening for notifications on %s and %s", zedtokenChannel, groupEventsChannel)
+		case pq.ListenerEventDisconnected:
+			zedtokens.reset(false)
+			log.Printf("Warning: Notification listener disconnected, bypassing zedtoken cache: %v", err)
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("Warning: Notification listener failed to connect: %v", err)
+		}
+	})
+	for _, channel := range []string{zedtokenChannel, groupEventsChannel} {
+		if err := listener.Listen(channel); err != nil {
+			log.Printf("Warning: Failed to listen on %s: %v", channel, err)
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case n := <-listener.Notify:
+				if n == nil {
+					// The connection was re-established and notifications may have been lost
+					zedtokens.reset(true)
+					groupEventHub.broadcast()
+					continue
+				}
+				switch n.Channel {
+				case zedtokenChannel:
+					handleZedtokenNotification(n.Extra)
+				case groupEventsChannel:
+					groupEventHub.broadcast()
+				}
+			case <-time.After(90 * time.Second):
+				// Make sure the connection is still alive when things are quiet
+				go listener.Ping()
+			}
+		}
+	}()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+const (
+	outboxPollInterval = 2 * time.Second
+	outboxBatchSize    = 20
+	outboxBaseBackoff  = 2 * time.Second
+	outboxMaxBackoff   = 5 * time.Minute
+	outboxWriteTimeout = 30 * time.Second
+	outboxLease        = 2 * time.Minute
+)
+
+// A relationship change waiting to be applied to SpiceDB.
+//
+// Changes are recorded in the same Postgres transaction as the group change they
+// belong to, so the two can't drift apart. Every operation is idempotent, which
+// lets the worker retry until SpiceDB accepts it.
+type outboxEntry struct {
+	id              int64
+	groupUsername   string
+	operation       string
+	relation        string
+	subjectType     string
+	subjectID       string
+	subjectRelation string
+	expiresAt       sql.NullTime
+	attempts        int
+}
+
+// Record a relationship change inside the caller's transaction
+func enqueueOutboxEntry(tx *sql.Tx, entry outboxEntry) (int64, error) {
+	var id int64
+	err := tx.QueryRow(`
+		INSERT INTO spicedb_outbox (group_username, operation, relation, subject_type, subject_id, subject_relation, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, entry.groupUsername, entry.operation, nullString(entry.relation), nullString(entry.subjectType),
+		nullString(entry.subjectID), nullString(entry.subjectRelation), entry.expiresAt).Scan(&id)
+	return id, err
+}
+
+func startOutboxWorker() {
+	go func() {
+		for {
+			processOutbox()
+			time.Sleep(outboxPollInterval)
+		}
+	}()
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Duration(float64(outboxBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if backoff > outboxMaxBackoff || backoff <= 0 {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
+
+// Lease pending entries that are ready to apply, or just the given entry when
+// id is non-zero, by pushing their next attempt past the lease. An entry waits
+// until every earlier entry for its group has been applied, so a group's
+// changes reach SpiceDB in the order they were made. The lease commits before
+// SpiceDB is called, so no transaction stays open across the write; a worker
+// that dies mid-batch leaves its entries to be retried once the lease runs out.
+func claimOutboxEntries(id int64) ([]outboxEntry, error) {
+	rows, err := db.Query(`
+		UPDATE spicedb_outbox
+		SET next_attempt_at = CURRENT_TIMESTAMP + $3::int * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT o.id
+			FROM spicedb_outbox o
+			WHERE o.status = 'PENDING'
+			  AND o.next_attempt_at <= CURRENT_TIMESTAMP
+			  AND ($1 = 0 OR o.id = $1)
+			  AND NOT EXISTS (
+			      SELECT 1 FROM spicedb_outbox earlier
+			      WHERE earlier.group_username = o.group_username
+			        AND earlier.status = 'PENDING'
+			        AND earlier.id < o.id
+			  )
+			ORDER BY o.id
+			LIMIT $2
+			FOR UPDATE OF o SKIP LOCKED
+		)
+		RETURNING id, group_username, operation, COALESCE(relation, ''),
+		          COALESCE(subject_type, ''), COALESCE(subject_id, ''), COALESCE(subject_relation, ''),
+		          expires_at, attempts
+	`, id, outboxBatchSize, int(outboxLease.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []outboxEntry
+	for rows.Next() {
+		var entry outboxEntry
+		err := rows.Scan(&entry.id, &entry.groupUsername, &entry.operation, &entry.relation,
+			&entry.subjectType, &entry.subjectID, &entry.subjectRelation, &entry.expiresAt, &entry.attempts)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	return entries, nil
+}
+
+// Apply a leased entry to SpiceDB and record the outcome
+func applyOutboxEntry(entry outboxEntry) (string, error) {
+	var zedtoken string
+	var err error
+	switch entry.operation {
+	case "TOUCH", "DELETE":
+		zedtoken, err = updateSpiceDBRelationship(entry)
+	case "DELETE_GROUP":
+		zedtoken, err = deleteSpiceDBGroup(entry.groupUsername)
+	default:
+		err = fmt.Errorf("unknown outbox operation: %s", entry.operation)
+	}
+
+	if err == nil {
+		_, dbErr := db.Exec(`
+			UPDATE spicedb_outbox
+			SET status = 'APPLIED', attempts = attempts + 1, last_error = NULL, zedtoken = $1, applied_at = CURRENT_TIMESTAMP
+			WHERE id = $2
+		`, zedtoken, entry.id)
+		if dbErr != nil {
+			// The lease runs out and the entry is applied again as a no-op
+			log.Printf("[OUTBOX] failed to record entry %d: %v", entry.id, dbErr)
+		}
+		log.Printf("[OUTBOX] status=APPLIED id=%d group=%s operation=%s zedtoken=%s", entry.id, entry.groupUsername, entry.operation, zedtoken)
+		return zedtoken, nil
+	}
+
+	attempts := entry.attempts + 1
+	nextAttempt := time.Now().Add(outboxBackoff(attempts))
+	_, dbErr := db.Exec(`
+		UPDATE spicedb_outbox
+		SET attempts = $1, last_error = $2, next_attempt_at = $3
+		WHERE id = $4
+	`, attempts, err.Error(), nextAttempt, entry.id)
+	if dbErr != nil {
+		log.Printf("[OUTBOX] failed to record entry %d: %v", entry.id, dbErr)
+	}
+	log.Printf("[OUTBOX] status=PENDING id=%d group=%s operation=%s attempts=%d error=%v", entry.id, entry.groupUsername, entry.operation, attempts, err)
+	return "", err
+}
+
+// Apply a batch of ready entries. A batch holds at most one entry per group,
+// since a group's later entries wait for its earlier ones.
+func processOutbox() {
+	entries, err := claimOutboxEntries(0)
+	if err != nil {
+		log.Printf("[OUTBOX] failed to claim pending entries: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		applyOutboxEntry(entry)
+	}
+}
+
+// Try to apply an entry straight away so the caller can usually see its change
+// immediately. Returns the entry's state; anything still pending is left to the
+// worker.
+func applyOutboxEntryNow(id int64) (string, string) {
+	entries, err := claimOutboxEntries(id)
+	if err != nil {
+		log.Printf("[OUTBOX] failed to claim entry %d: %v", id, err)
+		return "PENDING", ""
+	}
+	if len(entries) == 0 {
+		// Another worker holds it, or an earlier change to the group is still pending
+		return "PENDING", ""
+	}
+
+	zedtoken, err := applyOutboxEntry(entries[0])
+	if err != nil {
+		return "PENDING", ""
+	}
+	return "APPLIED", zedtoken
+}
+
+// Get the names of groups with relationship changes still waiting for SpiceDB
+func getGroupsWithPendingSync() (map[string]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT group_username FROM spicedb_outbox WHERE status = 'PENDING'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := make(map[string]bool)
+	for rows.Next() {
+		var groupUsername string
+		if err := rows.Scan(&groupUsername); err != nil {
+			return nil, err
+		}
+		pending[groupUsername] = true
+	}
+	return pending, rows.Err()
+}
+
+// Write or delete a single group relationship. TOUCH succeeds if the relationship
+// already exists and DELETE succeeds if it is already gone.
+func updateSpiceDBRelationship(entry outboxEntry) (string, error) {
+	operation := v1.RelationshipUpdate_OPERATION_TOUCH
+	if entry.operation == "DELETE" {
+		operation = v1.RelationshipUpdate_OPERATION_DELETE
+	}
+
+	request := &v1.WriteRelationshipsRequest{
+		Updates: []*v1.RelationshipUpdate{
+			{
+				Operation: operation,
+				Relationship: &v1.Relationship{
+					Resource: &v1.ObjectReference{
+						ObjectType: "group",
+						ObjectId:   entry.groupUsername,
+					},
+					Relation: entry.relation,
+					Subject: &v1.SubjectReference{
+						Object: &v1.ObjectReference{
+							ObjectType: entry.subjectType,
+							ObjectId:   entry.subjectID,
+						},
+						OptionalRelation: entry.subjectRelation,
+					},
+				},
+			},
+		},
+	}
+	if operation == v1.RelationshipUpdate_OPERATION_TOUCH && entry.expiresAt.Valid {
+		request.Updates[0].Relationship.OptionalCaveat = expiryCaveat(entry.expiresAt.Time)
+	}
+
+	log.Printf("[SPICEDB] operation=WriteRelationships action=%s resource_type=group resource_id=%s relation=%s subject_type=%s subject_id=%s subject_relation=%s expires_at=%s",
+		entry.operation, entry.groupUsername, entry.relation, entry.subjectType, entry.subjectID, entry.subjectRelation, formatExpiry(entry.expiresAt))
+
+	return writeGroupRelationships(entry.groupUsername, func() (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), outboxWriteTimeout)
+		defer cancel()
+		resp, err := spicedbClient.WriteRelationships(ctx, request)
+		if err != nil {
+			log.Printf("[SPICEDB] operation=WriteRelationships status=ERROR error=%v", err)
+			return "", err
+		}
+
+		// Log the response; the zedtoken is stored under the group's write lock
+		log.Printf("[SPICEDB] operation=WriteRelationships status=SUCCESS written_at=%s", resp.WrittenAt.Token)
+		return resp.WrittenAt.Token, nil
+	})
+}
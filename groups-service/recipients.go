@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+)
+
+type ResolveRecipientsRequest struct {
+	Addresses []string `json:"addresses" binding:"required"`
+	Sender    string   `json:"sender"`
+}
+
+type Recipient struct {
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Via      []string `json:"via"`
+}
+
+type RejectedAddress struct {
+	Address string `json:"address"`
+	Reason  string `json:"reason"`
+}
+
+type ResolveRecipientsResponse struct {
+	Sender     string            `json:"sender"`
+	Recipients []Recipient       `json:"recipients"`
+	Rejected   []RejectedAddress `json:"rejected"`
+}
+
+// Split an address into its local part and domain, lowercased
+func parseAddress(address string) (string, string, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || at == len(address)-1 {
+		return "", "", fmt.Errorf("malformed address")
+	}
+	return address[:at], address[at+1:], nil
+}
+
+// Helper function to check if a group exists in Postgres
+func groupExists(groupUsername string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM groups WHERE username = $1)", groupUsername).Scan(&exists)
+	return exists, err
+}
+
+// Get the effective members of a group from SpiceDB, with nested groups expanded
+func getEffectiveMembersFromSpiceDB(groupUsername string) ([]string, error) {
+	request := &v1.LookupSubjectsRequest{
+		Resource: &v1.ObjectReference{
+			ObjectType: "group",
+			ObjectId:   groupUsername,
+		},
+		Permission:        "all_members",
+		SubjectObjectType: "user",
+		Consistency:       getConsistencyForGroup(groupUsername),
+		Context:           caveatContext(),
+	}
+
+	log.Printf("[SPICEDB] operation=LookupSubjects resource_type=group resource_id=%s permission=all_members subject_type=user", groupUsername)
+
+	stream, err := spicedbClient.LookupSubjects(context.Background(), request)
+	if err != nil {
+		log.Printf("[SPICEDB] operation=LookupSubjects status=ERROR error=%v", err)
+		return nil, err
+	}
+
+	var members []string
+	for {
+		response, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			log.Printf("[SPICEDB] operation=LookupSubjects status=ERROR error=%v", err)
+			return nil, err
+		}
+
+		subject := response.Subject
+		if subject == nil || subject.SubjectObjectId == "*" {
+			continue
+		}
+		if subject.Permissionship != v1.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION {
+			continue
+		}
+		members = append(members, subject.SubjectObjectId)
+	}
+
+	log.Printf("[SPICEDB] operation=LookupSubjects status=SUCCESS subject_count=%d", len(members))
+	return members, nil
+}
+
+// Resolve a list of addresses into the set of users mail should be delivered to.
+// User addresses resolve to themselves, group addresses resolve to the group's
+// effective members provided the sender may post to the group.
+func resolveRecipients(sender string, addresses []string) ResolveRecipientsResponse {
+	result := ResolveRecipientsResponse{
+		Sender:     sender,
+		Recipients: []Recipient{},
+		Rejected:   []RejectedAddress{},
+	}
+
+	index := map[string]int{}
+	deliver := func(username, via string) {
+		if i, ok := index[username]; ok {
+			result.Recipients[i].Via = append(result.Recipients[i].Via, via)
+			return
+		}
+		index[username] = len(result.Recipients)
+		result.Recipients = append(result.Recipients, Recipient{
+			Username: username,
+			Email:    emailAddress(username),
+			Via:      []string{via},
+		})
+	}
+	reject := func(address, reason string) {
+		result.Rejected = append(result.Rejected, RejectedAddress{Address: address, Reason: reason})
+	}
+
+	seen := map[string]bool{}
+	for _, address := range addresses {
+		localPart, domain, err := parseAddress(address)
+		if err != nil {
+			reject(address, "Malformed address")
+			continue
+		}
+		normalized := localPart + "@" + domain
+		if seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+
+		if domain != emailDomain {
+			reject(address, fmt.Sprintf("Domain '%s' is not handled by this service", domain))
+			continue
+		}
+
+		if isSystemUser(localPart) {
+			deliver(localPart, normalized)
+			continue
+		}
+
+		groupUsername, found, err := lookupGroupByLocalPart(localPart)
+		if err != nil {
+			log.Printf("Failed to resolve group address %s: %v", normalized, err)
+			reject(address, "Failed to resolve address")
+			continue
+		}
+		if !found {
+			reject(address, "Unknown recipient")
+			continue
+		}
+
+		if !checkPermission(sender, groupUsername, "post") {
+			reject(address, fmt.Sprintf("Sender '%s' is not allowed to post to this group", sender))
+			continue
+		}
+
+		members, err := getEffectiveMembersFromSpiceDB(groupUsername)
+		if err != nil {
+			log.Printf("Failed to expand members of group %s: %v", groupUsername, err)
+			reject(address, "Failed to expand group members")
+			continue
+		}
+		for _, member := range members {
+			deliver(member, normalized)
+		}
+	}
+
+	return result
+}
+
+// Resolve addresses for mail sent by the caller. A user always resolves as
+// themselves, so they can only expand groups they may post to. A service
+// account whose key has the resolve_recipients scope, such as mail-service,
+// names the sender it is relaying for in the body.
+func resolveRecipientsHandler(c *gin.Context) {
+	var req ResolveRecipientsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	principal := currentPrincipal(c)
+	sender := ""
+	switch {
+	case principal.Type == "user":
+		if req.Sender != "" && req.Sender != principal.ID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Users can only resolve recipients as themselves"})
+			return
+		}
+		sender = principal.ID
+	case principal.Type == "service_account" && principal.hasScope(resolveRecipientsScope):
+		if req.Sender == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sender is required"})
+			return
+		}
+		if !isSystemUser(req.Sender) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Sender '%s' is not a valid system user", req.Sender)})
+			return
+		}
+		sender = req.Sender
+		log.Printf("[RECIPIENTS] service_account=%s resolving for sender=%s", principal.ID, sender)
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only users, or service accounts with the resolve_recipients scope, can resolve recipients"})
+		return
+	}
+
+	c.JSON(http.StatusOK, resolveRecipients(sender, req.Addresses))
+}
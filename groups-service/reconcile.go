@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+)
+
+// A SpiceDB group relationship found by the reconciler
+type DriftRelationship struct {
+	Group           string `json:"group"`
+	Relation        string `json:"relation"`
+	SubjectType     string `json:"subject_type"`
+	SubjectID       string `json:"subject_id"`
+	SubjectRelation string `json:"subject_relation,omitempty"`
+	ExpiresAt       string `json:"expires_at,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+
+	// The relationship's expiry, for backfilling its membership metadata
+	expiresAt sql.NullTime
+}
+
+// A change the reconciler made, or would make, to remove drift
+type DriftRepair struct {
+	Action       string             `json:"action"`
+	Group        string             `json:"group"`
+	Relationship *DriftRelationship `json:"relationship,omitempty"`
+	OutboxID     int64              `json:"outbox_id,omitempty"`
+	Note         string             `json:"note,omitempty"`
+}
+
+type DriftReport struct {
+	Mode                  string              `json:"mode"`
+	CheckedAt             string              `json:"checked_at"`
+	GroupCount            int                 `json:"group_count"`
+	RelationshipCount     int                 `json:"relationship_count"`
+	GroupsWithoutAdmin    []string            `json:"groups_without_admin"`
+	OrphanedRelationships []DriftRelationship `json:"orphaned_relationships"`
+	InvalidSubjects       []DriftRelationship `json:"invalid_subjects"`
+	MetadataDrift         []DriftRelationship `json:"metadata_drift"`
+	Repairs               []DriftRepair       `json:"repairs,omitempty"`
+}
+
+type ReconcileRequest struct {
+	Mode          string `json:"mode"`
+	FallbackOwner string `json:"fallback_owner"`
+}
+
+const (
+	defaultReconcileInterval = time.Hour
+	reconcileGracePeriod     = time.Minute
+)
+
+// Read every group relationship from SpiceDB, along with the revision they
+// were read at
+func readAllGroupRelationships() ([]*v1.Relationship, string, error) {
+	request := &v1.ReadRelationshipsRequest{
+		RelationshipFilter: &v1.RelationshipFilter{
+			ResourceType: "group",
+		},
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{
+				FullyConsistent: true,
+			},
+		},
+	}
+
+	log.Printf("[SPICEDB] operation=ReadRelationships resource_type=group context=reconcile")
+
+	stream, err := spicedbClient.ReadRelationships(context.Background(), request)
+	if err != nil {
+		log.Printf("[SPICEDB] operation=ReadRelationships status=ERROR error=%v", err)
+		return nil, "", err
+	}
+
+	var relationships []*v1.Relationship
+	var readAt string
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[SPICEDB] operation=ReadRelationships status=ERROR error=%v", err)
+			return nil, "", err
+		}
+		relationships = append(relationships, response.Relationship)
+		readAt = response.ReadAt.GetToken()
+	}
+
+	log.Printf("[SPICEDB] operation=ReadRelationships status=SUCCESS relationship_count=%d", len(relationships))
+	return relationships, readAt, nil
+}
+
+// Explain why a relationship's subject doesn't belong in SpiceDB, or return ""
+func invalidSubjectReason(subject *v1.SubjectReference, groups map[string]bool) (string, error) {
+	switch subject.Object.ObjectType {
+	case "user":
+		if !isSystemUser(subject.Object.ObjectId) {
+			return "not a system user", nil
+		}
+	case "service_account":
+		exists, err := serviceAccountExists(subject.Object.ObjectId)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "service account does not exist", nil
+		}
+	case "group":
+		if !groups[subject.Object.ObjectId] {
+			return "nested group does not exist", nil
+		}
+	default:
+		return "unexpected subject type", nil
+	}
+	return "", nil
+}
+
+// Compare the groups table with SpiceDB group relationships. Groups with
+// changes still waiting in the outbox are skipped, since they are expected to
+// differ until the worker catches up.
+func findDrift() (*DriftReport, error) {
+	// Read SpiceDB before Postgres. A group deleted in between then only shows
+	// up as orphaned relationships, which are safe to delete again, rather than
+	// a live group's relationships being mistaken for orphans.
+	relationships, _, err := readAllGroupRelationships()
+	if err != nil {
+		return nil, err
+	}
+
+	// Groups created in between have no admin in our snapshot, so recent
+	// groups are left out of that check
+	rows, err := db.Query(`
+		SELECT username, created_at > CURRENT_TIMESTAMP - $1::int * INTERVAL '1 second'
+		FROM groups
+		ORDER BY username
+	`, int(reconcileGracePeriod.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]bool)
+	recent := make(map[string]bool)
+	var groupNames []string
+	for rows.Next() {
+		var username string
+		var isRecent bool
+		if err := rows.Scan(&username, &isRecent); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groups[username] = true
+		recent[username] = isRecent
+		groupNames = append(groupNames, username)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	pendingSync, err := getGroupsWithPendingSync()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DriftReport{
+		Mode:                  "report",
+		CheckedAt:             time.Now().Format("2006-01-02 15:04:05"),
+		GroupCount:            len(groupNames),
+		RelationshipCount:     len(relationships),
+		GroupsWithoutAdmin:    []string{},
+		OrphanedRelationships: []DriftRelationship{},
+		InvalidSubjects:       []DriftRelationship{},
+		MetadataDrift:         []DriftRelationship{},
+	}
+
+	hasAdmin := make(map[string]bool)
+	var valid []DriftRelationship
+	for _, rel := range relationships {
+		groupUsername := rel.Resource.ObjectId
+		if pendingSync[groupUsername] {
+			continue
+		}
+
+		drift := DriftRelationship{
+			Group:           groupUsername,
+			Relation:        rel.Relation,
+			SubjectType:     rel.Subject.Object.ObjectType,
+			SubjectID:       rel.Subject.Object.ObjectId,
+			SubjectRelation: rel.Subject.OptionalRelation,
+		}
+		if t, ok := relationshipExpiry(rel); ok {
+			drift.expiresAt = sql.NullTime{Time: t, Valid: true}
+			drift.ExpiresAt = formatExpiry(drift.expiresAt)
+		}
+
+		if !groups[groupUsername] {
+			drift.Reason = "group does not exist in Postgres"
+			report.OrphanedRelationships = append(report.OrphanedRelationships, drift)
+			continue
+		}
+
+		reason, err := invalidSubjectReason(rel.Subject, groups)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			drift.Reason = reason
+			report.InvalidSubjects = append(report.InvalidSubjects, drift)
+			continue
+		}
+
+		if rel.Relation == "admin" {
+			hasAdmin[groupUsername] = true
+		}
+		valid = append(valid, drift)
+	}
+
+	for _, groupUsername := range groupNames {
+		if !hasAdmin[groupUsername] && !pendingSync[groupUsername] && !recent[groupUsername] {
+			report.GroupsWithoutAdmin = append(report.GroupsWithoutAdmin, groupUsername)
+		}
+	}
+
+	if err := findMetadataDrift(report, valid, pendingSync); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Compare membership_metadata with the valid relationships found in SpiceDB.
+// Rows written within the grace period may belong to changes made after the
+// SpiceDB snapshot, so they are left alone.
+func findMetadataDrift(report *DriftReport, relationships []DriftRelationship, pendingSync map[string]bool) error {
+	rows, err := db.Query(`
+		SELECT group_username, subject_type, subject_id, relation,
+		       joined_at > CURRENT_TIMESTAMP - $1::int * INTERVAL '1 second'
+		FROM membership_metadata
+		ORDER BY group_username, subject_type, subject_id, relation
+	`, int(reconcileGracePeriod.Seconds()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type metadataKey struct {
+		group, subjectType, subjectID, relation string
+	}
+	stored := make(map[metadataKey]bool)
+	var storedOrder []metadataKey
+	for rows.Next() {
+		var key metadataKey
+		var isRecent bool
+		if err := rows.Scan(&key.group, &key.subjectType, &key.subjectID, &key.relation, &isRecent); err != nil {
+			return err
+		}
+		stored[key] = isRecent
+		storedOrder = append(storedOrder, key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	related := make(map[metadataKey]bool)
+	for _, rel := range relationships {
+		key := metadataKey{rel.Group, rel.SubjectType, rel.SubjectID, rel.Relation}
+		related[key] = true
+		if _, ok := stored[key]; ok {
+			continue
+		}
+		rel.Reason = "relationship has no membership metadata"
+		report.MetadataDrift = append(report.MetadataDrift, rel)
+	}
+
+	for _, key := range storedOrder {
+		if related[key] || stored[key] || pendingSync[key.group] {
+			continue
+		}
+		report.MetadataDrift = append(report.MetadataDrift, DriftRelationship{
+			Group:       key.group,
+			Relation:    key.relation,
+			SubjectType: key.subjectType,
+			SubjectID:   key.subjectID,
+			Reason:      "membership metadata has no relationship",
+		})
+	}
+
+	return nil
+}
+
+// Plan the repairs for a drift report and, in apply mode, queue them in the
+// SpiceDB outbox. Groups without an admin are given the fallback owner when
+// one is supplied; otherwise they are left for someone to repair by hand.
+func repairDrift(report *DriftReport, mode string, fallbackOwner string, actor string) error {
+	report.Mode = mode
+	report.Repairs = []DriftRepair{}
+
+	orphanedGroups := make(map[string]bool)
+	var entries []outboxEntry
+	for _, drift := range report.OrphanedRelationships {
+		if orphanedGroups[drift.Group] {
+			continue
+		}
+		orphanedGroups[drift.Group] = true
+		entries = append(entries, outboxEntry{groupUsername: drift.Group, operation: "DELETE_GROUP"})
+		report.Repairs = append(report.Repairs, DriftRepair{Action: "delete_group_relationships", Group: drift.Group})
+	}
+	for i, drift := range report.InvalidSubjects {
+		entries = append(entries, outboxEntry{
+			groupUsername:   drift.Group,
+			operation:       "DELETE",
+			relation:        drift.Relation,
+			subjectType:     drift.SubjectType,
+			subjectID:       drift.SubjectID,
+			subjectRelation: drift.SubjectRelation,
+		})
+		report.Repairs = append(report.Repairs, DriftRepair{Action: "delete_relationship", Group: drift.Group, Relationship: &report.InvalidSubjects[i]})
+	}
+	for _, groupUsername := range report.GroupsWithoutAdmin {
+		if fallbackOwner == "" {
+			report.Repairs = append(report.Repairs, DriftRepair{Action: "manual", Group: groupUsername, Note: "No fallback owner given; add an admin by hand"})
+			continue
+		}
+		entries = append(entries, outboxEntry{
+			groupUsername: groupUsername,
+			operation:     "TOUCH",
+			relation:      "admin",
+			subjectType:   "user",
+			subjectID:     fallbackOwner,
+		})
+		report.Repairs = append(report.Repairs, DriftRepair{Action: "add_admin", Group: groupUsername, Note: "Owner set to " + fallbackOwner})
+	}
+
+	// Metadata lives in Postgres, so it is fixed directly rather than through the outbox
+	for i, drift := range report.MetadataDrift {
+		action := "add_metadata"
+		if drift.Reason == "membership metadata has no relationship" {
+			action = "delete_metadata"
+		}
+		report.Repairs = append(report.Repairs, DriftRepair{Action: action, Group: drift.Group, Relationship: &report.MetadataDrift[i]})
+	}
+
+	if mode != "apply" || len(report.Repairs) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queued := 0
+	for i := range report.Repairs {
+		repair := &report.Repairs[i]
+		switch repair.Action {
+		case "manual":
+			continue
+		case "add_metadata":
+			rel := repair.Relationship
+			_, err = tx.Exec(`
+				INSERT INTO membership_metadata (group_username, subject_type, subject_id, relation, expires_at)
+				VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (group_username, subject_type, subject_id, relation) DO UPDATE
+				SET expires_at = EXCLUDED.expires_at,
+				    expiry_notified_at = CASE
+				        WHEN membership_metadata.expires_at IS DISTINCT FROM EXCLUDED.expires_at THEN NULL
+				        ELSE membership_metadata.expiry_notified_at
+				    END
+			`, rel.Group, rel.SubjectType, rel.SubjectID, rel.Relation, rel.expiresAt)
+		case "delete_metadata":
+			rel := repair.Relationship
+			_, err = tx.Exec(`
+				DELETE FROM membership_metadata
+				WHERE group_username = $1 AND subject_type = $2 AND subject_id = $3 AND relation = $4
+			`, rel.Group, rel.SubjectType, rel.SubjectID, rel.Relation)
+		default:
+			repair.OutboxID, err = enqueueOutboxEntry(tx, entries[queued])
+			queued++
+		}
+		if err != nil {
+			return err
+		}
+
+		err = recordAuditEventTx(tx, AuditEvent{
+			Actor:         actor,
+			Action:        "drift.repaired",
+			GroupUsername: repair.Group,
+			After:         repair,
+			OutboxID:      repair.OutboxID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("[RECONCILE] queued %d repairs and fixed %d membership metadata rows", queued, len(report.MetadataDrift))
+	return nil
+}
+
+func logDriftReport(report *DriftReport) {
+	log.Printf("[RECONCILE] mode=%s groups=%d relationships=%d groups_without_admin=%d orphaned_relationships=%d invalid_subjects=%d metadata_drift=%d repairs=%d",
+		report.Mode, report.GroupCount, report.RelationshipCount, len(report.GroupsWithoutAdmin),
+		len(report.OrphanedRelationships), len(report.InvalidSubjects), len(report.MetadataDrift), len(report.Repairs))
+}
+
+// Periodically look for drift. RECONCILE_MODE picks whether the job only
+// reports (the default), plans repairs as a dry run, or applies them.
+func startReconcileJob() {
+	interval := defaultReconcileInterval
+	if v := os.Getenv("RECONCILE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Printf("Invalid RECONCILE_INTERVAL %q, using %v", v, defaultReconcileInterval)
+		} else {
+			interval = d
+		}
+	}
+	if interval == 0 {
+		log.Println("Drift reconciliation job disabled")
+		return
+	}
+
+	mode := os.Getenv("RECONCILE_MODE")
+	if mode != "dry_run" && mode != "apply" {
+		mode = "report"
+	}
+	fallbackOwner := os.Getenv("RECONCILE_FALLBACK_OWNER")
+	if fallbackOwner != "" && !isSystemUser(fallbackOwner) {
+		log.Printf("RECONCILE_FALLBACK_OWNER %q is not a system user, ignoring it", fallbackOwner)
+		fallbackOwner = ""
+	}
+
+	log.Printf("Drift reconciliation every %v in %s mode", interval, mode)
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			report, err := findDrift()
+			if err != nil {
+				log.Printf("[RECONCILE] failed to check for drift: %v", err)
+				continue
+			}
+			if mode != "report" {
+				if err := repairDrift(report, mode, fallbackOwner, "system:reconciler"); err != nil {
+					log.Printf("[RECONCILE] failed to repair drift: %v", err)
+				}
+			}
+			logDriftReport(report)
+		}
+	}()
+}
+
+func getDriftReport(c *gin.Context) {
+	username := currentUsername(c)
+	if username == "" || !checkPlatformPermission(username, "reconcile") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	report, err := findDrift()
+	if err != nil {
+		log.Printf("[RECONCILE] failed to check for drift: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for drift"})
+		return
+	}
+	logDriftReport(report)
+
+	c.JSON(http.StatusOK, report)
+}
+
+func reconcileDrift(c *gin.Context) {
+	username := currentUsername(c)
+	if username == "" || !checkPlatformPermission(username, "reconcile") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	// The body is optional; an empty one asks for a dry run
+	var req ReconcileRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "dry_run"
+	}
+	if req.Mode != "dry_run" && req.Mode != "apply" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode. Must be dry_run or apply"})
+		return
+	}
+	if req.FallbackOwner != "" && !isSystemUser(req.FallbackOwner) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Fallback owner '%s' is not a valid system user", req.FallbackOwner)})
+		return
+	}
+
+	report, err := findDrift()
+	if err != nil {
+		log.Printf("[RECONCILE] failed to check for drift: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check for drift"})
+		return
+	}
+
+	if err := repairDrift(report, req.Mode, req.FallbackOwner, currentPrincipal(c).Actor()); err != nil {
+		log.Printf("[RECONCILE] failed to repair drift: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to repair drift"})
+		return
+	}
+	logDriftReport(report)
+
+	c.JSON(http.StatusOK, report)
+}
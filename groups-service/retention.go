@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	retentionInterval  = time.Hour
+	retentionBatchSize = 1000
+)
+
+type RetentionPolicy struct {
+	Policy    string `json:"policy"`
+	Value     *int   `json:"value,omitempty"`
+	LegalHold bool   `json:"legal_hold"`
+}
+
+// Helper function to load a group's retention settings
+func getRetentionPolicy(exec execer, groupUsername string) (*RetentionPolicy, error) {
+	var policy RetentionPolicy
+	var value sql.NullInt64
+	err := exec.QueryRow(`
+		SELECT retention_policy, retention_value, legal_hold
+		FROM groups WHERE username = $1
+	`, groupUsername).Scan(&policy.Policy, &value, &policy.LegalHold)
+	if err != nil {
+		return nil, err
+	}
+	if value.Valid {
+		v := int(value.Int64)
+		policy.Value = &v
+	}
+	return &policy, nil
+}
+
+func getGroupRetention(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	// Check permission to view members (members may see how long messages are kept)
+	if !checkPrincipalPermission(c, groupUsername, "view_members") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	policy, err := getRetentionPolicy(db, groupUsername)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// Change a group's retention policy, its legal hold, or both. A legal hold
+// stops the purge job for the group whatever the policy says; placing or
+// lifting one is a compliance decision, so it needs the platform's
+// manage_legal_hold permission rather than group ownership.
+func updateGroupRetention(c *gin.Context) {
+	groupUsername := c.Param("username")
+	principal := currentPrincipal(c)
+
+	type UpdateRetentionRequest struct {
+		Policy    string `json:"policy"`
+		Value     *int   `json:"value"`
+		LegalHold *bool  `json:"legal_hold"`
+	}
+
+	var req UpdateRetentionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Policy == "" && req.LegalHold == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update. Set policy or legal_hold"})
+		return
+	}
+
+	// Only owners may change retention
+	if req.Policy != "" && !checkPrincipalPermission(c, groupUsername, "manage_retention") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	if req.LegalHold != nil {
+		username := currentUsername(c)
+		if username == "" || !checkPlatformPermission(username, "manage_legal_hold") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			return
+		}
+	}
+
+	switch req.Policy {
+	case "":
+	case "FOREVER":
+		req.Value = nil
+	case "DAYS", "COUNT":
+		if req.Value == nil || *req.Value <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A positive value is required for DAYS and COUNT policies"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid policy. Must be FOREVER, DAYS, or COUNT"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention policy"})
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := getRetentionPolicy(tx, groupUsername)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch retention policy"})
+		return
+	}
+
+	after := *before
+	if req.Policy != "" {
+		after.Policy = req.Policy
+		after.Value = req.Value
+	}
+	if req.LegalHold != nil {
+		after.LegalHold = *req.LegalHold
+	}
+
+	_, err = tx.Exec(`
+		UPDATE groups
+		SET retention_policy = $1, retention_value = $2, legal_hold = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE username = $4
+	`, after.Policy, after.Value, after.LegalHold, groupUsername)
+	if err == nil && req.Policy != "" {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "retention.updated",
+			GroupUsername: groupUsername,
+			Before:        before,
+			After:         &after,
+		})
+	}
+	if err == nil && req.LegalHold != nil && *req.LegalHold != before.LegalHold {
+		action := "legal_hold.placed"
+		if !*req.LegalHold {
+			action = "legal_hold.lifted"
+		}
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        action,
+			GroupUsername: groupUsername,
+			Before:        gin.H{"legal_hold": before.LegalHold},
+			After:         gin.H{"legal_hold": after.LegalHold},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to update retention for group %s: %v", groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention policy"})
+		return
+	}
+	publishGroupEvent(GroupEvent{
+		Type:          "group.updated",
+		GroupUsername: groupUsername,
+		Actor:         principal.Actor(),
+		Data:          eventData(gin.H{"change": "retention_updated", "retention": &after}),
+	})
+
+	c.JSON(http.StatusOK, &after)
+}
+
+// Start the background job that purges messages past their group's retention
+func startRetentionJob() {
+	go func() {
+		for {
+			purgeExpiredMessages()
+			time.Sleep(retentionInterval)
+		}
+	}()
+}
+
+func purgeExpiredMessages() {
+	rows, err := db.Query(`
+		SELECT username, retention_policy, retention_value
+		FROM groups
+		WHERE retention_policy <> 'FOREVER' AND retention_value IS NOT NULL AND NOT legal_hold
+	`)
+	if err != nil {
+		log.Printf("[RETENTION] failed to fetch retention policies: %v", err)
+		return
+	}
+
+	type groupRetention struct {
+		username string
+		policy   string
+		value    int
+	}
+	var groups []groupRetention
+	for rows.Next() {
+		var g groupRetention
+		if err := rows.Scan(&g.username, &g.policy, &g.value); err != nil {
+			rows.Close()
+			log.Printf("[RETENTION] failed to scan retention policy: %v", err)
+			return
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+
+	for _, g := range groups {
+		deleted, err := purgeGroupMessages(g.username, g.policy, g.value)
+		if err != nil {
+			log.Printf("[RETENTION] failed to purge group %s: %v", g.username, err)
+		}
+		if deleted == 0 {
+			continue
+		}
+
+		log.Printf("[RETENTION] purged %d messages from group %s policy=%s value=%d", deleted, g.username, g.policy, g.value)
+	}
+}
+
+// Delete a group's expired messages in batches, returning how many were removed.
+// Each batch re-checks the legal hold so a hold placed mid-purge stops it, and
+// is audited in the transaction that deletes it.
+func purgeGroupMessages(groupUsername string, policy string, value int) (int64, error) {
+	var query string
+	switch policy {
+	case "DAYS":
+		query = `
+			DELETE FROM messages WHERE id IN (
+				SELECT m.id FROM messages m
+				JOIN groups g ON g.username = m.group_username
+				WHERE m.group_username = $1 AND NOT g.legal_hold
+				  AND m.created_at < CURRENT_TIMESTAMP - make_interval(days => $2)
+				LIMIT $3
+			)`
+	case "COUNT":
+		query = `
+			DELETE FROM messages WHERE id IN (
+				SELECT m.id FROM messages m
+				JOIN groups g ON g.username = m.group_username
+				WHERE m.group_username = $1 AND NOT g.legal_hold
+				ORDER BY m.created_at DESC, m.id DESC
+				OFFSET $2
+				LIMIT $3
+			)`
+	default:
+		return 0, nil
+	}
+
+	var total int64
+	for {
+		affected, err := purgeMessageBatch(query, groupUsername, policy, value)
+		if err != nil {
+			return total, err
+		}
+		total += affected
+		if affected < retentionBatchSize {
+			return total, nil
+		}
+	}
+}
+
+func purgeMessageBatch(query string, groupUsername string, policy string, value int) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, groupUsername, value, retentionBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return 0, nil
+	}
+
+	err = recordAuditEventTx(tx, AuditEvent{
+		Actor:         "system:retention",
+		Action:        "messages.purged",
+		GroupUsername: groupUsername,
+		After: map[string]interface{}{
+			"policy":  policy,
+			"value":   value,
+			"deleted": affected,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return affected, tx.Commit()
+}
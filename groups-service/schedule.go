@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	scheduleInterval    = 30 * time.Second
+	scheduleMaxAttempts = 5
+	scheduleBaseBackoff = time.Minute
+)
+
+// A membership change queued to run at a future time
+type ScheduledChange struct {
+	ID            int    `json:"id"`
+	GroupUsername string `json:"group_username"`
+	Action        string `json:"action"`
+	Username      string `json:"username"`
+	Type          string `json:"type"`
+	Role          string `json:"role,omitempty"`
+	ExpiresAt     string `json:"expires_at,omitempty"`
+	Note          string `json:"note,omitempty"`
+	RunAt         string `json:"run_at"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	Result        string `json:"result,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+	Zedtoken      string `json:"zedtoken,omitempty"`
+	CreatedBy     string `json:"created_by"`
+	CreatedAt     string `json:"created_at"`
+	AppliedAt     string `json:"applied_at,omitempty"`
+	CancelledBy   string `json:"cancelled_by,omitempty"`
+	CancelledAt   string `json:"cancelled_at,omitempty"`
+}
+
+// A scheduled change that can never apply as written, so isn't retried
+type scheduleRejection string
+
+func (r scheduleRejection) Error() string { return string(r) }
+
+type dueChange struct {
+	id          int
+	group       string
+	action      string
+	subjectType string
+	subjectID   string
+	role        string
+	expiresAt   sql.NullTime
+	note        sql.NullString
+	attempts    int
+	createdBy   string
+}
+
+// Start the scheduler that applies membership changes once their run_at
+// passes. Schedules live in Postgres, so changes due while the service was
+// down are applied when it comes back.
+func startMembershipScheduler() {
+	log.Printf("Membership scheduler running every %v", scheduleInterval)
+	go func() {
+		for {
+			for applyNextScheduledChange() {
+			}
+			time.Sleep(scheduleInterval)
+		}
+	}()
+}
+
+// Apply the next due change, reporting whether there was one. The row stays
+// locked while its SpiceDB write runs, so a cancellation can't slip in between
+// and other replicas skip it. A change whose write landed before a crash is
+// run again; every action is a no-op when its result is already in place.
+func applyNextScheduledChange() bool {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[SCHEDULE] failed to begin transaction: %v", err)
+		return false
+	}
+	defer tx.Rollback()
+
+	var change dueChange
+	err = tx.QueryRow(`
+		SELECT id, group_username, action, subject_type, subject_id, COALESCE(role, ''), expires_at, note, attempts, created_by
+		FROM scheduled_membership_changes
+		WHERE status = 'PENDING' AND next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY run_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`).Scan(&change.id, &change.group, &change.action, &change.subjectType, &change.subjectID, &change.role,
+		&change.expiresAt, &change.note, &change.attempts, &change.createdBy)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("[SCHEDULE] failed to fetch due changes: %v", err)
+		return false
+	}
+
+	previousRole, result, zedtoken, applyErr := applyScheduledChange(change)
+	attempts := change.attempts + 1
+	_, rejected := applyErr.(scheduleRejection)
+
+	status := "PENDING"
+	switch {
+	case applyErr == nil:
+		status = "APPLIED"
+		_, err = tx.Exec(`
+			UPDATE scheduled_membership_changes
+			SET status = 'APPLIED', attempts = $2, result = $3, zedtoken = $4, last_error = NULL, applied_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, change.id, attempts, result, nullString(zedtoken))
+		if err == nil && zedtoken != "" {
+			err = recordScheduledChangeAudit(tx, change, previousRole, zedtoken)
+		}
+	case rejected || attempts >= scheduleMaxAttempts:
+		status = "FAILED"
+		_, err = tx.Exec(`
+			UPDATE scheduled_membership_changes SET status = 'FAILED', attempts = $2, last_error = $3
+			WHERE id = $1
+		`, change.id, attempts, applyErr.Error())
+		if err == nil {
+			err = recordAuditEventTx(tx, AuditEvent{
+				Actor:         "system:scheduler",
+				Action:        "member.change_failed",
+				GroupUsername: change.group,
+				Subject:       change.subjectID,
+				After:         gin.H{"scheduled_change": change.id, "action": change.action, "error": applyErr.Error()},
+			})
+		}
+	default:
+		backoff := scheduleBaseBackoff << (attempts - 1)
+		_, err = tx.Exec(`
+			UPDATE scheduled_membership_changes
+			SET attempts = $2, last_error = $3, next_attempt_at = CURRENT_TIMESTAMP + $4::int * INTERVAL '1 second'
+			WHERE id = $1
+		`, change.id, attempts, applyErr.Error(), int(backoff.Seconds()))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[SCHEDULE] failed to record result of change %d: %v", change.id, err)
+		// The change will run again as a no-op, so its write is audited now
+		if status == "APPLIED" && zedtoken != "" {
+			recordScheduledChangeAudit(db, change, previousRole, zedtoken)
+		}
+		return false
+	}
+
+	switch status {
+	case "APPLIED":
+		log.Printf("[SCHEDULE] applied change %d action=%s group=%s subject=%s:%s result=%q", change.id, change.action, change.group, change.subjectType, change.subjectID, result)
+	case "FAILED":
+		log.Printf("[SCHEDULE] change %d failed after %d attempts: %v", change.id, attempts, applyErr)
+	default:
+		log.Printf("[SCHEDULE] change %d attempt %d failed, retrying: %v", change.id, attempts, applyErr)
+	}
+	return true
+}
+
+// Make a scheduled change through the same SpiceDB writes the member handlers
+// use, and keep the membership metadata in step. Returns the subject's role
+// before the change, a description of what happened and the write's zedtoken,
+// which is empty when there was nothing to do.
+func applyScheduledChange(change dueChange) (string, string, string, error) {
+	// The admin who scheduled it may have lost the right to make it since
+	permitted, err := schedulerCanAddMembers(change)
+	if err != nil {
+		return "", "", "", err
+	}
+	if !permitted {
+		return "", "", "", scheduleRejection(fmt.Sprintf("%s no longer has add_member on the group", change.createdBy))
+	}
+
+	// The subject may have been created or deleted since the change was scheduled
+	switch change.subjectType {
+	case "user":
+		if !isSystemUser(change.subjectID) {
+			return "", "", "", scheduleRejection(fmt.Sprintf("Username '%s' is not a valid system user", change.subjectID))
+		}
+	case "service_account":
+		exists, err := serviceAccountExists(change.subjectID)
+		if err != nil {
+			return "", "", "", err
+		}
+		if !exists {
+			return "", "", "", scheduleRejection(fmt.Sprintf("Service account '%s' does not exist", change.subjectID))
+		}
+	}
+
+	current, err := getSubjectRole(change.group, change.subjectType, change.subjectID)
+	if err != nil {
+		return "", "", "", err
+	}
+	currentRelation, _ := roleRelation(current)
+	relation, _ := roleRelation(change.role)
+
+	var note *string
+	if change.note.Valid {
+		note = &change.note.String
+	}
+
+	switch change.action {
+	case "ADD":
+		if current != "" && currentRelation == relation {
+			return current, fmt.Sprintf("Already %s, nothing to do", current), "", nil
+		}
+		if change.expiresAt.Valid && !change.expiresAt.Time.After(time.Now()) {
+			return current, "", "", scheduleRejection("The membership would already have expired")
+		}
+		zedtoken, err := addSpiceDBSubjectRelationshipWithExpiry(change.group, change.subjectType, change.subjectID, change.role, change.expiresAt)
+		if err != nil {
+			return current, "", "", err
+		}
+		if err := upsertMembershipMetadata(db, change.group, change.subjectType, change.subjectID, relation, change.createdBy, note, change.expiresAt); err != nil {
+			log.Printf("[SCHEDULE] failed to record membership metadata for change %d: %v", change.id, err)
+		}
+		return current, fmt.Sprintf("Added as %s", change.role), zedtoken, nil
+
+	case "REMOVE":
+		if current == "" {
+			return current, "Not a member, nothing to do", "", nil
+		}
+		zedtoken, err := removeSpiceDBSubjectRelationship(change.group, change.subjectType, change.subjectID)
+		if err != nil {
+			return current, "", "", err
+		}
+		if err := deleteMembershipMetadata(db, change.group, change.subjectType, change.subjectID); err != nil {
+			log.Printf("[SCHEDULE] failed to delete membership metadata for change %d: %v", change.id, err)
+		}
+		return current, fmt.Sprintf("Removed (was %s)", current), zedtoken, nil
+
+	case "CHANGE_ROLE":
+		if current == "" {
+			return current, "", "", scheduleRejection(fmt.Sprintf("%s is not a member of the group", change.subjectID))
+		}
+		if currentRelation == relation {
+			return current, fmt.Sprintf("Already %s, nothing to do", current), "", nil
+		}
+		if change.expiresAt.Valid && !change.expiresAt.Time.After(time.Now()) {
+			return current, "", "", scheduleRejection("The membership would already have expired")
+		}
+		zedtoken, err := setSpiceDBSubjectRole(change.group, change.subjectType, change.subjectID, change.role, change.expiresAt)
+		if err != nil {
+			return current, "", "", err
+		}
+		err = deleteMembershipMetadata(db, change.group, change.subjectType, change.subjectID)
+		if err == nil {
+			err = upsertMembershipMetadata(db, change.group, change.subjectType, change.subjectID, relation, change.createdBy, note, change.expiresAt)
+		}
+		if err != nil {
+			log.Printf("[SCHEDULE] failed to update membership metadata for change %d: %v", change.id, err)
+		}
+		return current, fmt.Sprintf("Changed from %s to %s", current, change.role), zedtoken, nil
+	}
+
+	return current, "", "", scheduleRejection(fmt.Sprintf("Unknown action %s", change.action))
+}
+
+// Check, at full consistency, that whoever scheduled a change still has
+// add_member on its group. Actors are stored as Principal.Actor() names them:
+// a bare username, or type:id for other principals.
+func schedulerCanAddMembers(change dueChange) (bool, error) {
+	subjectType, subjectID, found := strings.Cut(change.createdBy, ":")
+	if !found {
+		subjectType, subjectID = "user", change.createdBy
+	}
+
+	request := &v1.CheckPermissionRequest{
+		Resource: &v1.ObjectReference{
+			ObjectType: "group",
+			ObjectId:   change.group,
+		},
+		Permission: "add_member",
+		Subject: &v1.SubjectReference{
+			Object: &v1.ObjectReference{
+				ObjectType: subjectType,
+				ObjectId:   subjectID,
+			},
+		},
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{
+				FullyConsistent: true,
+			},
+		},
+		Context: caveatContext(),
+	}
+
+	log.Printf("[SPICEDB] operation=CheckPermission resource_type=group resource_id=%s permission=add_member subject_type=%s subject_id=%s",
+		change.group, subjectType, subjectID)
+
+	resp, err := spicedbClient.CheckPermission(context.Background(), request)
+	if err != nil {
+		log.Printf("[SPICEDB] operation=CheckPermission status=ERROR error=%v", err)
+		return false, err
+	}
+
+	log.Printf("[SPICEDB] operation=CheckPermission status=SUCCESS permissionship=%s", resp.Permissionship.String())
+	return resp.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION, nil
+}
+
+// Audit an applied change like the matching member handler would, naming the
+// admin who scheduled it
+func recordScheduledChangeAudit(exec execer, change dueChange, previousRole, zedtoken string) error {
+	event := AuditEvent{
+		Actor:         "system:scheduler",
+		GroupUsername: change.group,
+		Subject:       change.subjectID,
+		Before:        auditRole(change.subjectType, previousRole),
+		Zedtoken:      zedtoken,
+	}
+
+	switch change.action {
+	case "ADD":
+		event.Action = "member.added"
+	case "REMOVE":
+		event.Action = "member.removed"
+	case "CHANGE_ROLE":
+		event.Action = "member.role_changed"
+	}
+
+	after := gin.H{"scheduled_change": change.id, "scheduled_by": change.createdBy}
+	if change.action != "REMOVE" {
+		after["type"] = change.subjectType
+		after["role"] = change.role
+		if change.expiresAt.Valid {
+			after["expires_at"] = formatExpiry(change.expiresAt)
+		}
+	}
+	event.After = after
+
+	return recordAuditEventTx(exec, event)
+}
+
+func scanScheduledChange(rows *sql.Rows) (ScheduledChange, error) {
+	var change ScheduledChange
+	var role, note, result, lastError, zedtoken, cancelledBy sql.NullString
+	var expiresAt, appliedAt, cancelledAt sql.NullTime
+	var runAt, createdAt time.Time
+	err := rows.Scan(&change.ID, &change.GroupUsername, &change.Action, &change.Type, &change.Username, &role,
+		&expiresAt, &note, &runAt, &change.Status, &change.Attempts, &result, &lastError, &zedtoken,
+		&change.CreatedBy, &createdAt, &appliedAt, &cancelledBy, &cancelledAt)
+	if err != nil {
+		return change, err
+	}
+
+	change.Role = role.String
+	change.ExpiresAt = formatExpiry(expiresAt)
+	change.Note = note.String
+	change.RunAt = runAt.UTC().Format(time.RFC3339)
+	change.Result = result.String
+	change.LastError = lastError.String
+	change.Zedtoken = zedtoken.String
+	change.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	if appliedAt.Valid {
+		change.AppliedAt = appliedAt.Time.Format("2006-01-02 15:04:05")
+	}
+	change.CancelledBy = cancelledBy.String
+	if cancelledAt.Valid {
+		change.CancelledAt = cancelledAt.Time.Format("2006-01-02 15:04:05")
+	}
+	return change, nil
+}
+
+const scheduledChangeColumns = `id, group_username, action, subject_type, subject_id, role, expires_at, note, run_at, status,
+	attempts, result, last_error, zedtoken, created_by, created_at, applied_at, cancelled_by, cancelled_at`
+
+// List a group's scheduled changes, optionally only those with ?status=
+func getScheduledChanges(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	// Scheduling is another way of changing membership, so it takes the same permission
+	if !checkPrincipalPermission(c, groupUsername, "add_member") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", "PENDING", "APPLIED", "FAILED", "CANCELLED":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status. Must be PENDING, APPLIED, FAILED, or CANCELLED"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+scheduledChangeColumns+`
+		FROM scheduled_membership_changes
+		WHERE group_username = $1 AND ($2 = '' OR status = $2)
+		ORDER BY run_at, id
+	`, groupUsername, status)
+	if err != nil {
+		log.Printf("Failed to fetch scheduled changes for group %s: %v", groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scheduled changes"})
+		return
+	}
+	defer rows.Close()
+
+	changes := []ScheduledChange{}
+	for rows.Next() {
+		change, err := scanScheduledChange(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan scheduled change"})
+			return
+		}
+		changes = append(changes, change)
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
+
+// Schedule an add, removal or role change. The subject is checked when the
+// change runs rather than now, so a new hire can be added before their
+// account exists.
+func scheduleMembershipChange(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	if !checkPrincipalPermission(c, groupUsername, "add_member") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	type ScheduleChangeRequest struct {
+		Action    string `json:"action" binding:"required"`
+		Username  string `json:"username" binding:"required"`
+		Type      string `json:"type"`
+		Role      string `json:"role"`
+		RunAt     string `json:"run_at" binding:"required"`
+		ExpiresAt string `json:"expires_at"`
+		Note      string `json:"note"`
+	}
+
+	var req ScheduleChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch req.Action {
+	case "ADD", "CHANGE_ROLE":
+		if req.Role != "OWNER" && req.Role != "MANAGER" && req.Role != "MEMBER" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role. Must be OWNER, MANAGER, or MEMBER"})
+			return
+		}
+	case "REMOVE":
+		if req.Role != "" || req.ExpiresAt != "" || req.Note != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "REMOVE takes no role, expires_at or note"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid action. Must be ADD, REMOVE, or CHANGE_ROLE"})
+		return
+	}
+
+	switch req.Type {
+	case "":
+		req.Type = "user"
+	case "user", "service_account":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type. Must be user or service_account"})
+		return
+	}
+
+	runAt, err := parseExportTime(req.RunAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run_at. Use YYYY-MM-DD or RFC 3339"})
+		return
+	}
+	if !runAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "run_at must be in the future"})
+		return
+	}
+
+	var expiresAt sql.NullTime
+	if req.ExpiresAt != "" {
+		if req.Role != "MEMBER" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only MEMBER memberships can expire"})
+			return
+		}
+		t, err := parseExpiry(req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !t.After(runAt) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be after run_at"})
+			return
+		}
+		expiresAt = sql.NullTime{Time: t, Valid: true}
+	}
+
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM groups WHERE username = $1)", groupUsername).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check group existence"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	createdBy := currentPrincipal(c).Actor()
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule change"})
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		INSERT INTO scheduled_membership_changes
+			(group_username, action, subject_type, subject_id, role, expires_at, note, run_at, next_attempt_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8, $9)
+		RETURNING `+scheduledChangeColumns,
+		groupUsername, req.Action, req.Type, req.Username, nullString(req.Role), expiresAt, nullString(req.Note), runAt, createdBy)
+	if err != nil {
+		log.Printf("Failed to schedule %s of %s %s in group %s: %v", req.Action, req.Type, req.Username, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule change"})
+		return
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule change"})
+		return
+	}
+	change, err := scanScheduledChange(rows)
+	rows.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan scheduled change"})
+		return
+	}
+
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:        "member.change_scheduled",
+		GroupUsername: groupUsername,
+		Subject:       req.Username,
+		After:         change,
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to schedule %s of %s %s in group %s: %v", req.Action, req.Type, req.Username, groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule change"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, change)
+}
+
+// Cancel a change that hasn't run yet
+func cancelScheduledChange(c *gin.Context) {
+	groupUsername := c.Param("username")
+
+	if !checkPrincipalPermission(c, groupUsername, "add_member") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled change not found"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled change"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Waits out the scheduler if it is applying this change right now
+	rows, err := tx.Query(`
+		UPDATE scheduled_membership_changes
+		SET status = 'CANCELLED', cancelled_by = $3, cancelled_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND group_username = $2 AND status = 'PENDING'
+		RETURNING `+scheduledChangeColumns,
+		id, groupUsername, currentPrincipal(c).Actor())
+	if err != nil {
+		log.Printf("Failed to cancel scheduled change %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled change"})
+		return
+	}
+
+	if !rows.Next() {
+		rows.Close()
+		var status string
+		err := db.QueryRow(`
+			SELECT status FROM scheduled_membership_changes WHERE id = $1 AND group_username = $2
+		`, id, groupUsername).Scan(&status)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled change not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled change"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Scheduled change is already %s", status)})
+		return
+	}
+	change, err := scanScheduledChange(rows)
+	rows.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan scheduled change"})
+		return
+	}
+
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:        "member.change_cancelled",
+		GroupUsername: groupUsername,
+		Subject:       change.Username,
+		Before:        gin.H{"scheduled_change": change.ID, "action": change.Action, "role": change.Role, "run_at": change.RunAt},
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to cancel scheduled change %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled change"})
+		return
+	}
+
+	c.JSON(http.StatusOK, change)
+}
@@ -23,9 +23,368 @@ CREATE TABLE IF NOT EXISTS messages (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Message retention per group
+-- Groups under legal hold are never purged, whatever their policy
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS retention_policy VARCHAR(20) NOT NULL DEFAULT 'FOREVER' CHECK (retention_policy IN ('FOREVER', 'DAYS', 'COUNT'));
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS retention_value INTEGER;
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS legal_hold BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Number of SpiceDB writes recorded against the group's zedtoken; only ever increases
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS zedtoken_seq BIGINT NOT NULL DEFAULT 0;
+
+-- Mail threading for messages received through the SMTP listener
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS message_id VARCHAR(998);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS in_reply_to VARCHAR(998);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_id INTEGER;
+
 -- Indexes for better performance
 CREATE INDEX IF NOT EXISTS idx_messages_group_username ON messages(group_username);
 CREATE INDEX IF NOT EXISTS idx_messages_sender_username ON messages(sender_username);
+CREATE INDEX IF NOT EXISTS idx_messages_message_id ON messages(group_username, message_id);
+CREATE INDEX IF NOT EXISTS idx_messages_thread_id ON messages(thread_id);
+
+-- Extra email addresses for groups
+-- Aliases share a namespace with group usernames and system users
+CREATE TABLE IF NOT EXISTS group_aliases (
+    alias VARCHAR(100) PRIMARY KEY,
+    group_username VARCHAR(100) NOT NULL REFERENCES groups(username) ON DELETE CASCADE,
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_aliases_group_username ON group_aliases(group_username);
+
+-- Per-member delivery preferences for group mail
+-- Members without a row receive every message
+CREATE TABLE IF NOT EXISTS delivery_preferences (
+    group_username VARCHAR(100) REFERENCES groups(username) ON DELETE CASCADE,
+    username VARCHAR(100) NOT NULL,
+    mode VARCHAR(20) NOT NULL DEFAULT 'EVERY' CHECK (mode IN ('EVERY', 'DIGEST', 'NONE')),
+    digest_frequency VARCHAR(20) NOT NULL DEFAULT 'DAILY' CHECK (digest_frequency IN ('DAILY', 'WEEKLY')),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_username, username)
+);
+
+-- Outbound delivery state of each group message, one row per recipient
+CREATE TABLE IF NOT EXISTS message_deliveries (
+    id SERIAL PRIMARY KEY,
+    message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    recipient_username VARCHAR(100) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SENT', 'FAILED', 'DIGEST', 'SKIPPED')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    delivered_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (message_id, recipient_username)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_deliveries_pending ON message_deliveries(next_attempt_at) WHERE status = 'PENDING';
+CREATE INDEX IF NOT EXISTS idx_message_deliveries_digest ON message_deliveries(recipient_username) WHERE status = 'DIGEST';
+
+-- Messages whose delivery rows haven't been created yet, queued in the transaction that stores
+-- the message so a failed member lookup is retried instead of the post never reaching anyone
+CREATE TABLE IF NOT EXISTS message_fanouts (
+    message_id INTEGER PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_fanouts_next_attempt ON message_fanouts(next_attempt_at);
+
+-- Digest emails sent to members, one row per recipient and period
+-- A run is marked SENDING before it goes to the relay and SENT right after, each in its own
+-- statement, so a restart only retries runs that were in flight when it stopped
+CREATE TABLE IF NOT EXISTS digest_runs (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(100) NOT NULL,
+    frequency VARCHAR(20) NOT NULL CHECK (frequency IN ('DAILY', 'WEEKLY')),
+    period_start TIMESTAMP NOT NULL,
+    period_end TIMESTAMP NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SENT', 'EMPTY', 'FAILED')),
+    message_count INTEGER NOT NULL DEFAULT 0,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    sent_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (username, frequency, period_start)
+);
+
+-- Append-only audit log of changes made through the service
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    actor VARCHAR(100) NOT NULL,
+    action VARCHAR(100) NOT NULL,
+    group_username VARCHAR(100),
+    subject VARCHAR(100),
+    before_state JSONB,
+    after_state JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Platform admin behind an impersonated request, if any
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS impersonated_by VARCHAR(100);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_group_username ON audit_events(group_username);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+
+-- Write that produced a membership change, and the API request behind an event
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS zedtoken VARCHAR(255);
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS request_id VARCHAR(100);
+
+-- Outbox entry for changes audited in the same transaction that queues their
+-- SpiceDB write; the zedtoken is read from it once applied
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS outbox_id BIGINT;
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events(actor);
+CREATE INDEX IF NOT EXISTS idx_audit_events_subject ON audit_events(subject);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action);
+
+-- The audit log is append-only
+CREATE OR REPLACE FUNCTION reject_audit_event_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION reject_audit_event_change();
+
+-- Service accounts for other services and automation
+-- Ownership and group access live in SpiceDB like any other subject
+CREATE TABLE IF NOT EXISTS service_accounts (
+    name VARCHAR(100) PRIMARY KEY,
+    description TEXT,
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- API keys issued to service accounts; only a SHA-256 hash of each key is stored
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    service_account VARCHAR(100) NOT NULL REFERENCES service_accounts(name) ON DELETE CASCADE,
+    key_prefix VARCHAR(20) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_service_account ON api_keys(service_account);
+
+-- Relationship changes waiting to be applied to SpiceDB
+-- Written in the same transaction as the group change they belong to and applied in order per group
+CREATE TABLE IF NOT EXISTS spicedb_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    group_username VARCHAR(100) NOT NULL,
+    operation VARCHAR(20) NOT NULL CHECK (operation IN ('TOUCH', 'DELETE', 'DELETE_GROUP')),
+    relation VARCHAR(100),
+    subject_type VARCHAR(100),
+    subject_id VARCHAR(100),
+    subject_relation VARCHAR(100),
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'APPLIED')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    zedtoken VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    applied_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_spicedb_outbox_pending ON spicedb_outbox(group_username, id) WHERE status = 'PENDING';
+
+-- Last SpiceDB revision processed by each Watch consumer
+CREATE TABLE IF NOT EXISTS watch_checkpoints (
+    consumer VARCHAR(100) PRIMARY KEY,
+    zedtoken VARCHAR(255) NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Changes to groups, streamed live to clients
+-- Membership changes (member.added, member.removed, role.changed) come from the SpiceDB Watch API,
+-- including writes made outside this service; group.* and message.created events are recorded by the handlers
+CREATE TABLE IF NOT EXISTS group_events (
+    id BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR(50) NOT NULL,
+    group_username VARCHAR(100) NOT NULL,
+    subject_type VARCHAR(100),
+    subject_id VARCHAR(100),
+    subject_relation VARCHAR(100),
+    role VARCHAR(20),
+    previous_role VARCHAR(20),
+    zedtoken VARCHAR(255),
+    actor VARCHAR(100),
+    payload JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_events_group_username ON group_events(group_username, id);
+
+-- The transaction that wrote each event. IDs are taken before commit, so readers
+-- follow (xid, id) below the snapshot xmin rather than the ID alone
+ALTER TABLE group_events ADD COLUMN IF NOT EXISTS xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+CREATE INDEX IF NOT EXISTS idx_group_events_xid ON group_events(xid, id);
+
+-- How far each consumer of group_events has read
+CREATE TABLE IF NOT EXISTS event_cursors (
+    consumer VARCHAR(100) PRIMARY KEY,
+    last_event_id BIGINT NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Outgoing webhook subscriptions, for one group or for every group when group_username is NULL
+-- The secret is kept in full because it signs every payload
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    group_username VARCHAR(100),
+    url TEXT NOT NULL,
+    event_types TEXT[] NOT NULL,
+    secret VARCHAR(100) NOT NULL,
+    secret_prefix VARCHAR(20) NOT NULL,
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_subscriptions_group_username ON webhook_subscriptions(group_username);
+
+-- A group's subscriptions are retired when the group is deleted: they still get
+-- the group's events up to and including group.deleted, but not those of a new
+-- group created under the same username
+ALTER TABLE webhook_subscriptions ADD COLUMN IF NOT EXISTS retired_after_event_id BIGINT;
+ALTER TABLE webhook_subscriptions ADD COLUMN IF NOT EXISTS retired_at TIMESTAMP;
+
+-- Delivery state of each event sent to each subscription; DEAD deliveries ran out of attempts
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+    event_id BIGINT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    group_username VARCHAR(100) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'SENT', 'DEAD')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_status_code INTEGER,
+    last_error TEXT,
+    delivered_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (subscription_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries(next_attempt_at) WHERE status = 'PENDING';
+
+-- Who added each group relationship and when; SpiceDB relationships carry no metadata.
+-- Kept in step with SpiceDB by the handlers, the Watch consumer and the reconciler.
+CREATE TABLE IF NOT EXISTS membership_metadata (
+    group_username VARCHAR(100) NOT NULL REFERENCES groups(username) ON DELETE CASCADE,
+    subject_type VARCHAR(50) NOT NULL,
+    subject_id VARCHAR(100) NOT NULL,
+    relation VARCHAR(50) NOT NULL,
+    added_by VARCHAR(100),
+    note TEXT,
+    joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_username, subject_type, subject_id, relation)
+);
+
+-- History of group relationships, built by the Watch consumer, for point-in-time membership queries.
+-- Kept after a group is deleted. Backfilled intervals were already open when the history was (re)started.
+CREATE TABLE IF NOT EXISTS membership_intervals (
+    id BIGSERIAL PRIMARY KEY,
+    group_username VARCHAR(100) NOT NULL,
+    subject_type VARCHAR(50) NOT NULL,
+    subject_id VARCHAR(100) NOT NULL,
+    relation VARCHAR(50) NOT NULL,
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    started_zedtoken VARCHAR(255),
+    backfilled BOOLEAN NOT NULL DEFAULT FALSE,
+    ended_at TIMESTAMP,
+    ended_zedtoken VARCHAR(255)
+);
+
+CREATE INDEX IF NOT EXISTS idx_membership_intervals_group ON membership_intervals(group_username, started_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_membership_intervals_open
+    ON membership_intervals(group_username, subject_type, subject_id, relation) WHERE ended_at IS NULL;
+
+-- Intervals are timed by the write behind each change, found by its zedtoken.
+-- Times the consumer had to take when it saw the change are marked approximate,
+-- as are all those recorded before this column existed.
+ALTER TABLE membership_intervals ADD COLUMN IF NOT EXISTS started_approximate BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE membership_intervals ADD COLUMN IF NOT EXISTS ended_approximate BOOLEAN NOT NULL DEFAULT TRUE;
+CREATE INDEX IF NOT EXISTS idx_spicedb_outbox_zedtoken ON spicedb_outbox(zedtoken) WHERE zedtoken IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_audit_events_zedtoken ON audit_events(zedtoken) WHERE zedtoken IS NOT NULL;
+
+-- Expiring memberships: SpiceDB enforces the expiry through a caveat; this copy drives the
+-- owner notices and the job that removes lapsed relationships
+ALTER TABLE membership_metadata ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+ALTER TABLE membership_metadata ADD COLUMN IF NOT EXISTS expiry_notified_at TIMESTAMP;
+ALTER TABLE spicedb_outbox ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_membership_metadata_expires_at ON membership_metadata(expires_at) WHERE expires_at IS NOT NULL;
+
+-- Membership changes scheduled for a future time, applied by the scheduler in run_at order.
+-- Rows are kept after they run as the record of what happened.
+CREATE TABLE IF NOT EXISTS scheduled_membership_changes (
+    id SERIAL PRIMARY KEY,
+    group_username VARCHAR(100) NOT NULL REFERENCES groups(username) ON DELETE CASCADE,
+    action VARCHAR(20) NOT NULL CHECK (action IN ('ADD', 'REMOVE', 'CHANGE_ROLE')),
+    subject_type VARCHAR(50) NOT NULL,
+    subject_id VARCHAR(100) NOT NULL,
+    role VARCHAR(20),
+    expires_at TIMESTAMP,
+    note TEXT,
+    run_at TIMESTAMP NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'APPLIED', 'FAILED', 'CANCELLED')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    result TEXT,
+    last_error TEXT,
+    zedtoken VARCHAR(255),
+    created_by VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    applied_at TIMESTAMP,
+    cancelled_by VARCHAR(100),
+    cancelled_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_membership_changes_group ON scheduled_membership_changes(group_username, run_at);
+CREATE INDEX IF NOT EXISTS idx_scheduled_membership_changes_due ON scheduled_membership_changes(next_attempt_at) WHERE status = 'PENDING';
+
+-- Break-glass requests from members for temporary admin on a group. Approval writes an
+-- expiring admin relationship that the membership expiry job removes.
+CREATE TABLE IF NOT EXISTS elevation_requests (
+    id SERIAL PRIMARY KEY,
+    group_username VARCHAR(100) NOT NULL REFERENCES groups(username) ON DELETE CASCADE,
+    requester VARCHAR(100) NOT NULL,
+    justification TEXT NOT NULL,
+    duration_hours INTEGER NOT NULL CHECK (duration_hours > 0),
+    status VARCHAR(20) NOT NULL DEFAULT 'PENDING'
+        CHECK (status IN ('PENDING', 'APPROVED', 'DENIED', 'CANCELLED', 'REVOKED', 'EXPIRED')),
+    decided_by VARCHAR(100),
+    decided_at TIMESTAMP,
+    decision_reason TEXT,
+    expires_at TIMESTAMP,
+    zedtoken VARCHAR(255),
+    ended_by VARCHAR(100),
+    ended_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_elevation_requests_group ON elevation_requests(group_username, created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_elevation_requests_open
+    ON elevation_requests(group_username, requester) WHERE status IN ('PENDING', 'APPROVED');
+
+-- Digest runs are leased with SENDING while their email is handed to the relay
+ALTER TABLE digest_runs ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMP;
+ALTER TABLE digest_runs DROP CONSTRAINT IF EXISTS digest_runs_status_check;
+ALTER TABLE digest_runs ADD CONSTRAINT digest_runs_status_check
+    CHECK (status IN ('PENDING', 'SENDING', 'SENT', 'EMPTY', 'FAILED'));
 
 -- Insert some sample data
 -- Note: Group membership/ownership will be managed via SpiceDB relationships
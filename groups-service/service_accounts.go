@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	apiKeyPrefix         = "gsk_"
+	defaultAPIKeyTTLDays = 90
+	maxAPIKeyTTLDays     = 365
+)
+
+// API key scopes: read covers GET requests, write covers everything else, and
+// resolve_recipients lets a mail system expand group addresses on behalf of a
+// named sender with POST /resolve-recipients
+var validAPIKeyScopes = map[string]bool{"read": true, "write": true, resolveRecipientsScope: true}
+
+const resolveRecipientsScope = "resolve_recipients"
+
+type ServiceAccount struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	CreatedBy   string `json:"created_by"`
+	CreatedAt   string `json:"created_at"`
+}
+
+type APIKey struct {
+	ID             int      `json:"id"`
+	ServiceAccount string   `json:"service_account"`
+	Prefix         string   `json:"prefix"`
+	Scopes         []string `json:"scopes"`
+	ExpiresAt      string   `json:"expires_at"`
+	CreatedBy      string   `json:"created_by"`
+	CreatedAt      string   `json:"created_at"`
+	LastUsedAt     string   `json:"last_used_at,omitempty"`
+	RevokedAt      string   `json:"revoked_at,omitempty"`
+	Key            string   `json:"key,omitempty"`
+}
+
+// Helper function to check if a service account exists
+func serviceAccountExists(name string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM service_accounts WHERE name = $1)", name).Scan(&exists)
+	return exists, err
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Check whether a user may manage a service account and its keys
+func checkServiceAccountPermission(username string, name string, permission string) bool {
+	request := &v1.CheckPermissionRequest{
+		Resource: &v1.ObjectReference{
+			ObjectType: "service_account",
+			ObjectId:   name,
+		},
+		Permission: permission,
+		Subject: &v1.SubjectReference{
+			Object: &v1.ObjectReference{
+				ObjectType: "user",
+				ObjectId:   username,
+			},
+		},
+		Consistency: &v1.Consistency{
+			Requirement: &v1.Consistency_FullyConsistent{
+				FullyConsistent: true,
+			},
+		},
+	}
+
+	log.Printf("[SPICEDB] operation=CheckPermission resource_type=service_account resource_id=%s permission=%s subject_type=user subject_id=%s",
+		name, permission, username)
+
+	resp, err := spicedbClient.CheckPermission(context.Background(), request)
+	if err != nil {
+		log.Printf("[SPICEDB] operation=CheckPermission status=ERROR error=%v", err)
+		return false
+	}
+
+	log.Printf("[SPICEDB] operation=CheckPermission status=SUCCESS permissionship=%s", resp.Permissionship.String())
+	return resp.Permissionship == v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
+}
+
+// Record the owner of a service account in SpiceDB, returning the zedtoken of the write
+func addServiceAccountOwner(name string, owner string) (string, error) {
+	request := &v1.WriteRelationshipsRequest{
+		Updates: []*v1.RelationshipUpdate{
+			{
+				Operation: v1.RelationshipUpdate_OPERATION_TOUCH,
+				Relationship: &v1.Relationship{
+					Resource: &v1.ObjectReference{
+						ObjectType: "service_account",
+						ObjectId:   name,
+					},
+					Relation: "owner",
+					Subject: &v1.SubjectReference{
+						Object: &v1.ObjectReference{
+							ObjectType: "user",
+							ObjectId:   owner,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	log.Printf("[SPICEDB] operation=WriteRelationships action=TOUCH resource_type=service_account resource_id=%s relation=owner subject_type=user subject_id=%s",
+		name, owner)
+
+	resp, err := spicedbClient.WriteRelationships(context.Background(), request)
+	if err != nil {
+		log.Printf("[SPICEDB] operation=WriteRelationships status=ERROR error=%v", err)
+		return "", err
+	}
+
+	log.Printf("[SPICEDB] operation=WriteRelationships status=SUCCESS written_at=%s", resp.WrittenAt.Token)
+	return resp.WrittenAt.Token, nil
+}
+
+// Authenticate a service account API key
+func authenticateAPIKey(key string) (*Principal, error) {
+	var id int
+	var name string
+	var scopes []string
+	var expiresAt time.Time
+	var revokedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, service_account, scopes, expires_at, revoked_at
+		FROM api_keys
+		WHERE key_hash = $1
+	`, hashAPIKey(key)).Scan(&id, &name, pq.Array(&scopes), &expiresAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("unknown API key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAPIKeyValidity(revokedAt, expiresAt, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1", id); err != nil {
+		log.Printf("Failed to record use of API key %d: %v", id, err)
+	}
+
+	return &Principal{Type: "service_account", ID: name, Method: "api_key", Scopes: scopes}, nil
+}
+
+// Check that a key found by its hash hasn't been revoked or expired
+func checkAPIKeyValidity(revokedAt sql.NullTime, expiresAt time.Time, now time.Time) error {
+	if revokedAt.Valid {
+		return errors.New("API key has been revoked")
+	}
+	if now.After(expiresAt) {
+		return errors.New("API key has expired")
+	}
+	return nil
+}
+
+// Generate a new API key and the prefix stored to identify it in listings
+func generateAPIKey() (string, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+	return key, key[:len(apiKeyPrefix)+8], nil
+}
+
+// Check that an API key's scopes cover the request
+func apiKeyAllowsRequest(principal *Principal, method string, path string) bool {
+	if path == "/resolve-recipients" && principal.hasScope(resolveRecipientsScope) {
+		return true
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return principal.hasScope("read")
+	}
+	return principal.hasScope("write")
+}
+
+func (p *Principal) hasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func createServiceAccount(c *gin.Context) {
+	// Service accounts are created by people, not by other service accounts
+	username := currentUsername(c)
+	if username == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	type CreateServiceAccountRequest struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+	}
+
+	var req CreateServiceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.Name = strings.ToLower(strings.TrimSpace(req.Name))
+	if req.Name == "" || strings.ContainsAny(req.Name, "@:/ \t") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service account name"})
+		return
+	}
+	if isSystemUser(req.Name) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Name '%s' conflicts with an existing user", req.Name)})
+		return
+	}
+
+	exists, err := serviceAccountExists(req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check service account existence"})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Service account '%s' already exists", req.Name)})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service account"})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO service_accounts (name, description, created_by)
+		VALUES ($1, $2, $3)
+	`, req.Name, req.Description, username)
+	if err != nil {
+		log.Printf("Failed to create service account %s: %v", req.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service account"})
+		return
+	}
+
+	// The creator owns the service account and may issue its keys. The row is
+	// only committed, with its audit event, once the owner is written.
+	zedtoken, err := addServiceAccountOwner(req.Name, username)
+	if err != nil {
+		log.Printf("Failed to add SpiceDB owner for service account %s: %v", req.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service account"})
+		return
+	}
+
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:   "service_account.created",
+		Subject:  req.Name,
+		After:    gin.H{"name": req.Name, "description": req.Description, "owner": username},
+		Zedtoken: zedtoken,
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to create service account %s: %v", req.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service account"})
+		return
+	}
+	setZedtokenHeader(c, zedtoken)
+
+	log.Printf("Service account %s created by %s", req.Name, username)
+	c.JSON(http.StatusCreated, ServiceAccount{
+		Name:        req.Name,
+		Description: req.Description,
+		CreatedBy:   username,
+		CreatedAt:   time.Now().Format("2006-01-02 15:04:05"),
+	})
+}
+
+func getServiceAccounts(c *gin.Context) {
+	username := currentUsername(c)
+	if username == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT name, COALESCE(description, ''), created_by, created_at
+		FROM service_accounts
+		ORDER BY name
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch service accounts"})
+		return
+	}
+	defer rows.Close()
+
+	var all []ServiceAccount
+	for rows.Next() {
+		var account ServiceAccount
+		var createdAt time.Time
+		if err := rows.Scan(&account.Name, &account.Description, &account.CreatedBy, &createdAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan service account"})
+			return
+		}
+		account.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		all = append(all, account)
+	}
+	rows.Close()
+
+	// Only list the service accounts the caller manages
+	accounts := []ServiceAccount{}
+	for _, account := range all {
+		if checkServiceAccountPermission(username, account.Name, "manage") {
+			accounts = append(accounts, account)
+		}
+	}
+
+	c.JSON(http.StatusOK, accounts)
+}
+
+func createAPIKey(c *gin.Context) {
+	name := c.Param("name")
+
+	username := currentUsername(c)
+	if username == "" || !checkServiceAccountPermission(username, name, "manage") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	type CreateAPIKeyRequest struct {
+		Scopes        []string `json:"scopes" binding:"required"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validAPIKeyScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid scope '%s'. Must be read, write or resolve_recipients", scope)})
+			return
+		}
+	}
+
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultAPIKeyTTLDays
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPIKeyTTLDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in_days must be between 1 and %d", maxAPIKeyTTLDays)})
+		return
+	}
+
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+	expiresAt := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO api_keys (service_account, key_prefix, key_hash, scopes, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, name, prefix, hashAPIKey(key), pq.Array(req.Scopes), expiresAt, username).Scan(&id)
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:  "api_key.created",
+			Subject: name,
+			After:   gin.H{"id": id, "prefix": prefix, "scopes": req.Scopes, "expires_at": expiresAt.Format("2006-01-02 15:04:05")},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to create API key for service account %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	log.Printf("API key %d (%s) issued for service account %s by %s", id, prefix, name, username)
+
+	// The key itself is only ever returned here
+	c.JSON(http.StatusCreated, APIKey{
+		ID:             id,
+		ServiceAccount: name,
+		Prefix:         prefix,
+		Scopes:         req.Scopes,
+		ExpiresAt:      expiresAt.Format("2006-01-02 15:04:05"),
+		CreatedBy:      username,
+		CreatedAt:      time.Now().Format("2006-01-02 15:04:05"),
+		Key:            key,
+	})
+}
+
+func getAPIKeys(c *gin.Context) {
+	name := c.Param("name")
+
+	username := currentUsername(c)
+	if username == "" || !checkServiceAccountPermission(username, name, "manage") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, key_prefix, scopes, expires_at, created_by, created_at, last_used_at, revoked_at
+		FROM api_keys
+		WHERE service_account = $1
+		ORDER BY created_at DESC
+	`, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key := APIKey{ServiceAccount: name}
+		var expiresAt, createdAt time.Time
+		var lastUsedAt, revokedAt sql.NullTime
+		err := rows.Scan(&key.ID, &key.Prefix, pq.Array(&key.Scopes), &expiresAt, &key.CreatedBy, &createdAt, &lastUsedAt, &revokedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan API key"})
+			return
+		}
+		key.ExpiresAt = expiresAt.Format("2006-01-02 15:04:05")
+		key.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		if lastUsedAt.Valid {
+			key.LastUsedAt = lastUsedAt.Time.Format("2006-01-02 15:04:05")
+		}
+		if revokedAt.Valid {
+			key.RevokedAt = revokedAt.Time.Format("2006-01-02 15:04:05")
+		}
+		keys = append(keys, key)
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func revokeAPIKey(c *gin.Context) {
+	name := c.Param("name")
+
+	username := currentUsername(c)
+	if username == "" || !checkServiceAccountPermission(username, name, "manage") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key id"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND service_account = $2 AND revoked_at IS NULL
+	`, id, name)
+	if err != nil {
+		log.Printf("Failed to revoke API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:  "api_key.revoked",
+		Subject: name,
+		Before:  gin.H{"id": id},
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to revoke API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	log.Printf("API key %d for service account %s revoked by %s", id, name, username)
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully"})
+}
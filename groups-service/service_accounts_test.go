@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		t.Fatalf("generateAPIKey: %v", err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(key) != len(apiKeyPrefix)+48 {
+		t.Errorf("Key %q is not %s followed by 48 hex characters", key, apiKeyPrefix)
+	}
+	if prefix != key[:len(apiKeyPrefix)+8] {
+		t.Errorf("Prefix = %q, want the first %d characters of %q", prefix, len(apiKeyPrefix)+8, key)
+	}
+
+	other, _, err := generateAPIKey()
+	if err != nil {
+		t.Fatalf("generateAPIKey: %v", err)
+	}
+	if other == key {
+		t.Error("Two generated keys are the same")
+	}
+}
+
+func TestHashAPIKey(t *testing.T) {
+	hash := hashAPIKey("gsk_0123456789abcdef")
+	if len(hash) != 64 || strings.Trim(hash, "0123456789abcdef") != "" {
+		t.Errorf("Hash %q is not 64 lowercase hex characters", hash)
+	}
+	if hashAPIKey("gsk_0123456789abcdef") != hash {
+		t.Error("Hash is not deterministic")
+	}
+	if hashAPIKey("gsk_0123456789abcdeF") == hash {
+		t.Error("Keys differing in case hash the same")
+	}
+}
+
+func TestCheckAPIKeyValidity(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	revoked := sql.NullTime{Time: now.Add(-time.Hour), Valid: true}
+
+	tests := []struct {
+		name      string
+		revokedAt sql.NullTime
+		expiresAt time.Time
+		wantErr   string
+	}{
+		{"valid", sql.NullTime{}, now.Add(time.Hour), ""},
+		{"expires this instant", sql.NullTime{}, now, ""},
+		{"expired", sql.NullTime{}, now.Add(-time.Second), "expired"},
+		{"revoked", revoked, now.Add(time.Hour), "revoked"},
+		{"revoked and expired", revoked, now.Add(-time.Hour), "revoked"},
+	}
+
+	for _, tt := range tests {
+		err := checkAPIKeyValidity(tt.revokedAt, tt.expiresAt, now)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAPIKeyAllowsRequest(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		method string
+		path   string
+		want   bool
+	}{
+		{[]string{"read"}, http.MethodGet, "/groups", true},
+		{[]string{"read"}, http.MethodHead, "/groups", true},
+		{[]string{"read"}, http.MethodPost, "/groups", false},
+		{[]string{"read"}, http.MethodDelete, "/groups/eng/members/tkim", false},
+		{[]string{"write"}, http.MethodGet, "/groups", false},
+		{[]string{"write"}, http.MethodPost, "/groups", true},
+		{[]string{"write"}, http.MethodPatch, "/groups/eng/members/tkim", true},
+		{[]string{"read", "write"}, http.MethodGet, "/groups", true},
+		{[]string{"read", "write"}, http.MethodPut, "/groups/eng", true},
+		{[]string{resolveRecipientsScope}, http.MethodPost, "/resolve-recipients", true},
+		{[]string{resolveRecipientsScope}, http.MethodPost, "/groups", false},
+		{[]string{resolveRecipientsScope}, http.MethodGet, "/groups", false},
+		{[]string{"read"}, http.MethodPost, "/resolve-recipients", false},
+		{[]string{"write"}, http.MethodPost, "/resolve-recipients", true},
+		{nil, http.MethodGet, "/groups", false},
+		{[]string{"admin"}, http.MethodPost, "/groups", false},
+	}
+
+	for _, tt := range tests {
+		principal := &Principal{Type: "service_account", ID: "ci", Method: "api_key", Scopes: tt.scopes}
+		if got := apiKeyAllowsRequest(principal, tt.method, tt.path); got != tt.want {
+			t.Errorf("Scopes %v, %s %s: allowed = %v, want %v", tt.scopes, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+// Look keys up in Postgres and run them through the auth middleware: unknown,
+// revoked and expired keys are rejected, and a valid key is held to its scopes
+func TestAuthenticateAPIKey(t *testing.T) {
+	openTestDB(t)
+	gin.SetMode(gin.TestMode)
+
+	account := fmt.Sprintf("api-key-test-%d", os.Getpid())
+	if _, err := db.Exec(`INSERT INTO service_accounts (name, created_by) VALUES ($1, 'achen')`, account); err != nil {
+		t.Fatalf("Failed to create service account: %v", err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM service_accounts WHERE name = $1`, account) })
+
+	issue := func(scopes []string, expiresAt time.Time, revoked bool) string {
+		t.Helper()
+		key, prefix, err := generateAPIKey()
+		if err != nil {
+			t.Fatalf("generateAPIKey: %v", err)
+		}
+		var revokedAt sql.NullTime
+		if revoked {
+			revokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+		_, err = db.Exec(`
+			INSERT INTO api_keys (service_account, key_prefix, key_hash, scopes, expires_at, created_by, revoked_at)
+			VALUES ($1, $2, $3, $4, $5, 'achen', $6)
+		`, account, prefix, hashAPIKey(key), pq.Array(scopes), expiresAt, revokedAt)
+		if err != nil {
+			t.Fatalf("Failed to insert API key: %v", err)
+		}
+		return key
+	}
+
+	readKey := issue([]string{"read"}, time.Now().Add(time.Hour), false)
+	expiredKey := issue([]string{"read", "write"}, time.Now().Add(-time.Minute), false)
+	revokedKey := issue([]string{"read", "write"}, time.Now().Add(time.Hour), true)
+
+	router := gin.New()
+	router.Use(authMiddleware())
+	handler := func(c *gin.Context) { c.JSON(http.StatusOK, currentPrincipal(c)) }
+	router.GET("/groups", handler)
+	router.POST("/groups", handler)
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		value  string
+		want   int
+	}{
+		{"valid key in X-API-Key", http.MethodGet, "X-API-Key", readKey, http.StatusOK},
+		{"valid key as bearer token", http.MethodGet, "Authorization", "Bearer " + readKey, http.StatusOK},
+		{"out of scope", http.MethodPost, "X-API-Key", readKey, http.StatusForbidden},
+		{"expired", http.MethodGet, "X-API-Key", expiredKey, http.StatusUnauthorized},
+		{"revoked", http.MethodGet, "X-API-Key", revokedKey, http.StatusUnauthorized},
+		{"unknown", http.MethodGet, "X-API-Key", apiKeyPrefix + strings.Repeat("0", 48), http.StatusUnauthorized},
+		{"prefix only", http.MethodGet, "X-API-Key", readKey[:len(apiKeyPrefix)+8], http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/groups", nil)
+			req.Header.Set(tt.header, tt.value)
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("Status = %d, want %d (body %s)", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	var lastUsed sql.NullTime
+	if err := db.QueryRow(`SELECT last_used_at FROM api_keys WHERE key_hash = $1`, hashAPIKey(readKey)).Scan(&lastUsed); err != nil {
+		t.Fatalf("Failed to read last_used_at: %v", err)
+	}
+	if !lastUsed.Valid {
+		t.Error("Use of a valid key was not recorded")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	smtpMaxMessageBytes = 10 << 20
+	smtpMaxRecipients   = 100
+	smtpIdleTimeout     = 5 * time.Minute
+)
+
+// Start the optional inbound SMTP listener. Mail addressed to a group (or one
+// of its aliases) is stored in the group's archive when the envelope sender is
+// a system user allowed to post to that group.
+func startSMTPServer() {
+	addr := os.Getenv("SMTP_LISTEN_ADDR")
+	if addr == "" {
+		log.Println("SMTP listener disabled (set SMTP_LISTEN_ADDR to enable)")
+		return
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to start SMTP listener on %s: %v", addr, err)
+	}
+	log.Printf("SMTP listener accepting mail for @%s on %s", emailDomain, addr)
+
+	go func() {
+		var backoff time.Duration
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					log.Printf("[SMTP] listener closed")
+					return
+				}
+				// Back off on persistent errors such as running out of file descriptors
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				log.Printf("[SMTP] accept error: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			backoff = 0
+			go handleSMTPConnection(conn)
+		}
+	}()
+}
+
+type smtpSession struct {
+	conn       net.Conn
+	text       *textproto.Conn
+	remote     string
+	sender     string
+	recipients []string
+}
+
+func (s *smtpSession) reply(code int, format string, args ...interface{}) {
+	s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (s *smtpSession) reset() {
+	s.sender = ""
+	s.recipients = nil
+}
+
+func handleSMTPConnection(conn net.Conn) {
+	defer conn.Close()
+
+	s := &smtpSession{
+		conn:   conn,
+		text:   textproto.NewConn(conn),
+		remote: conn.RemoteAddr().String(),
+	}
+	log.Printf("[SMTP] connection opened remote=%s", s.remote)
+
+	s.reply(220, "%s groups-service ESMTP ready", emailDomain)
+	for {
+		conn.SetDeadline(time.Now().Add(smtpIdleTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[SMTP] read error remote=%s error=%v", s.remote, err)
+			}
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.reset()
+			s.reply(250, "%s", emailDomain)
+		case "EHLO":
+			s.reset()
+			s.text.PrintfLine("250-%s", emailDomain)
+			s.text.PrintfLine("250-8BITMIME")
+			s.text.PrintfLine("250 SIZE %d", smtpMaxMessageBytes)
+		case "MAIL":
+			s.handleMail(arg)
+		case "RCPT":
+			s.handleRcpt(arg)
+		case "DATA":
+			s.handleData()
+		case "RSET":
+			s.reset()
+			s.reply(250, "2.0.0 OK")
+		case "NOOP":
+			s.reply(250, "2.0.0 OK")
+		case "VRFY":
+			s.reply(252, "2.5.2 Cannot verify user")
+		case "QUIT":
+			s.reply(221, "2.0.0 Bye")
+			return
+		default:
+			s.reply(502, "5.5.2 Command not recognized")
+		}
+	}
+}
+
+// Extract the address from a MAIL FROM:<...> or RCPT TO:<...> argument
+func parsePathArgument(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(path, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(path, '>')
+	if end < 0 {
+		return "", false
+	}
+	return path[1:end], true
+}
+
+func (s *smtpSession) handleMail(arg string) {
+	if s.sender != "" {
+		s.reply(503, "5.5.1 Sender already specified")
+		return
+	}
+	address, ok := parsePathArgument(arg, "FROM:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	// The envelope sender must map to a system user in our domain
+	localPart, domain, err := parseAddress(address)
+	if err != nil || domain != emailDomain || !isSystemUser(localPart) {
+		log.Printf("[SMTP] sender rejected remote=%s sender=%s", s.remote, address)
+		s.reply(550, "5.7.1 Sender <%s> is not a known user", address)
+		return
+	}
+
+	s.sender = localPart
+	s.reply(250, "2.1.0 Sender OK")
+}
+
+func (s *smtpSession) handleRcpt(arg string) {
+	if s.sender == "" {
+		s.reply(503, "5.5.1 Need MAIL before RCPT")
+		return
+	}
+	address, ok := parsePathArgument(arg, "TO:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(s.recipients) >= smtpMaxRecipients {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	localPart, domain, err := parseAddress(address)
+	if err != nil {
+		s.reply(501, "5.1.3 Bad recipient address syntax")
+		return
+	}
+	if domain != emailDomain {
+		s.reply(550, "5.7.1 Relaying to <%s> is not permitted", address)
+		return
+	}
+
+	groupUsername, found, err := lookupGroupByLocalPart(localPart)
+	if err != nil {
+		log.Printf("[SMTP] failed to resolve recipient %s: %v", address, err)
+		s.reply(451, "4.3.0 Temporary failure resolving recipient")
+		return
+	}
+	if !found {
+		s.reply(550, "5.1.1 No such group <%s>", address)
+		return
+	}
+
+	if !checkPermission(s.sender, groupUsername, "post") {
+		log.Printf("[SMTP] recipient rejected remote=%s sender=%s group=%s reason=permission_denied", s.remote, s.sender, groupUsername)
+		s.reply(550, "5.7.1 %s is not allowed to post to <%s>", s.sender, address)
+		return
+	}
+
+	for _, existing := range s.recipients {
+		if existing == groupUsername {
+			s.reply(250, "2.1.5 Recipient OK")
+			return
+		}
+	}
+	s.recipients = append(s.recipients, groupUsername)
+	s.reply(250, "2.1.5 Recipient OK")
+}
+
+func (s *smtpSession) handleData() {
+	if s.sender == "" || len(s.recipients) == 0 {
+		s.reply(503, "5.5.1 Need MAIL and RCPT before DATA")
+		return
+	}
+	s.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+
+	reader := s.text.DotReader()
+	raw, err := io.ReadAll(io.LimitReader(reader, smtpMaxMessageBytes+1))
+	if err != nil {
+		log.Printf("[SMTP] failed to read message data remote=%s error=%v", s.remote, err)
+		s.reply(451, "4.3.0 Failed to read message")
+		s.reset()
+		return
+	}
+	if len(raw) > smtpMaxMessageBytes {
+		// Drain the rest of the message so the session stays in sync
+		io.Copy(io.Discard, reader)
+		s.reply(552, "5.3.4 Message exceeds maximum size")
+		s.reset()
+		return
+	}
+
+	parsed, err := parseInboundMessage(raw)
+	if err != nil {
+		log.Printf("[SMTP] failed to parse message remote=%s error=%v", s.remote, err)
+		s.reply(554, "5.6.0 Malformed message")
+		s.reset()
+		return
+	}
+
+	// All groups or none, so a retry after a 451 doesn't duplicate the message
+	if err := storeGroupMessages(groupMessagesFor(parsed, s.sender, s.recipients)); err != nil {
+		log.Printf("[SMTP] failed to store message for groups %s: %v", strings.Join(s.recipients, ","), err)
+		s.reply(451, "4.3.0 Failed to store message")
+		s.reset()
+		return
+	}
+
+	log.Printf("[SMTP] message accepted remote=%s sender=%s groups=%s", s.remote, s.sender, strings.Join(s.recipients, ","))
+	s.reply(250, "2.0.0 Message accepted")
+	s.reset()
+}
+
+// Make a copy of a parsed message for each group it was addressed to
+func groupMessagesFor(parsed *GroupMessage, sender string, groups []string) []*GroupMessage {
+	var msgs []*GroupMessage
+	for _, groupUsername := range groups {
+		msg := *parsed
+		msg.GroupUsername = groupUsername
+		msg.SenderUsername = sender
+		msgs = append(msgs, &msg)
+	}
+	return msgs
+}
+
+// Parse an RFC 5322 message into the fields stored in the archive
+func parseInboundMessage(raw []byte) (*GroupMessage, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		subject = m.Header.Get("Subject")
+	}
+
+	// Fall back to the last References entry when In-Reply-To is missing
+	inReplyTo := strings.TrimSpace(m.Header.Get("In-Reply-To"))
+	if inReplyTo == "" {
+		if refs := strings.Fields(m.Header.Get("References")); len(refs) > 0 {
+			inReplyTo = refs[len(refs)-1]
+		}
+	}
+
+	body, err := extractTextBody(textproto.MIMEHeader(m.Header), m.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupMessage{
+		Subject:   subject,
+		Body:      body,
+		MessageID: strings.TrimSpace(m.Header.Get("Message-ID")),
+		InReplyTo: inReplyTo,
+	}, nil
+}
+
+// Extract the text/plain body of a message, descending into multipart bodies
+func extractTextBody(header textproto.MIMEHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		var fallback string
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := extractTextBody(part.Header, part)
+			if err != nil {
+				return "", err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if partType == "text/plain" || partType == "" {
+				return text, nil
+			}
+			if fallback == "" {
+				fallback = text
+			}
+		}
+		return fallback, nil
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &crlfStripper{r: bufio.NewReader(body)})
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(string(content), "\r\n", "\n"), nil
+}
+
+// Drops line breaks from base64 encoded bodies
+type crlfStripper struct {
+	r *bufio.Reader
+}
+
+func (c *crlfStripper) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if b == '\r' || b == '\n' {
+			continue
+		}
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
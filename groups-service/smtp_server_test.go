@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func TestParsePathArgument(t *testing.T) {
+	tests := []struct {
+		arg    string
+		prefix string
+		want   string
+		ok     bool
+	}{
+		{"FROM:<achen@company.com>", "FROM:", "achen@company.com", true},
+		{"from: <achen@company.com> SIZE=1024", "FROM:", "achen@company.com", true},
+		{"TO:<eng@company.com>", "TO:", "eng@company.com", true},
+		{"FROM:<>", "FROM:", "", true},
+		{"FROM:achen@company.com", "FROM:", "", false},
+		{"FROM:<achen@company.com", "FROM:", "", false},
+		{"TO:<eng@company.com>", "FROM:", "", false},
+		{"TO", "TO:", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parsePathArgument(tt.arg, tt.prefix)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parsePathArgument(%q, %q) = %q, %v; want %q, %v", tt.arg, tt.prefix, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseInboundMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		subject   string
+		body      string
+		messageID string
+		inReplyTo string
+	}{
+		{
+			name: "plain text",
+			raw: "From: achen@company.com\r\n" +
+				"To: eng@company.com, design@company.com\r\n" +
+				"Subject: Standup moved\r\n" +
+				"Message-ID: <1@company.com>\r\n" +
+				"\r\n" +
+				"Standup is at 10 today.\r\n",
+			subject:   "Standup moved",
+			body:      "Standup is at 10 today.\n",
+			messageID: "<1@company.com>",
+		},
+		{
+			name: "encoded subject and quoted-printable body",
+			raw: "Subject: =?UTF-8?B?Q2Fmw6kgbWVudQ==?=\r\n" +
+				"In-Reply-To: <1@company.com>\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n" +
+				"\r\n" +
+				"Caf=C3=A9 is open=\r\n" +
+				" until 3.\r\n",
+			subject:   "Café menu",
+			body:      "Café is open until 3.\n",
+			inReplyTo: "<1@company.com>",
+		},
+		{
+			name: "reply threaded by References",
+			raw: "Subject: Re: Standup moved\r\n" +
+				"References: <1@company.com> <2@company.com>\r\n" +
+				"\r\n" +
+				"Thanks\r\n",
+			subject:   "Re: Standup moved",
+			body:      "Thanks\n",
+			inReplyTo: "<2@company.com>",
+		},
+		{
+			name: "multipart prefers text/plain",
+			raw: "Subject: Launch\r\n" +
+				"Content-Type: multipart/alternative; boundary=b1\r\n" +
+				"\r\n" +
+				"--b1\r\n" +
+				"Content-Type: text/html\r\n" +
+				"\r\n" +
+				"<p>We launched</p>\r\n" +
+				"--b1\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"V2UgbGF1\r\n" +
+				"bmNoZWQ=\r\n" +
+				"--b1--\r\n",
+			subject: "Launch",
+			body:    "We launched",
+		},
+		{
+			name: "multipart without text/plain falls back to the first part",
+			raw: "Subject: Launch\r\n" +
+				"Content-Type: multipart/alternative; boundary=b1\r\n" +
+				"\r\n" +
+				"--b1\r\n" +
+				"Content-Type: text/html\r\n" +
+				"\r\n" +
+				"<p>We launched</p>\r\n" +
+				"--b1--\r\n",
+			subject: "Launch",
+			body:    "<p>We launched</p>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseInboundMessage([]byte(tt.raw))
+			if err != nil {
+				t.Fatalf("parseInboundMessage: %v", err)
+			}
+			if msg.Subject != tt.subject {
+				t.Errorf("Subject = %q, want %q", msg.Subject, tt.subject)
+			}
+			if msg.Body != tt.body {
+				t.Errorf("Body = %q, want %q", msg.Body, tt.body)
+			}
+			if msg.MessageID != tt.messageID {
+				t.Errorf("MessageID = %q, want %q", msg.MessageID, tt.messageID)
+			}
+			if msg.InReplyTo != tt.inReplyTo {
+				t.Errorf("InReplyTo = %q, want %q", msg.InReplyTo, tt.inReplyTo)
+			}
+		})
+	}
+}
+
+func TestParseInboundMessageRejectsMalformedHeaders(t *testing.T) {
+	if _, err := parseInboundMessage([]byte("not a header line\r\n\r\nbody\r\n")); err == nil {
+		t.Error("Expected an error for a message without valid headers")
+	}
+}
+
+// A message sent to several groups is stored once per group, each copy with
+// its own group and the envelope sender
+func TestGroupMessagesForMultipleRecipients(t *testing.T) {
+	parsed := &GroupMessage{Subject: "Launch", Body: "We launched", MessageID: "<1@company.com>"}
+	msgs := groupMessagesFor(parsed, "achen", []string{"eng", "design", "all-hands"})
+
+	if len(msgs) != 3 {
+		t.Fatalf("Got %d messages, want 3", len(msgs))
+	}
+	for i, group := range []string{"eng", "design", "all-hands"} {
+		msg := msgs[i]
+		if msg.GroupUsername != group || msg.SenderUsername != "achen" {
+			t.Errorf("Message %d is for %s from %s, want %s from achen", i, msg.GroupUsername, msg.SenderUsername, group)
+		}
+		if msg.Subject != parsed.Subject || msg.Body != parsed.Body || msg.MessageID != parsed.MessageID {
+			t.Errorf("Message %d = %+v, want the parsed fields of %+v", i, msg, parsed)
+		}
+	}
+	if parsed.GroupUsername != "" {
+		t.Errorf("Parsed message was modified: %+v", parsed)
+	}
+	msgs[0].Subject = "changed"
+	if msgs[1].Subject != "Launch" {
+		t.Error("Copies share storage")
+	}
+}
+
+// Envelope checks that don't need a database: sender lookup, command order,
+// recipient syntax and relaying
+func TestSMTPSessionEnvelope(t *testing.T) {
+	emailDomain = "company.com"
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go handleSMTPConnection(server)
+
+	text := textproto.NewConn(client)
+	expect := func(command string, code int) {
+		t.Helper()
+		if command != "" {
+			if err := text.PrintfLine("%s", command); err != nil {
+				t.Fatalf("Failed to send %q: %v", command, err)
+			}
+		}
+		got, msg, err := text.ReadResponse(0)
+		if err != nil && got == 0 {
+			t.Fatalf("Failed to read reply to %q: %v", command, err)
+		}
+		if got != code {
+			t.Errorf("%q: got %d %s, want %d", command, got, msg, code)
+		}
+	}
+
+	expect("", 220)
+	expect("EHLO client.example", 250)
+	expect("RCPT TO:<eng@company.com>", 503)
+	expect("DATA", 503)
+	expect("MAIL FROM:<nobody@company.com>", 550)
+	expect("MAIL FROM:<achen@elsewhere.com>", 550)
+	expect("MAIL FROM:achen@company.com", 501)
+	expect("MAIL FROM:<ACHEN@Company.com>", 250)
+	expect("MAIL FROM:<achen@company.com>", 503)
+	expect("RCPT TO:eng@company.com", 501)
+	expect("RCPT TO:<eng>", 501)
+	expect("RCPT TO:<eng@elsewhere.com>", 550)
+	expect("DATA", 503)
+	expect("RSET", 250)
+	expect("NOOP", 250)
+	expect("XYZZY", 502)
+	expect("QUIT", 221)
+}
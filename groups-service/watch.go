@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Name of the membership consumer's row in watch_checkpoints
+const groupWatchConsumer = "group-events"
+
+const (
+	watchRetryInterval = 5 * time.Second
+	watchLockInterval  = 30 * time.Second
+)
+
+// A change to a group: membership changes observed through the SpiceDB Watch
+// API, plus group edits and new messages recorded by the handlers
+type GroupEvent struct {
+	ID              int64           `json:"id"`
+	Type            string          `json:"type"`
+	GroupUsername   string          `json:"group_username"`
+	SubjectType     string          `json:"subject_type,omitempty"`
+	SubjectID       string          `json:"subject_id,omitempty"`
+	SubjectRelation string          `json:"subject_relation,omitempty"`
+	Role            string          `json:"role,omitempty"`
+	PreviousRole    string          `json:"previous_role,omitempty"`
+	Zedtoken        string          `json:"zedtoken,omitempty"`
+	Actor           string          `json:"actor,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	CreatedAt       string          `json:"created_at"`
+
+	// Where the event sits in the log, for readers resuming after it
+	position eventPosition
+}
+
+// Map a SpiceDB group relation to the role names used by the API
+func relationRole(relation string) string {
+	if relation == "admin" {
+		return "OWNER"
+	}
+	return "MEMBER"
+}
+
+// Turn the updates of one Watch response into membership events. Updates are
+// paired up per group and subject: a relation deleted and another written in
+// the same revision is a role change; anything else is an add or a removal.
+func buildGroupEvents(updates []*v1.RelationshipUpdate, zedtoken string) []GroupEvent {
+	type subjectKey struct {
+		group, subjectType, subjectID, subjectRelation string
+	}
+	type subjectChanges struct {
+		written   []string
+		deleted   []string
+		expiresAt map[string]time.Time
+	}
+
+	var order []subjectKey
+	changes := make(map[subjectKey]*subjectChanges)
+	for _, update := range updates {
+		rel := update.Relationship
+		key := subjectKey{
+			group:           rel.Resource.ObjectId,
+			subjectType:     rel.Subject.Object.ObjectType,
+			subjectID:       rel.Subject.Object.ObjectId,
+			subjectRelation: rel.Subject.OptionalRelation,
+		}
+		if changes[key] == nil {
+			changes[key] = &subjectChanges{expiresAt: make(map[string]time.Time)}
+			order = append(order, key)
+		}
+		if update.Operation == v1.RelationshipUpdate_OPERATION_DELETE {
+			changes[key].deleted = append(changes[key].deleted, rel.Relation)
+		} else {
+			changes[key].written = append(changes[key].written, rel.Relation)
+			if expiresAt, ok := relationshipExpiry(rel); ok {
+				changes[key].expiresAt[rel.Relation] = expiresAt.Local()
+			}
+		}
+	}
+
+	var events []GroupEvent
+	for _, key := range order {
+		change := changes[key]
+		event := GroupEvent{
+			GroupUsername:   key.group,
+			SubjectType:     key.subjectType,
+			SubjectID:       key.subjectID,
+			SubjectRelation: key.subjectRelation,
+			Zedtoken:        zedtoken,
+		}
+
+		switch {
+		case len(change.written) > 0 && len(change.deleted) > 0:
+			if relationRole(change.written[0]) == relationRole(change.deleted[0]) {
+				continue
+			}
+			event.Type = "role.changed"
+			event.Role = relationRole(change.written[0])
+			event.PreviousRole = relationRole(change.deleted[0])
+		case len(change.written) > 0:
+			event.Type = "member.added"
+			event.Role = relationRole(change.written[0])
+			if expiresAt, ok := change.expiresAt[change.written[0]]; ok {
+				event.Data = eventData(map[string]string{"expires_at": expiresAt.Format("2006-01-02 15:04:05")})
+			}
+		default:
+			event.Type = "member.removed"
+			event.PreviousRole = relationRole(change.deleted[0])
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// Store a response's events and membership metadata changes and move the
+// checkpoint past it in one transaction, so each revision is recorded exactly
+// once even across restarts
+func storeGroupEvents(events []GroupEvent, updates []*v1.RelationshipUpdate, zedtoken string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range events {
+		// Rewriting an existing relationship, such as extending its expiry,
+		// looks like an add in the Watch stream
+		if events[i].Type == "member.added" {
+			existing, err := hasOpenMembershipInterval(tx, &events[i])
+			if err != nil {
+				return err
+			}
+			if existing {
+				events[i].Type = "member.updated"
+			}
+		}
+		if err := recordGroupEvent(tx, &events[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := applyMembershipMetadataUpdates(tx, updates); err != nil {
+		return err
+	}
+	if err := applyMembershipIntervalUpdates(tx, updates, zedtoken); err != nil {
+		return err
+	}
+
+	if err := saveWatchCheckpoint(tx, zedtoken); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Start the consumer from a snapshot of every group relationship, so the
+// membership history is complete from here on. Returns the snapshot's
+// revision, or "" when there are no relationships to read a revision from.
+func bootstrapGroupWatch() (string, error) {
+	relationships, zedtoken, err := readAllGroupRelationships()
+	if err != nil || zedtoken == "" {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if err := resyncMembershipIntervals(tx, relationships, zedtoken); err != nil {
+		return "", err
+	}
+
+	if err := saveWatchCheckpoint(tx, zedtoken); err != nil {
+		return "", err
+	}
+
+	return zedtoken, tx.Commit()
+}
+
+func saveWatchCheckpoint(tx *sql.Tx, zedtoken string) error {
+	_, err := tx.Exec(`
+		INSERT INTO watch_checkpoints (consumer, zedtoken, updated_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP)
+		ON CONFLICT (consumer) DO UPDATE SET zedtoken = EXCLUDED.zedtoken, updated_at = EXCLUDED.updated_at
+	`, groupWatchConsumer, zedtoken)
+	return err
+}
+
+func getWatchCheckpoint(consumer string) (string, error) {
+	var zedtoken string
+	err := db.QueryRow("SELECT zedtoken FROM watch_checkpoints WHERE consumer = $1", consumer).Scan(&zedtoken)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return zedtoken, err
+}
+
+// Consume group relationship changes from SpiceDB until the stream fails
+func watchGroupRelationships(ctx context.Context) error {
+	checkpoint, err := getWatchCheckpoint(groupWatchConsumer)
+	if err != nil {
+		return err
+	}
+	if checkpoint == "" {
+		checkpoint, err = bootstrapGroupWatch()
+		if err != nil {
+			return err
+		}
+	}
+
+	request := &v1.WatchRequest{
+		OptionalObjectTypes: []string{"group"},
+	}
+	if checkpoint != "" {
+		request.OptionalStartCursor = &v1.ZedToken{Token: checkpoint}
+		log.Printf("[WATCH] resuming group watch from %s", checkpoint)
+	} else {
+		// No relationships at all yet, so start from now
+		log.Printf("[WATCH] starting group watch at head revision")
+	}
+
+	stream, err := spicedbClient.Watch(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			// A checkpoint older than SpiceDB's garbage collection window can't be
+			// resumed from; start again from now rather than retrying forever
+			if checkpoint != "" && (status.Code(err) == codes.FailedPrecondition || status.Code(err) == codes.InvalidArgument) {
+				log.Printf("[WATCH] checkpoint %s can no longer be resumed, changes since then are lost: %v", checkpoint, err)
+				if _, dbErr := db.Exec("DELETE FROM watch_checkpoints WHERE consumer = $1", groupWatchConsumer); dbErr != nil {
+					log.Printf("[WATCH] failed to reset checkpoint: %v", dbErr)
+				}
+			}
+			return err
+		}
+
+		zedtoken := resp.ChangesThrough.GetToken()
+		events := buildGroupEvents(resp.Updates, zedtoken)
+		if err := storeGroupEvents(events, resp.Updates, zedtoken); err != nil {
+			return err
+		}
+		checkpoint = zedtoken
+
+		for _, event := range events {
+			log.Printf("[WATCH] event=%s group=%s subject=%s:%s role=%s previous_role=%s zedtoken=%s",
+				event.Type, event.GroupUsername, event.SubjectType, event.SubjectID, event.Role, event.PreviousRole, zedtoken)
+		}
+	}
+}
+
+// Run the membership change consumer. Only one replica consumes at a time: the
+// one holding a session-level advisory lock on a dedicated connection.
+func startGroupWatcher() {
+	go func() {
+		for {
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				log.Printf("[WATCH] failed to get a database connection: %v", err)
+				time.Sleep(watchRetryInterval)
+				continue
+			}
+
+			var locked bool
+			err = conn.QueryRowContext(context.Background(), "SELECT pg_try_advisory_lock(hashtext($1))", "watch:"+groupWatchConsumer).Scan(&locked)
+			if err != nil || !locked {
+				if err != nil {
+					log.Printf("[WATCH] failed to take the consumer lock: %v", err)
+				}
+				conn.Close()
+				time.Sleep(watchLockInterval)
+				continue
+			}
+
+			log.Printf("[WATCH] this replica is consuming group relationship changes")
+			for {
+				err := watchGroupRelationships(context.Background())
+				log.Printf("[WATCH] group watch stopped, retrying in %v: %v", watchRetryInterval, err)
+				time.Sleep(watchRetryInterval)
+
+				// Give up the lock if our connection died so another replica can take over
+				if err := conn.PingContext(context.Background()); err != nil {
+					log.Printf("[WATCH] lost the consumer lock connection: %v", err)
+					break
+				}
+			}
+			conn.Close()
+		}
+	}()
+}
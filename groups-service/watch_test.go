@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+func groupUpdate(operation v1.RelationshipUpdate_Operation, group, relation, subjectType, subjectID string) *v1.RelationshipUpdate {
+	return &v1.RelationshipUpdate{
+		Operation: operation,
+		Relationship: &v1.Relationship{
+			Resource: &v1.ObjectReference{ObjectType: "group", ObjectId: group},
+			Relation: relation,
+			Subject: &v1.SubjectReference{
+				Object: &v1.ObjectReference{ObjectType: subjectType, ObjectId: subjectID},
+			},
+		},
+	}
+}
+
+const (
+	opTouch  = v1.RelationshipUpdate_OPERATION_TOUCH
+	opCreate = v1.RelationshipUpdate_OPERATION_CREATE
+	opDelete = v1.RelationshipUpdate_OPERATION_DELETE
+)
+
+func TestBuildGroupEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []*v1.RelationshipUpdate
+		want    []GroupEvent
+	}{
+		{
+			name:    "member added",
+			updates: []*v1.RelationshipUpdate{groupUpdate(opTouch, "eng", "member", "user", "tkim")},
+			want:    []GroupEvent{{Type: "member.added", GroupUsername: "eng", SubjectType: "user", SubjectID: "tkim", Role: "MEMBER"}},
+		},
+		{
+			name:    "owner created",
+			updates: []*v1.RelationshipUpdate{groupUpdate(opCreate, "eng", "admin", "user", "achen")},
+			want:    []GroupEvent{{Type: "member.added", GroupUsername: "eng", SubjectType: "user", SubjectID: "achen", Role: "OWNER"}},
+		},
+		{
+			name:    "member removed",
+			updates: []*v1.RelationshipUpdate{groupUpdate(opDelete, "eng", "admin", "service_account", "ci")},
+			want:    []GroupEvent{{Type: "member.removed", GroupUsername: "eng", SubjectType: "service_account", SubjectID: "ci", PreviousRole: "OWNER"}},
+		},
+		{
+			name: "delete and write in one revision is a role change",
+			updates: []*v1.RelationshipUpdate{
+				groupUpdate(opDelete, "eng", "member", "user", "tkim"),
+				groupUpdate(opTouch, "eng", "admin", "user", "tkim"),
+			},
+			want: []GroupEvent{{Type: "role.changed", GroupUsername: "eng", SubjectType: "user", SubjectID: "tkim", Role: "OWNER", PreviousRole: "MEMBER"}},
+		},
+		{
+			name: "rewriting the same role is not an event",
+			updates: []*v1.RelationshipUpdate{
+				groupUpdate(opDelete, "eng", "member", "user", "tkim"),
+				groupUpdate(opTouch, "eng", "member", "user", "tkim"),
+			},
+		},
+		{
+			name: "subjects and groups are kept apart, in order of first appearance",
+			updates: []*v1.RelationshipUpdate{
+				groupUpdate(opTouch, "eng", "member", "user", "tkim"),
+				groupUpdate(opDelete, "design", "member", "user", "tkim"),
+				groupUpdate(opTouch, "eng", "member", "user", "cmorgan"),
+				groupUpdate(opTouch, "eng", "member", "group", "design"),
+			},
+			want: []GroupEvent{
+				{Type: "member.added", GroupUsername: "eng", SubjectType: "user", SubjectID: "tkim", Role: "MEMBER"},
+				{Type: "member.removed", GroupUsername: "design", SubjectType: "user", SubjectID: "tkim", PreviousRole: "MEMBER"},
+				{Type: "member.added", GroupUsername: "eng", SubjectType: "user", SubjectID: "cmorgan", Role: "MEMBER"},
+				{Type: "member.added", GroupUsername: "eng", SubjectType: "group", SubjectID: "design", Role: "MEMBER"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildGroupEvents(tt.updates, "token-1")
+			if len(got) != len(tt.want) {
+				t.Fatalf("Got %d events %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i, want := range tt.want {
+				want.Zedtoken = "token-1"
+				event := got[i]
+				if event.Type != want.Type || event.GroupUsername != want.GroupUsername ||
+					event.SubjectType != want.SubjectType || event.SubjectID != want.SubjectID ||
+					event.Role != want.Role || event.PreviousRole != want.PreviousRole || event.Zedtoken != want.Zedtoken {
+					t.Errorf("Event %d = %+v, want %+v", i, event, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildGroupEventsSubjectRelation(t *testing.T) {
+	update := groupUpdate(opTouch, "eng", "member", "group", "design")
+	update.Relationship.Subject.OptionalRelation = "member"
+
+	events := buildGroupEvents([]*v1.RelationshipUpdate{update, groupUpdate(opTouch, "eng", "member", "group", "design")}, "token-1")
+	if len(events) != 2 {
+		t.Fatalf("Got %d events, want one for group:design#member and one for group:design", len(events))
+	}
+	if events[0].SubjectRelation != "member" || events[1].SubjectRelation != "" {
+		t.Errorf("Subject relations = %q, %q; want \"member\", \"\"", events[0].SubjectRelation, events[1].SubjectRelation)
+	}
+}
+
+func TestBuildGroupEventsExpiry(t *testing.T) {
+	expiresAt := time.Date(2030, 6, 1, 12, 0, 0, 0, time.UTC)
+	update := groupUpdate(opTouch, "eng", "member", "user", "tkim")
+	update.Relationship.OptionalCaveat = expiryCaveat(expiresAt)
+
+	events := buildGroupEvents([]*v1.RelationshipUpdate{update}, "token-1")
+	if len(events) != 1 {
+		t.Fatalf("Got %d events, want 1", len(events))
+	}
+
+	var data map[string]string
+	if err := json.Unmarshal(events[0].Data, &data); err != nil {
+		t.Fatalf("Event data %s: %v", events[0].Data, err)
+	}
+	if want := expiresAt.Local().Format("2006-01-02 15:04:05"); data["expires_at"] != want {
+		t.Errorf("expires_at = %q, want %q", data["expires_at"], want)
+	}
+
+	// Removing an expiring membership carries no expiry
+	update.Operation = opDelete
+	events = buildGroupEvents([]*v1.RelationshipUpdate{update}, "token-2")
+	if len(events) != 1 || events[0].Data != nil {
+		t.Errorf("Removal events = %+v, want one without data", events)
+	}
+}
+
+func TestRelationRole(t *testing.T) {
+	for relation, want := range map[string]string{"admin": "OWNER", "member": "MEMBER", "": "MEMBER"} {
+		if got := relationRole(relation); got != want {
+			t.Errorf("relationRole(%q) = %q, want %q", relation, got, want)
+		}
+	}
+}
@@ -0,0 +1,740 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	webhookPollInterval   = 2 * time.Second
+	webhookBatchSize      = 50
+	webhookBaseBackoff    = 30 * time.Second
+	webhookMaxBackoff     = time.Hour
+	webhookTimeout        = 10 * time.Second
+	webhookLease          = 10 * time.Minute
+	webhookPurgeInterval  = time.Hour
+	webhookRetiredKeep    = 7 * 24 * time.Hour
+	webhookSecretPrefix   = "whsec_"
+	webhookDispatchCursor = "webhooks"
+)
+
+// Group events that can be delivered to webhooks
+var validWebhookEvents = map[string]bool{
+	"group.created":  true,
+	"group.deleted":  true,
+	"member.added":   true,
+	"member.removed": true,
+	"role.changed":   true,
+}
+
+var (
+	webhookMaxAttempts = 8
+	webhookClient      = &http.Client{
+		Timeout: webhookTimeout,
+		// No proxy, so the address checked at dial time is the one connected to
+		Transport: &http.Transport{DialContext: dialWebhookTarget},
+	}
+
+	// Hosts that may be webhook targets even though they resolve to internal
+	// addresses, from WEBHOOK_ALLOWED_HOSTS
+	webhookAllowedHosts = map[string]bool{}
+
+	// Carrier-grade NAT space (RFC 6598), which net.IP.IsPrivate leaves out but
+	// cloud providers use for internal services
+	sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+)
+
+type WebhookSubscription struct {
+	ID            int      `json:"id"`
+	GroupUsername string   `json:"group_username,omitempty"`
+	URL           string   `json:"url"`
+	EventTypes    []string `json:"event_types"`
+	SecretPrefix  string   `json:"secret_prefix"`
+	CreatedBy     string   `json:"created_by"`
+	CreatedAt     string   `json:"created_at"`
+	Secret        string   `json:"secret,omitempty"`
+}
+
+type WebhookDelivery struct {
+	ID             int64  `json:"id"`
+	EventID        int64  `json:"event_id"`
+	EventType      string `json:"event_type"`
+	GroupUsername  string `json:"group_username"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	LastStatusCode int    `json:"last_status_code,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+	NextAttemptAt  string `json:"next_attempt_at,omitempty"`
+	DeliveredAt    string `json:"delivered_at,omitempty"`
+	CreatedAt      string `json:"created_at"`
+}
+
+func startWebhookWorker() {
+	if v, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS")); err == nil && v > 0 {
+		webhookMaxAttempts = v
+	}
+	for _, host := range strings.Split(os.Getenv("WEBHOOK_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			webhookAllowedHosts[host] = true
+		}
+	}
+
+	log.Printf("Webhook delivery enabled (max attempts %d)", webhookMaxAttempts)
+	go func() {
+		for {
+			dispatchWebhookEvents()
+			processPendingWebhookDeliveries()
+			time.Sleep(webhookPollInterval)
+		}
+	}()
+	go func() {
+		for {
+			purgeRetiredWebhooks()
+			time.Sleep(webhookPurgeInterval)
+		}
+	}()
+}
+
+// Retire a deleted group's subscriptions, in the transaction that deletes the
+// group and after group.deleted has been recorded as eventID. A retired
+// subscription is only matched to events up to that one, so a group created
+// later under the same username doesn't have its events sent to the URLs the
+// old group's admins registered.
+func retireGroupWebhooks(tx *sql.Tx, groupUsername string, eventID int64) error {
+	_, err := tx.Exec(`
+		UPDATE webhook_subscriptions
+		SET retired_after_event_id = $2, retired_at = CURRENT_TIMESTAMP
+		WHERE group_username = $1 AND retired_after_event_id IS NULL
+	`, groupUsername, eventID)
+	return err
+}
+
+// Delete retired subscriptions, with their delivery logs, once they have
+// nothing left to send and have been kept for a while for inspection
+func purgeRetiredWebhooks() {
+	result, err := db.Exec(`
+		DELETE FROM webhook_subscriptions s
+		WHERE s.retired_at < CURRENT_TIMESTAMP - $1::int * INTERVAL '1 second'
+		  AND NOT EXISTS (SELECT 1 FROM webhook_deliveries d WHERE d.subscription_id = s.id AND d.status = 'PENDING')
+	`, int(webhookRetiredKeep.Seconds()))
+	if err != nil {
+		log.Printf("[WEBHOOK] failed to purge retired subscriptions: %v", err)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		log.Printf("[WEBHOOK] purged %d retired subscriptions", affected)
+	}
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := time.Duration(float64(webhookBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if backoff > webhookMaxBackoff || backoff <= 0 {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+// Whether an address is inside the network rather than on the internet: a
+// subscriber could otherwise have the service call its own admin endpoints, the
+// cloud metadata service or anything else only reachable from here
+func isInternalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// Check that a webhook URL's host resolves only to public addresses, unless
+// the platform has allowed it
+func checkWebhookTarget(host string) error {
+	if webhookAllowedHosts[strings.ToLower(host)] {
+		return nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s", host)
+	}
+	for _, ip := range ips {
+		if isInternalAddress(ip) {
+			return fmt.Errorf("%s resolves to internal address %s", host, ip)
+		}
+	}
+	return nil
+}
+
+// Dial a subscriber, checking the address actually connected to so a host that
+// re-resolves to an internal address after the subscription was created, or a
+// redirect to one, is refused too
+func dialWebhookTarget(ctx context.Context, network string, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if !webhookAllowedHosts[strings.ToLower(host)] {
+		dialer.Control = func(network string, address string, _ syscall.RawConn) error {
+			ipHost, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(ipHost); ip == nil || isInternalAddress(ip) {
+				return fmt.Errorf("refusing to connect to internal address %s", ipHost)
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// Sign a payload as HMAC-SHA256 over "<timestamp>.<body>", so receivers can
+// reject replayed deliveries by their timestamp
+func signWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Queue a delivery for every subscription that wants each new group event. The
+// cursor row is locked for the whole pass so only one replica fans out at a time.
+// It holds the ID of the last event fanned out; readGroupEvents resumes after
+// that event's position, so events that commit late are not skipped.
+func dispatchWebhookEvents() {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("[WEBHOOK] failed to begin transaction: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO event_cursors (consumer, last_event_id)
+		SELECT $1, COALESCE(MAX(id), 0) FROM group_events
+		ON CONFLICT (consumer) DO NOTHING
+	`, webhookDispatchCursor)
+	if err != nil {
+		log.Printf("[WEBHOOK] failed to initialize dispatch cursor: %v", err)
+		return
+	}
+
+	var lastEventID int64
+	err = tx.QueryRow("SELECT last_event_id FROM event_cursors WHERE consumer = $1 FOR UPDATE SKIP LOCKED", webhookDispatchCursor).Scan(&lastEventID)
+	if err == sql.ErrNoRows {
+		// Another replica is dispatching
+		return
+	}
+	if err != nil {
+		log.Printf("[WEBHOOK] failed to read dispatch cursor: %v", err)
+		return
+	}
+
+	after, err := groupEventPosition(lastEventID)
+	if err != nil {
+		log.Printf("[WEBHOOK] failed to resolve dispatch cursor: %v", err)
+		return
+	}
+	events, err := readGroupEvents(after, "")
+	if err != nil {
+		log.Printf("[WEBHOOK] failed to read group events: %v", err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	queued := 0
+	for _, event := range events {
+		if !validWebhookEvents[event.Type] {
+			continue
+		}
+		result, err := tx.Exec(`
+			INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, group_username)
+			SELECT id, $1, $2, $3
+			FROM webhook_subscriptions
+			WHERE $2 = ANY(event_types) AND (group_username IS NULL OR
+			      (group_username = $3 AND (retired_after_event_id IS NULL OR $1 <= retired_after_event_id)))
+			ON CONFLICT (subscription_id, event_id) DO NOTHING
+		`, event.ID, event.Type, event.GroupUsername)
+		if err != nil {
+			log.Printf("[WEBHOOK] failed to queue deliveries for event %d: %v", event.ID, err)
+			return
+		}
+		affected, _ := result.RowsAffected()
+		queued += int(affected)
+	}
+
+	_, err = tx.Exec("UPDATE event_cursors SET last_event_id = $1, updated_at = CURRENT_TIMESTAMP WHERE consumer = $2",
+		events[len(events)-1].ID, webhookDispatchCursor)
+	if err != nil {
+		log.Printf("[WEBHOOK] failed to advance dispatch cursor: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[WEBHOOK] failed to commit dispatch: %v", err)
+		return
+	}
+
+	if queued > 0 {
+		log.Printf("[WEBHOOK] queued %d deliveries for %d events", queued, len(events))
+	}
+}
+
+// POST one event to a subscriber, returning the response status code
+func sendWebhook(deliveryID int64, subscriptionURL string, secret string, event *GroupEvent) (int, error) {
+	body := eventData(event)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, subscriptionURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "groups-service-webhooks")
+	req.Header.Set("X-Webhook-Id", strconv.FormatInt(deliveryID, 10))
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhookPayload(secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("subscriber responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func processPendingWebhookDeliveries() {
+	pending, err := claimPendingWebhookDeliveries()
+	if err != nil {
+		log.Printf("[WEBHOOK] failed to claim pending deliveries: %v", err)
+		return
+	}
+
+	for _, p := range pending {
+		event, err := getGroupEvent(p.eventID)
+		if err != nil {
+			log.Printf("[WEBHOOK] failed to load event %d for delivery %d: %v", p.eventID, p.id, err)
+			continue
+		}
+
+		statusCode, err := sendWebhook(p.id, p.url, p.secret, event)
+		if err == nil {
+			_, err = db.Exec(`
+				UPDATE webhook_deliveries
+				SET status = 'SENT', attempts = attempts + 1, last_status_code = $1, last_error = NULL, delivered_at = CURRENT_TIMESTAMP
+				WHERE id = $2
+			`, statusCode, p.id)
+			if err != nil {
+				log.Printf("[WEBHOOK] failed to record delivery %d: %v", p.id, err)
+			}
+			log.Printf("[WEBHOOK] status=SENT delivery=%d event=%d url=%s", p.id, p.eventID, p.url)
+			continue
+		}
+
+		// Deliveries that keep failing are dead-lettered and kept for inspection
+		attempts := p.attempts + 1
+		status := "PENDING"
+		if attempts >= webhookMaxAttempts {
+			status = "DEAD"
+		}
+		nextAttempt := time.Now().Add(webhookBackoff(attempts))
+		_, dbErr := db.Exec(`
+			UPDATE webhook_deliveries
+			SET status = $1, attempts = $2, last_status_code = $3, last_error = $4, next_attempt_at = $5
+			WHERE id = $6
+		`, status, attempts, sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}, err.Error(), nextAttempt, p.id)
+		if dbErr != nil {
+			log.Printf("[WEBHOOK] failed to record delivery %d: %v", p.id, dbErr)
+		}
+		log.Printf("[WEBHOOK] status=%s delivery=%d event=%d url=%s attempts=%d error=%v", status, p.id, p.eventID, p.url, attempts, err)
+	}
+}
+
+type pendingWebhook struct {
+	id       int64
+	eventID  int64
+	attempts int
+	url      string
+	secret   string
+}
+
+// Lease due deliveries to this worker by pushing their next attempt past the
+// lease, so no transaction stays open while subscribers are called. A worker
+// that dies mid-batch leaves its deliveries to be retried once the lease runs
+// out. SKIP LOCKED lets several replicas share the queue.
+func claimPendingWebhookDeliveries() ([]pendingWebhook, error) {
+	rows, err := db.Query(`
+		WITH claimed AS (
+			UPDATE webhook_deliveries
+			SET next_attempt_at = CURRENT_TIMESTAMP + $2::int * INTERVAL '1 second'
+			WHERE id IN (
+				SELECT id FROM webhook_deliveries
+				WHERE status = 'PENDING' AND next_attempt_at <= CURRENT_TIMESTAMP
+				ORDER BY next_attempt_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, event_id, attempts, subscription_id
+		)
+		SELECT d.id, d.event_id, d.attempts, s.url, s.secret
+		FROM claimed d
+		JOIN webhook_subscriptions s ON s.id = d.subscription_id
+	`, webhookBatchSize, int(webhookLease.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []pendingWebhook
+	for rows.Next() {
+		var p pendingWebhook
+		if err := rows.Scan(&p.id, &p.eventID, &p.attempts, &p.url, &p.secret); err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
+
+// Check that the caller may manage webhooks for a group, or global webhooks
+// when groupUsername is empty
+func canManageWebhooks(c *gin.Context, groupUsername string) bool {
+	if groupUsername == "" {
+		username := currentUsername(c)
+		return username != "" && checkPlatformPermission(username, "manage_webhooks")
+	}
+	return checkPrincipalPermission(c, groupUsername, "manage_webhooks")
+}
+
+// Load a subscription, making sure it belongs to the scope named in the route
+func getWebhookSubscription(id string, groupUsername string) (*WebhookSubscription, error) {
+	var sub WebhookSubscription
+	var group sql.NullString
+	var createdAt time.Time
+	err := db.QueryRow(`
+		SELECT id, group_username, url, event_types, secret_prefix, created_by, created_at
+		FROM webhook_subscriptions
+		WHERE id = $1 AND COALESCE(group_username, '') = $2 AND retired_after_event_id IS NULL
+	`, id, groupUsername).Scan(&sub.ID, &group, &sub.URL, pq.Array(&sub.EventTypes), &sub.SecretPrefix, &sub.CreatedBy, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	sub.GroupUsername = group.String
+	sub.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+	return &sub, nil
+}
+
+func createWebhook(c *gin.Context) {
+	groupUsername := c.Param("username")
+	if !canManageWebhooks(c, groupUsername) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	type CreateWebhookRequest struct {
+		URL        string   `json:"url" binding:"required"`
+		EventTypes []string `json:"event_types" binding:"required"`
+	}
+
+	var req CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	parsed, err := url.Parse(req.URL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid url. Must be an absolute http or https URL"})
+		return
+	}
+	if err := checkWebhookTarget(parsed.Hostname()); err != nil {
+		log.Printf("[WEBHOOK] rejected url %s: %v", req.URL, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid url. Must not point to a loopback, link-local or private address"})
+		return
+	}
+	if len(req.EventTypes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one event type is required"})
+		return
+	}
+	for _, eventType := range req.EventTypes {
+		if !validWebhookEvents[eventType] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid event type '%s'. Must be group.created, group.deleted, member.added, member.removed or role.changed", eventType)})
+			return
+		}
+	}
+
+	if groupUsername != "" {
+		exists, err := groupExists(groupUsername)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check group existence"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+	}
+
+	// Payloads are signed with the secret, so it has to be kept in full; like an
+	// API key it is only returned when the subscription is created
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate webhook secret"})
+		return
+	}
+	secret := webhookSecretPrefix + hex.EncodeToString(raw)
+	secretPrefix := secret[:len(webhookSecretPrefix)+8]
+
+	principal := currentPrincipal(c)
+	sub := WebhookSubscription{
+		GroupUsername: groupUsername,
+		URL:           req.URL,
+		EventTypes:    req.EventTypes,
+		SecretPrefix:  secretPrefix,
+		CreatedBy:     principal.Actor(),
+		CreatedAt:     time.Now().Format("2006-01-02 15:04:05"),
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO webhook_subscriptions (group_username, url, event_types, secret, secret_prefix, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, nullString(groupUsername), req.URL, pq.Array(req.EventTypes), secret, secretPrefix, principal.Actor()).Scan(&sub.ID)
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "webhook.created",
+			GroupUsername: groupUsername,
+			Subject:       strconv.Itoa(sub.ID),
+			After:         sub,
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to create webhook for %q: %v", groupUsername, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+
+	sub.Secret = secret
+	c.JSON(http.StatusCreated, sub)
+}
+
+func getWebhooks(c *gin.Context) {
+	groupUsername := c.Param("username")
+	if !canManageWebhooks(c, groupUsername) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, url, event_types, secret_prefix, created_by, created_at
+		FROM webhook_subscriptions
+		WHERE COALESCE(group_username, '') = $1 AND retired_after_event_id IS NULL
+		ORDER BY id
+	`, groupUsername)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+		return
+	}
+	defer rows.Close()
+
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		sub := WebhookSubscription{GroupUsername: groupUsername}
+		var createdAt time.Time
+		if err := rows.Scan(&sub.ID, &sub.URL, pq.Array(&sub.EventTypes), &sub.SecretPrefix, &sub.CreatedBy, &createdAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan webhook"})
+			return
+		}
+		sub.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		subs = append(subs, sub)
+	}
+
+	c.JSON(http.StatusOK, subs)
+}
+
+func deleteWebhook(c *gin.Context) {
+	groupUsername := c.Param("username")
+	if !canManageWebhooks(c, groupUsername) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	sub, err := getWebhookSubscription(c.Param("id"), groupUsername)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Deliveries go with the subscription
+	_, err = tx.Exec("DELETE FROM webhook_subscriptions WHERE id = $1", sub.ID)
+	if err == nil {
+		err = recordRequestAuditEventTx(c, tx, AuditEvent{
+			Action:        "webhook.deleted",
+			GroupUsername: groupUsername,
+			Subject:       strconv.Itoa(sub.ID),
+			Before:        sub,
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to delete webhook %d: %v", sub.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// List a subscription's deliveries, newest first, optionally by status
+func getWebhookDeliveries(c *gin.Context) {
+	groupUsername := c.Param("username")
+	if !canManageWebhooks(c, groupUsername) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	sub, err := getWebhookSubscription(c.Param("id"), groupUsername)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	status := c.Query("status")
+	if status != "" && status != "PENDING" && status != "SENT" && status != "DEAD" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status. Must be PENDING, SENT or DEAD"})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, event_id, event_type, group_username, status, attempts, COALESCE(last_status_code, 0),
+		       COALESCE(last_error, ''), next_attempt_at, delivered_at, created_at
+		FROM webhook_deliveries
+		WHERE subscription_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY id DESC
+		LIMIT 200
+	`, sub.ID, status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook deliveries"})
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var nextAttemptAt, deliveredAt sql.NullTime
+		var createdAt time.Time
+		err := rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.GroupUsername, &d.Status, &d.Attempts, &d.LastStatusCode,
+			&d.LastError, &nextAttemptAt, &deliveredAt, &createdAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan webhook delivery"})
+			return
+		}
+		if d.Status == "PENDING" && nextAttemptAt.Valid {
+			d.NextAttemptAt = nextAttemptAt.Time.Format("2006-01-02 15:04:05")
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = deliveredAt.Time.Format("2006-01-02 15:04:05")
+		}
+		d.CreatedAt = createdAt.Format("2006-01-02 15:04:05")
+		deliveries = append(deliveries, d)
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// Put a dead-lettered delivery back in the queue
+func redeliverWebhook(c *gin.Context) {
+	groupUsername := c.Param("username")
+	if !canManageWebhooks(c, groupUsername) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+
+	sub, err := getWebhookSubscription(c.Param("id"), groupUsername)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue webhook delivery"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE webhook_deliveries
+		SET status = 'PENDING', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND subscription_id = $2 AND status = 'DEAD'
+	`, c.Param("deliveryId"), sub.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue webhook delivery"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead-lettered delivery not found"})
+		return
+	}
+
+	err = recordRequestAuditEventTx(c, tx, AuditEvent{
+		Action:        "webhook.redelivered",
+		GroupUsername: groupUsername,
+		Subject:       strconv.Itoa(sub.ID),
+		After:         gin.H{"delivery_id": c.Param("deliveryId")},
+	})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue webhook delivery"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Delivery requeued"})
+}
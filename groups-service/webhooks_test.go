@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestIsInternalAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"100.63.255.255", false},
+		{"100.128.0.0", false},
+		{"::1", true},
+		{"::", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+		{"2606:4700::1111", false},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"::ffff:100.64.0.1", true},
+		{"::ffff:8.8.8.8", false},
+	}
+
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if ip == nil {
+			t.Fatalf("Failed to parse %s", tt.ip)
+		}
+		if got := isInternalAddress(ip); got != tt.want {
+			t.Errorf("isInternalAddress(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	body := []byte(`{"type":"member.added"}`)
+	signature := signWebhookPayload("whsec_test", "1700000000", body)
+
+	// HMAC-SHA256 of "1700000000.{body}" keyed with the secret
+	if want := "sha256=6f5583300f535dd7a8b30367fe3f03b779442240b22a2ab5a963a42eade6786e"; signature != want {
+		t.Errorf("Signature = %s, want %s", signature, want)
+	}
+	if signWebhookPayload("whsec_test", "1700000000", body) != signature {
+		t.Error("Signature is not deterministic")
+	}
+
+	changed := map[string]string{
+		"secret":    signWebhookPayload("whsec_other", "1700000000", body),
+		"timestamp": signWebhookPayload("whsec_test", "1700000001", body),
+		"body":      signWebhookPayload("whsec_test", "1700000000", []byte(`{"type":"member.removed"}`)),
+		// The separator keeps the timestamp and body apart
+		"split": signWebhookPayload("whsec_test", "170000000", []byte(`0.{"type":"member.added"}`)),
+	}
+	for name, other := range changed {
+		if other == signature {
+			t.Errorf("Changing the %s does not change the signature", name)
+		}
+	}
+}
+
+// Once a group is deleted its subscriptions get the group's events up to
+// group.deleted, and none from a group created afterwards under the same name
+func TestWebhooksRetiredWithDeletedGroup(t *testing.T) {
+	openTestDB(t)
+
+	groupUsername := fmt.Sprintf("webhook-test-%d", os.Getpid())
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM webhook_subscriptions WHERE group_username = $1`, groupUsername)
+		db.Exec(`DELETE FROM group_events WHERE group_username = $1`, groupUsername)
+		db.Exec(`DELETE FROM groups WHERE username = $1`, groupUsername)
+	})
+
+	// Start the dispatch cursor after any events already in the database
+	dispatchWebhookEvents()
+
+	if _, err := db.Exec(`INSERT INTO groups (username, name) VALUES ($1, $1)`, groupUsername); err != nil {
+		t.Fatalf("Failed to create group: %v", err)
+	}
+	var subID int
+	err := db.QueryRow(`
+		INSERT INTO webhook_subscriptions (group_username, url, event_types, secret, secret_prefix, created_by)
+		VALUES ($1, 'https://hooks.example.com/old', $2, 'whsec_test', 'whsec_te', 'achen')
+		RETURNING id
+	`, groupUsername, pq.Array([]string{"member.added", "group.deleted"})).Scan(&subID)
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+
+	added := &GroupEvent{Type: "member.added", GroupUsername: groupUsername, SubjectType: "user", SubjectID: "tkim", Role: "MEMBER"}
+	if err := recordGroupEvent(db, added); err != nil {
+		t.Fatalf("Failed to record event: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	deleted := &GroupEvent{Type: "group.deleted", GroupUsername: groupUsername}
+	if _, err := tx.Exec(`DELETE FROM groups WHERE username = $1`, groupUsername); err != nil {
+		t.Fatalf("Failed to delete group: %v", err)
+	}
+	if err := recordGroupEvent(tx, deleted); err != nil {
+		t.Fatalf("Failed to record event: %v", err)
+	}
+	if err := retireGroupWebhooks(tx, groupUsername, deleted.ID); err != nil {
+		t.Fatalf("retireGroupWebhooks: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit deletion: %v", err)
+	}
+
+	if _, err := db.Exec(`INSERT INTO groups (username, name) VALUES ($1, $1)`, groupUsername); err != nil {
+		t.Fatalf("Failed to recreate group: %v", err)
+	}
+	recreated := &GroupEvent{Type: "member.added", GroupUsername: groupUsername, SubjectType: "user", SubjectID: "cmorgan", Role: "MEMBER"}
+	if err := recordGroupEvent(db, recreated); err != nil {
+		t.Fatalf("Failed to record event: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		dispatchWebhookEvents()
+	}
+
+	rows, err := db.Query(`SELECT event_id FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY event_id`, subID)
+	if err != nil {
+		t.Fatalf("Failed to read deliveries: %v", err)
+	}
+	defer rows.Close()
+	var got []int64
+	for rows.Next() {
+		var eventID int64
+		if err := rows.Scan(&eventID); err != nil {
+			t.Fatalf("Failed to scan delivery: %v", err)
+		}
+		got = append(got, eventID)
+	}
+	if want := []int64{added.ID, deleted.ID}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Deliveries for events %v, want %v (event %d is the new group's)", got, want, recreated.ID)
+	}
+
+	// The new group's admins don't see, or manage, the old group's subscription
+	if _, err := getWebhookSubscription(fmt.Sprint(subID), groupUsername); err != sql.ErrNoRows {
+		t.Errorf("getWebhookSubscription of a retired subscription: err = %v, want sql.ErrNoRows", err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Postgres channel that carries stored zedtokens between replicas
+const zedtokenChannel = "group_zedtokens"
+
+type zedtokenNotification struct {
+	Group   string `json:"group"`
+	Token   string `json:"token,omitempty"`
+	Seq     int64  `json:"seq"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type cachedZedtoken struct {
+	token string
+	seq   int64
+}
+
+// In-process copy of each group's stored zedtoken, so permission checks don't
+// need a Postgres round-trip to pick their consistency. Entries only move
+// forward by zedtoken_seq. Writes on this replica update it directly and
+// writes on other replicas arrive through LISTEN/NOTIFY; while the listener is
+// disconnected the cache is bypassed, since it may be missing updates.
+type zedtokenCache struct {
+	mu        sync.RWMutex
+	entries   map[string]cachedZedtoken
+	listening bool
+}
+
+var (
+	zedtokens = &zedtokenCache{entries: make(map[string]cachedZedtoken)}
+
+	zedtokenCacheHits      = expvar.NewInt("zedtoken_cache_hits")
+	zedtokenCacheMisses    = expvar.NewInt("zedtoken_cache_misses")
+	zedtokenCacheBypasses  = expvar.NewInt("zedtoken_cache_bypasses")
+	zedtokenCacheEvictions = expvar.NewInt("zedtoken_cache_evictions")
+)
+
+func init() {
+	expvar.Publish("zedtoken_cache_hit_rate", expvar.Func(func() interface{} {
+		hits := zedtokenCacheHits.Value()
+		lookups := hits + zedtokenCacheMisses.Value() + zedtokenCacheBypasses.Value()
+		if lookups == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(lookups)
+	}))
+	expvar.Publish("zedtoken_cache_size", expvar.Func(func() interface{} {
+		zedtokens.mu.RLock()
+		defer zedtokens.mu.RUnlock()
+		return len(zedtokens.entries)
+	}))
+}
+
+// Look up a group's cached zedtoken, counting the hit, miss or bypass
+func (z *zedtokenCache) get(groupUsername string) (cachedZedtoken, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if !z.listening {
+		zedtokenCacheBypasses.Add(1)
+		return cachedZedtoken{}, false
+	}
+	entry, ok := z.entries[groupUsername]
+	if ok {
+		zedtokenCacheHits.Add(1)
+	} else {
+		zedtokenCacheMisses.Add(1)
+	}
+	return entry, ok
+}
+
+// Record a group's zedtoken unless a newer one is already cached
+func (z *zedtokenCache) set(groupUsername string, token string, seq int64) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if !z.listening {
+		return
+	}
+	if entry, ok := z.entries[groupUsername]; ok && entry.seq >= seq {
+		return
+	}
+	z.entries[groupUsername] = cachedZedtoken{token: token, seq: seq}
+}
+
+// Forget a deleted group, so a new group with the same username starts afresh
+func (z *zedtokenCache) evict(groupUsername string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if _, ok := z.entries[groupUsername]; ok {
+		delete(z.entries, groupUsername)
+		zedtokenCacheEvictions.Add(1)
+	}
+}
+
+// Drop every entry and start or stop serving from the cache
+func (z *zedtokenCache) reset(listening bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	z.entries = make(map[string]cachedZedtoken)
+	z.listening = listening
+}
+
+// Tell every replica about a stored zedtoken. Postgres delivers the notification
+// when the transaction commits, and drops it if the transaction rolls back.
+func notifyZedtoken(tx *sql.Tx, notification zedtokenNotification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("SELECT pg_notify($1, $2)", zedtokenChannel, string(payload))
+	return err
+}
+
+// Drop a deleted group's zedtoken from every replica's cache
+func evictGroupZedtoken(groupUsername string) {
+	zedtokens.evict(groupUsername)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Warning: Failed to evict cached zedtoken for group %s: %v", groupUsername, err)
+		return
+	}
+	defer tx.Rollback()
+	if err := notifyZedtoken(tx, zedtokenNotification{Group: groupUsername, Deleted: true}); err != nil {
+		log.Printf("Warning: Failed to evict cached zedtoken for group %s: %v", groupUsername, err)
+		return
+	}
+	tx.Commit()
+}
+
+// Apply a zedtoken stored by any replica to the cache
+func handleZedtokenNotification(payload string) {
+	var notification zedtokenNotification
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		log.Printf("Warning: Ignoring malformed zedtoken notification: %v", err)
+		return
+	}
+	if notification.Deleted {
+		zedtokens.evict(notification.Group)
+	} else {
+		zedtokens.set(notification.Group, notification.Token, notification.Seq)
+	}
+}
+
+// Serve the expvar metrics, which include runtime internals, to platform admins
+func getDebugVars(c *gin.Context) {
+	username := currentUsername(c)
+	if username == "" || !checkPlatformPermission(username, "view_metrics") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
+	}
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
+}
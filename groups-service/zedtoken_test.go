@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// Connect to the Postgres named by TEST_DATABASE_URL and apply the schema, or
+// skip when there is none to test against
+func openTestDB(t *testing.T) {
+	t.Helper()
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	var err error
+	db, err = sql.Open("postgres", databaseURL)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	schema, err := os.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatalf("Failed to read schema file: %v", err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("Failed to initialize database schema: %v", err)
+	}
+}
+
+// Concurrent writes to one group must run one at a time, each must see the
+// zedtoken_seq left by the write before it, and the token stored at the end
+// must be the one from the last write to take the lock.
+func TestWriteGroupRelationshipsSerializesConcurrentWrites(t *testing.T) {
+	openTestDB(t)
+
+	groupUsername := fmt.Sprintf("zedtoken-test-%d", os.Getpid())
+	if _, err := db.Exec(`INSERT INTO groups (username, name) VALUES ($1, $1)`, groupUsername); err != nil {
+		t.Fatalf("Failed to create group: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM groups WHERE username = $1`, groupUsername)
+		zedtokens.reset(false)
+	})
+
+	const writers = 20
+	var (
+		inFlight int32
+		issued   int64
+		mu       sync.Mutex
+		order    []int64
+		wg       sync.WaitGroup
+	)
+	errs := make(chan error, writers)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := writeGroupRelationships(groupUsername, func() (string, error) {
+				if n := atomic.AddInt32(&inFlight, 1); n != 1 {
+					return "", fmt.Errorf("%d writes to the group ran at once", n)
+				}
+				defer atomic.AddInt32(&inFlight, -1)
+
+				// The write before this one has committed, so its seq is visible
+				var seq int64
+				if err := db.QueryRow(`SELECT zedtoken_seq FROM groups WHERE username = $1`, groupUsername).Scan(&seq); err != nil {
+					return "", err
+				}
+				mu.Lock()
+				order = append(order, seq)
+				mu.Unlock()
+
+				return fmt.Sprintf("token-%d", atomic.AddInt64(&issued, 1)), nil
+			})
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i, seq := range order {
+		if seq != int64(i) {
+			t.Fatalf("Write %d saw zedtoken_seq %d, want %d (seen: %v)", i, seq, i, order)
+		}
+	}
+
+	var zedtoken string
+	var seq int64
+	if err := db.QueryRow(`SELECT zedtoken, zedtoken_seq FROM groups WHERE username = $1`, groupUsername).Scan(&zedtoken, &seq); err != nil {
+		t.Fatalf("Failed to read stored zedtoken: %v", err)
+	}
+	if seq != writers {
+		t.Errorf("zedtoken_seq = %d, want %d", seq, writers)
+	}
+	if want := fmt.Sprintf("token-%d", writers); zedtoken != want {
+		t.Errorf("Stored zedtoken = %s, want %s from the last write", zedtoken, want)
+	}
+}
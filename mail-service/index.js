@@ -46,10 +46,13 @@ const checkDocumentPermission = async (documentId, username, permission = 'view'
       })
     });
 
+    // Expiring group memberships are caveated on the current time; without it
+    // SpiceDB can only answer CONDITIONAL, which counts as no access
     const checkRequest = v1.CheckPermissionRequest.create({
       resource,
       permission,
-      subject
+      subject,
+      context: v1.PbStruct.fromJson({ now: new Date().toISOString() })
     });
 
     // Log the SpiceDB check request parameters